@@ -24,6 +24,27 @@ func main() {
 			Value:  "instance-terminations",
 			EnvVar: "PUDDING_INSTANCE_TERMINATIONS_QUEUE_NAME",
 		},
+		cli.StringFlag{
+			Name:   "instance-state-changes-queue-name",
+			Value:  "instance-state-changes",
+			EnvVar: "PUDDING_INSTANCE_STATE_CHANGES_QUEUE_NAME",
+		},
+		cli.StringFlag{
+			Name:   "instance-consoles-queue-name",
+			Value:  "instance-consoles",
+			EnvVar: "PUDDING_INSTANCE_CONSOLES_QUEUE_NAME",
+		},
+		cli.StringFlag{
+			Name:   "image-updates-queue-name",
+			Value:  "image-updates",
+			EnvVar: "PUDDING_IMAGE_UPDATES_QUEUE_NAME",
+		},
+		cli.StringFlag{
+			Name:   "R, aws-region",
+			Usage:  "the workers' own aws region",
+			Value:  "us-east-1",
+			EnvVar: "AWS_DEFAULT_REGION",
+		},
 		cli.StringFlag{
 			Name:   "A, auth-token",
 			Value:  "swordfish",
@@ -36,6 +57,36 @@ func main() {
 		lib.SentryDSNFlag,
 		lib.InstanceExpiryFlag,
 		lib.ImageExpiryFlag,
+		lib.InstanceBuildExpiryFlag,
+		lib.HistoryExpiryFlag,
+		lib.ImageSelectorsFlag,
+		lib.InitScriptKeysFlag,
+		lib.TopologyFlag,
+		lib.TagPolicyFlag,
+		cli.BoolFlag{
+			Name:   "init-script-source-binding",
+			Usage:  "only allow init scripts to be fetched from the ips of the instance they were built for",
+			EnvVar: "PUDDING_INIT_SCRIPT_SOURCE_BINDING",
+		},
+		cli.StringFlag{
+			Name:   "trusted-proxies",
+			Usage:  "comma-delimited ips or cidrs of the proxies whose X-Forwarded-For is trusted",
+			EnvVar: "PUDDING_TRUSTED_PROXIES",
+		},
+		cli.StringFlag{
+			Name:   "preview-unredact-token",
+			Usage:  "token required in the X-Pudding-Unredact-Token header to preview init scripts with redact=false",
+			EnvVar: "PUDDING_PREVIEW_UNREDACT_TOKEN",
+		},
+		cli.StringFlag{
+			Name: "instance-rsa",
+		},
+		cli.StringFlag{
+			Name: "Y, instance-yml",
+		},
+		cli.StringFlag{
+			Name: "T, init-script-template",
+		},
 		lib.DebugFlag,
 	}
 	app.Action = runServer
@@ -44,6 +95,21 @@ func main() {
 }
 
 func runServer(c *cli.Context) {
+	instanceRSA := c.String("instance-rsa")
+	if instanceRSA == "" {
+		instanceRSA = lib.GetInstanceRSAKey()
+	}
+
+	instanceYML := c.String("instance-yml")
+	if instanceYML == "" {
+		instanceYML = lib.GetInstanceYML()
+	}
+
+	initScriptTemplate := c.String("init-script-template")
+	if initScriptTemplate == "" {
+		initScriptTemplate = lib.GetInitScriptTemplate()
+	}
+
 	lib.WriteFlagsToEnv(c)
 
 	server.Main(&server.Config{
@@ -51,7 +117,8 @@ func runServer(c *cli.Context) {
 		AuthToken: c.String("auth-token"),
 		Debug:     c.Bool("debug"),
 
-		RedisURL: c.String("redis-url"),
+		RedisURL:  c.String("redis-url"),
+		AWSRegion: c.String("aws-region"),
 
 		SlackHookPath:       c.String("slack-hook-path"),
 		SlackUsername:       c.String("slack-username"),
@@ -60,12 +127,30 @@ func runServer(c *cli.Context) {
 
 		SentryDSN: c.String("sentry-dsn"),
 
-		InstanceExpiry: c.Int("instance-expiry"),
-		ImageExpiry:    c.Int("image-expiry"),
+		InstanceExpiry:      c.Int("instance-expiry"),
+		ImageExpiry:         c.Int("image-expiry"),
+		InstanceBuildExpiry: c.Int("instance-build-expiry"),
+		HistoryExpiry:       c.Int("history-expiry"),
+
+		ImageSelectors: c.String("image-selectors"),
+		InitScriptKeys: c.String("init-script-keys"),
+		Topology:       c.String("topology"),
+		TagPolicy:      c.String("tag-policy"),
+
+		InitScriptSourceBinding: c.Bool("init-script-source-binding"),
+		TrustedProxies:          c.String("trusted-proxies"),
+		PreviewUnredactToken:    c.String("preview-unredact-token"),
+
+		InstanceRSA:        instanceRSA,
+		InstanceYML:        instanceYML,
+		InitScriptTemplate: initScriptTemplate,
 
 		QueueNames: map[string]string{
-			"instance-builds":       c.String("instance-builds-queue-name"),
-			"instance-terminations": c.String("instance-terminations-queue-name"),
+			"instance-builds":        c.String("instance-builds-queue-name"),
+			"instance-terminations":  c.String("instance-terminations-queue-name"),
+			"instance-state-changes": c.String("instance-state-changes-queue-name"),
+			"instance-consoles":      c.String("instance-consoles-queue-name"),
+			"image-updates":          c.String("image-updates-queue-name"),
 		},
 	})
 }
@@ -21,7 +21,7 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:   "q, queues",
-			Value:  "instance-builds,instance-terminations",
+			Value:  "instance-builds,instance-terminations,instance-state-changes,instance-consoles,image-updates",
 			EnvVar: "QUEUES",
 		},
 		cli.StringFlag{
@@ -75,33 +75,76 @@ func main() {
 		lib.SentryDSNFlag,
 		lib.InstanceExpiryFlag,
 		lib.ImageExpiryFlag,
+		lib.InstanceBuildExpiryFlag,
+		lib.HistoryExpiryFlag,
+		lib.ImageSelectorsFlag,
+		lib.InitScriptKeysFlag,
+		lib.TopologyFlag,
+		lib.TagPolicyFlag,
 		cli.IntFlag{
 			Name:   "X, temporary-init-expiry",
 			Value:  1200,
 			Usage:  "expiry in seconds for temporary cloud-init script and auth",
 			EnvVar: "PUDDING_TEMPORARY_INIT_EXPIRY",
 		},
+		cli.StringFlag{
+			Name:   "image-retention",
+			Usage:  "semicolon-delimited role=count number of most recent active images to keep per role when cleaning up images",
+			EnvVar: "PUDDING_IMAGE_RETENTION",
+		},
+		cli.IntFlag{
+			Name:   "image-cleanup-interval",
+			Value:  3600,
+			Usage:  "interval in seconds between image cleanups",
+			EnvVar: "PUDDING_IMAGE_CLEANUP_INTERVAL",
+		},
+		cli.BoolTFlag{
+			Name:   "image-cleanup-dry-run",
+			Usage:  "only report which images would be deregistered",
+			EnvVar: "PUDDING_IMAGE_CLEANUP_DRY_RUN",
+		},
+		cli.IntFlag{
+			Name:   "spot-fulfillment-timeout",
+			Value:  300,
+			Usage:  "seconds to wait for a spot request to be fulfilled before falling back to on-demand",
+			EnvVar: "PUDDING_SPOT_FULFILLMENT_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "spot-interruption-replacement",
+			Usage:  "enqueue a replacement instance build when a spot instance is interrupted",
+			EnvVar: "PUDDING_SPOT_INTERRUPTION_REPLACEMENT",
+		},
+		cli.IntFlag{
+			Name:   "boot-deadline",
+			Value:  1800,
+			Usage:  "seconds after launch by which an instance must report its instance build finished before it is marked timed-out; disabled when 0",
+			EnvVar: "PUDDING_BOOT_DEADLINE",
+		},
+		cli.BoolFlag{
+			Name:   "boot-deadline-terminate",
+			Usage:  "terminate instances that miss the boot deadline",
+			EnvVar: "PUDDING_BOOT_DEADLINE_TERMINATE",
+		},
+		cli.StringFlag{
+			Name:   "metrics-addr",
+			Usage:  "address on which to serve prometheus metrics at /metrics, e.g. \":9102\"; disabled when empty",
+			EnvVar: "PUDDING_METRICS_ADDR",
+		},
 		lib.DebugFlag,
 	}
 	app.Action = runWorkers
+	app.Commands = []cli.Command{
+		{
+			Name:   "check-config",
+			Usage:  "verify the topology, and that the instance yml and init script template render for every site, env, and queue",
+			Action: checkConfig,
+		},
+	}
 	app.Run(os.Args)
 }
 
 func runWorkers(c *cli.Context) {
-	instanceRSA := c.String("instance-rsa")
-	if instanceRSA == "" {
-		instanceRSA = lib.GetInstanceRSAKey()
-	}
-
-	instanceYML := c.String("instance-yml")
-	if instanceYML == "" {
-		instanceYML = lib.GetInstanceYML()
-	}
-
-	initScriptTemplate := c.String("init-script-template")
-	if initScriptTemplate == "" {
-		initScriptTemplate = lib.GetInitScriptTemplate()
-	}
+	instanceRSA, instanceYML, initScriptTemplate := instanceConfigFromFlags(c.String)
 
 	lib.WriteFlagsToEnv(c)
 
@@ -122,11 +165,29 @@ func runWorkers(c *cli.Context) {
 		InstanceYML:        instanceYML,
 		InstanceTagRetries: 10,
 
-		InitScriptTemplate: initScriptTemplate,
-		MiniWorkerInterval: c.Int("mini-worker-interval"),
-		InstanceExpiry:     c.Int("instance-expiry"),
-		ImageExpiry:        c.Int("image-expiry"),
-		TmpInitExpiry:      c.Int("temporary-init-expiry"),
+		InitScriptTemplate:  initScriptTemplate,
+		MiniWorkerInterval:  c.Int("mini-worker-interval"),
+		InstanceExpiry:      c.Int("instance-expiry"),
+		ImageExpiry:         c.Int("image-expiry"),
+		InstanceBuildExpiry: c.Int("instance-build-expiry"),
+		TmpInitExpiry:       c.Int("temporary-init-expiry"),
+		HistoryExpiry:       c.Int("history-expiry"),
+
+		ImageSelectors:       c.String("image-selectors"),
+		InitScriptKeys:       c.String("init-script-keys"),
+		Topology:             c.String("topology"),
+		TagPolicy:            c.String("tag-policy"),
+		ImageRetention:       c.String("image-retention"),
+		ImageCleanupInterval: c.Int("image-cleanup-interval"),
+		ImageCleanupDryRun:   c.BoolT("image-cleanup-dry-run"),
+
+		SpotFulfillmentTimeout:      c.Int("spot-fulfillment-timeout"),
+		SpotInterruptionReplacement: c.Bool("spot-interruption-replacement"),
+
+		BootDeadline:          c.Int("boot-deadline"),
+		BootDeadlineTerminate: c.Bool("boot-deadline-terminate"),
+
+		MetricsAddr: c.String("metrics-addr"),
 
 		SlackHookPath: c.String("slack-hook-path"),
 		SlackUsername: c.String("slack-username"),
@@ -135,3 +196,45 @@ func runWorkers(c *cli.Context) {
 		SentryDSN: c.String("sentry-dsn"),
 	})
 }
+
+func checkConfig(c *cli.Context) {
+	instanceRSA, instanceYML, initScriptTemplate := instanceConfigFromFlags(c.GlobalString)
+
+	errors := workers.CheckConfig(&workers.Config{
+		RedisURL:           c.GlobalString("redis-url"),
+		InstanceRSA:        instanceRSA,
+		InstanceYML:        instanceYML,
+		InitScriptTemplate: initScriptTemplate,
+		Topology:           c.GlobalString("topology"),
+		TagPolicy:          c.GlobalString("tag-policy"),
+	})
+
+	if len(errors) == 0 {
+		fmt.Println("config ok")
+		return
+	}
+
+	for _, err := range errors {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	}
+	os.Exit(1)
+}
+
+func instanceConfigFromFlags(flagValue func(string) string) (string, string, string) {
+	instanceRSA := flagValue("instance-rsa")
+	if instanceRSA == "" {
+		instanceRSA = lib.GetInstanceRSAKey()
+	}
+
+	instanceYML := flagValue("instance-yml")
+	if instanceYML == "" {
+		instanceYML = lib.GetInstanceYML()
+	}
+
+	initScriptTemplate := flagValue("init-script-template")
+	if initScriptTemplate == "" {
+		initScriptTemplate = lib.GetInitScriptTemplate()
+	}
+
+	return instanceRSA, instanceYML, initScriptTemplate
+}
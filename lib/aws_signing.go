@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+// awsHTTPClient is used for the aws requests signed here, with a
+// timeout so that a hung request does not block the mini workers
+var awsHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// signAWSRequest adds an AWS signature version 4 authorization header
+// for the given region and service to the given GET request
+func signAWSRequest(req *http.Request, auth aws.Auth, region, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	headers := []string{"host:" + req.URL.Host, "x-amz-date:" + amzDate}
+	signedHeaders := "host;x-amz-date"
+
+	if auth.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", auth.Token)
+		headers = append(headers, "x-amz-security-token:"+auth.Token)
+		signedHeaders += ";x-amz-security-token"
+	}
+
+	emptyHash := sha256.Sum256([]byte{})
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		"/",
+		req.URL.RawQuery,
+		strings.Join(headers, "\n") + "\n",
+		signedHeaders,
+		hex.EncodeToString(emptyHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + auth.SecretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		auth.AccessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// awsCanonicalQuery encodes the params sorted by key, with spaces
+// encoded as %20 as required for signing
+func awsCanonicalQuery(params url.Values) string {
+	keys := []string{}
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		for _, value := range params[key] {
+			pairs = append(pairs, fmt.Sprintf("%s=%s",
+				strings.Replace(url.QueryEscape(key), "+", "%20", -1),
+				strings.Replace(url.QueryEscape(value), "+", "%20", -1)))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+// the expected signatures are from the get-vanilla* cases of the AWS
+// signature version 4 test suite
+var testAWSSigningAuth = aws.Auth{
+	AccessKey: "AKIDEXAMPLE",
+	SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+func TestSignAWSRequest(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	for _, c := range []struct {
+		desc      string
+		params    url.Values
+		signature string
+	}{
+		{
+			"get-vanilla",
+			url.Values{},
+			"5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			"get-vanilla-query-order-key-case",
+			url.Values{"Param2": {"value2"}, "Param1": {"value1"}},
+			"b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+	} {
+		req, err := http.NewRequest("GET", "https://example.amazonaws.com/?"+awsCanonicalQuery(c.params), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signAWSRequest(req, testAWSSigningAuth, "us-east-1", "service", now)
+
+		expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=" + c.signature
+		if req.Header.Get("Authorization") != expected {
+			t.Errorf("%s: expected authorization %q, got %q", c.desc, expected, req.Header.Get("Authorization"))
+		}
+
+		if req.Header.Get("X-Amz-Date") != "20150830T123600Z" {
+			t.Errorf("%s: expected x-amz-date %q, got %q", c.desc, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+		}
+	}
+}
+
+func TestSignAWSRequestWithToken(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := testAWSSigningAuth
+	auth.Token = "session-token"
+	signAWSRequest(req, auth, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	if req.Header.Get("X-Amz-Security-Token") != "session-token" {
+		t.Errorf("expected security token header, got %q", req.Header.Get("X-Amz-Security-Token"))
+	}
+
+	unsigned := &http.Request{Header: http.Header{}, URL: req.URL}
+	signAWSRequest(unsigned, testAWSSigningAuth, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	if req.Header.Get("Authorization") == unsigned.Header.Get("Authorization") {
+		t.Errorf("expected the security token to be signed")
+	}
+}
+
+func TestAWSCanonicalQuery(t *testing.T) {
+	for _, c := range []struct {
+		params   url.Values
+		expected string
+	}{
+		{url.Values{}, ""},
+		{url.Values{"Param1": {"value1"}}, "Param1=value1"},
+		{url.Values{"b": {"2"}, "a": {"1"}, "B": {"3"}}, "B=3&a=1&b=2"},
+		{url.Values{"Param1": {"value2", "value1"}}, "Param1=value2&Param1=value1"},
+		{url.Values{"Action": {"GetConsoleOutput"}, "InstanceId": {"i-abc123"}}, "Action=GetConsoleOutput&InstanceId=i-abc123"},
+		{url.Values{"Param": {"a b"}}, "Param=a%20b"},
+		{url.Values{"Param": {"-._~"}}, "Param=-._~"},
+		{url.Values{"Param": {"a/b=c&d"}}, "Param=a%2Fb%3Dc%26d"},
+	} {
+		actual := awsCanonicalQuery(c.params)
+		if actual != c.expected {
+			t.Errorf("expected %q for %v, got %q", c.expected, c.params, actual)
+		}
+	}
+}
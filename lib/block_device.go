@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+var (
+	errEmptyDeviceName     = fmt.Errorf("empty block device \"device_name\"")
+	errInvalidVolumeSize   = fmt.Errorf("block device volume_size must not be negative")
+	errInvalidVolumeType   = fmt.Errorf("volume_type must be standard, gp2, or io1")
+	errMissingIOPS         = fmt.Errorf("volume_type io1 requires \"iops\"")
+	errInvalidRootVolume   = fmt.Errorf("root_volume_size must not be negative")
+	errRootVolumeTypeAlone = fmt.Errorf("\"root_volume_type\" and \"root_volume_iops\" require \"root_volume_size\"")
+)
+
+// BlockDevice is an EBS volume attached to an instance at launch,
+// which is always deleted along with the instance
+type BlockDevice struct {
+	DeviceName string `json:"device_name" yaml:"device_name"`
+	VolumeSize int64  `json:"volume_size" yaml:"volume_size"`
+	VolumeType string `json:"volume_type,omitempty" yaml:"volume_type"`
+	IOPS       int64  `json:"iops,omitempty" yaml:"iops"`
+	SnapshotID string `json:"snapshot_id,omitempty" yaml:"snapshot_id"`
+}
+
+// Validate performs multiple validity checks and returns a slice
+// of all errors found
+func (bd *BlockDevice) Validate() []error {
+	errors := []error{}
+	if bd.DeviceName == "" {
+		errors = append(errors, errEmptyDeviceName)
+	}
+	if bd.VolumeSize < 0 {
+		errors = append(errors, errInvalidVolumeSize)
+	}
+	errors = append(errors, validateVolumeType(bd.VolumeType, bd.IOPS)...)
+
+	return errors
+}
+
+// EC2BlockDeviceMapping returns the ec2 representation of the block
+// device
+func (bd *BlockDevice) EC2BlockDeviceMapping() ec2.BlockDeviceMapping {
+	return ec2.BlockDeviceMapping{
+		DeviceName:          bd.DeviceName,
+		SnapshotId:          bd.SnapshotID,
+		VolumeType:          bd.VolumeType,
+		VolumeSize:          bd.VolumeSize,
+		IOPS:                bd.IOPS,
+		DeleteOnTermination: true,
+	}
+}
+
+func validateVolumeType(volumeType string, iops int64) []error {
+	errors := []error{}
+	switch volumeType {
+	case "", "standard", "gp2":
+	case "io1":
+		if iops < 1 {
+			errors = append(errors, errMissingIOPS)
+		}
+	default:
+		errors = append(errors, errInvalidVolumeType)
+	}
+
+	return errors
+}
@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+const (
+	ec2APIVersion = "2014-10-01"
+	ec2Service    = "ec2"
+)
+
+// ConsoleOutputsCollection is the representation used in jsonapi
+// bodies
+type ConsoleOutputsCollection struct {
+	ConsoleOutputs []*ConsoleOutput `json:"console_outputs"`
+}
+
+// ConsoleOutput is the most recent console output of an instance as
+// captured by ec2, which is typically only available a few minutes
+// after boot, along with when it was fetched from ec2
+type ConsoleOutput struct {
+	InstanceID string `json:"instance_id"`
+	Timestamp  string `json:"timestamp,omitempty"`
+	FetchedAt  string `json:"fetched_at,omitempty"`
+	Output     string `json:"output"`
+}
+
+type consoleOutputResponse struct {
+	InstanceID string `xml:"instanceId"`
+	Timestamp  string `xml:"timestamp"`
+	Output     string `xml:"output"`
+}
+
+type ec2ErrorResponse struct {
+	Code      string `xml:"Errors>Error>Code"`
+	Message   string `xml:"Errors>Error>Message"`
+	RequestID string `xml:"RequestID"`
+}
+
+// GetConsoleOutput requests the console output of the given instance
+// id in the region and with the auth of the given client, since goamz
+// does not provide GetConsoleOutput
+func GetConsoleOutput(client *ec2.EC2, instanceID string) (*ConsoleOutput, error) {
+	params := url.Values{
+		"Action":     []string{"GetConsoleOutput"},
+		"Version":    []string{ec2APIVersion},
+		"InstanceId": []string{instanceID},
+	}
+
+	endpoint := strings.TrimRight(client.Region.EC2Endpoint, "/") + "/"
+	req, err := http.NewRequest("GET", endpoint+"?"+awsCanonicalQuery(params), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	signAWSRequest(req, client.Auth, client.Region.Name, ec2Service, time.Now().UTC())
+
+	resp, err := awsHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		ec2Err := &ec2ErrorResponse{}
+		if xml.Unmarshal(body, ec2Err) == nil && ec2Err.Code != "" {
+			return nil, &ec2.Error{
+				StatusCode: resp.StatusCode,
+				Code:       ec2Err.Code,
+				Message:    ec2Err.Message,
+				RequestId:  ec2Err.RequestID,
+			}
+		}
+		return nil, fmt.Errorf("ec2: unexpected status %d", resp.StatusCode)
+	}
+
+	co := &consoleOutputResponse{}
+	err = xml.Unmarshal(body, co)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := base64.StdEncoding.DecodeString(co.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConsoleOutput{
+		InstanceID: co.InstanceID,
+		Timestamp:  co.Timestamp,
+		FetchedAt:  time.Now().UTC().Format(time.RFC3339),
+		Output:     string(output),
+	}, nil
+}
+
+// Tail returns at most the last n lines of the console output
+func (co *ConsoleOutput) Tail(n int) string {
+	lines := strings.Split(strings.TrimRight(co.Output, "\r\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return strings.Join(lines, "\n")
+}
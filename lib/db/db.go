@@ -1,15 +1,38 @@
 package db
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/url"
+	"sort"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
-	"github.com/mitchellh/goamz/ec2"
 	"github.com/travis-ci/pudding/lib"
 )
 
+const (
+	// instanceTagFieldPrefix prefixes the user tag fields of an
+	// instance hash, and the matching filter keys
+	instanceTagFieldPrefix = lib.InstanceTagAttrPrefix
+
+	// instanceEventsMax is the number of events kept per instance
+	instanceEventsMax = 100
+
+	// instanceEventsExpiry is the number of seconds the events of an
+	// instance are kept after the last one
+	instanceEventsExpiry = 7 * 24 * 60 * 60
+
+	// ec2SyncHistoryMax is the number of ec2 sync history entries kept
+	ec2SyncHistoryMax = 500
+
+	// consoleOutputExpiry is the number of seconds the console output
+	// of an instance is cached
+	consoleOutputExpiry = 24 * 60 * 60
+)
+
 // InitScriptRedisKey provides the key for an init script given the
 // instance build id
 func InitScriptRedisKey(instanceBuildID string) string {
@@ -21,6 +44,133 @@ func AuthRedisKey(instanceBuildID string) string {
 	return fmt.Sprintf("%s:auth:%s", lib.RedisNamespace, instanceBuildID)
 }
 
+// InstanceBuildRedisKey provides the key for an instance build
+// hash given the instance build id
+func InstanceBuildRedisKey(instanceBuildID string) string {
+	return fmt.Sprintf("%s:instance-build:%s", lib.RedisNamespace, instanceBuildID)
+}
+
+// InitScriptFetchesRedisKey provides the key for the list of init
+// script fetch attempts given the instance build id
+func InitScriptFetchesRedisKey(instanceBuildID string) string {
+	return fmt.Sprintf("%s:instance-build:%s:init-script-fetches", lib.RedisNamespace, instanceBuildID)
+}
+
+// InitScriptTemplateVersionsRedisKey provides the key for the hash
+// of versions to init script templates given the template name
+func InitScriptTemplateVersionsRedisKey(name string) string {
+	return fmt.Sprintf("%s:init-script-template:%s:versions", lib.RedisNamespace, name)
+}
+
+// InitScriptTemplateCurrentRedisKey provides the key for the current
+// version of an init script template given the template name
+func InitScriptTemplateCurrentRedisKey(name string) string {
+	return fmt.Sprintf("%s:init-script-template:%s:current", lib.RedisNamespace, name)
+}
+
+// InitScriptTemplateSerialRedisKey provides the key used to allocate
+// versions of an init script template given the template name
+func InitScriptTemplateSerialRedisKey(name string) string {
+	return fmt.Sprintf("%s:init-script-template:%s:serial", lib.RedisNamespace, name)
+}
+
+// RolloutRedisKey provides the key for a rollout hash given the
+// rollout id
+func RolloutRedisKey(rolloutID string) string {
+	return fmt.Sprintf("%s:rollout:%s", lib.RedisNamespace, rolloutID)
+}
+
+// RolloutBatchRedisKey provides the key for the hash of in-flight
+// instance build ids to the instance ids they are replacing
+func RolloutBatchRedisKey(rolloutID string) string {
+	return fmt.Sprintf("%s:rollout:%s:batch", lib.RedisNamespace, rolloutID)
+}
+
+// RolloutReplacedRedisKey provides the key for the set of instance
+// ids that have already been picked for replacement
+func RolloutReplacedRedisKey(rolloutID string) string {
+	return fmt.Sprintf("%s:rollout:%s:replaced", lib.RedisNamespace, rolloutID)
+}
+
+// RolloutLockRedisKey provides the key used to ensure only one
+// worker process advances a given rollout at a time
+func RolloutLockRedisKey(rolloutID string) string {
+	return fmt.Sprintf("%s:rollout:%s:lock", lib.RedisNamespace, rolloutID)
+}
+
+// InstanceIndexRedisKey provides the key for the set of instance ids
+// having the given value of an indexed attribute, such as "site" or
+// "tag:owner"
+func InstanceIndexRedisKey(attr, value string) string {
+	return fmt.Sprintf("%s:instances:index:%s:%s", lib.RedisNamespace, attr, url.QueryEscape(value))
+}
+
+// InstanceIndexesRedisKey provides the key for the set of all
+// instance index keys
+func InstanceIndexesRedisKey() string {
+	return fmt.Sprintf("%s:instances:indexes", lib.RedisNamespace)
+}
+
+// ImageIndexRedisKey provides the key for the set of image ids having
+// the given value of an indexed attribute, such as "role"
+func ImageIndexRedisKey(attr, value string) string {
+	return fmt.Sprintf("%s:images:index:%s:%s", lib.RedisNamespace, attr, url.QueryEscape(value))
+}
+
+// ImageIndexesRedisKey provides the key for the set of all image
+// index keys
+func ImageIndexesRedisKey() string {
+	return fmt.Sprintf("%s:images:indexes", lib.RedisNamespace)
+}
+
+// InstanceEventsRedisKey provides the key for the list of events
+// found by the ec2 syncer for the given instance id
+func InstanceEventsRedisKey(instanceID string) string {
+	return fmt.Sprintf("%s:instance:%s:events", lib.RedisNamespace, instanceID)
+}
+
+// EC2SyncHistoryRedisKey provides the key for the list of ec2 sync
+// history entries
+func EC2SyncHistoryRedisKey() string {
+	return fmt.Sprintf("%s:ec2-sync-history", lib.RedisNamespace)
+}
+
+// InstanceConsoleOutputRedisKey provides the key for the cached
+// console output of an instance given the instance id
+func InstanceConsoleOutputRedisKey(instanceID string) string {
+	return fmt.Sprintf("%s:instance:%s:console", lib.RedisNamespace, instanceID)
+}
+
+// InstanceStateReasonRedisKey provides the key for the action last
+// requested for an instance and the reason given for it
+func InstanceStateReasonRedisKey(instanceID string) string {
+	return fmt.Sprintf("%s:instance-state-reason:%s", lib.RedisNamespace, instanceID)
+}
+
+// InstanceHistoryRedisKey provides the key for the sorted set of
+// terminated instance ids scored by termination time
+func InstanceHistoryRedisKey() string {
+	return fmt.Sprintf("%s:instance-history", lib.RedisNamespace)
+}
+
+// InstanceHistoryEntryRedisKey provides the key for a terminated
+// instance given the instance id
+func InstanceHistoryEntryRedisKey(instanceID string) string {
+	return fmt.Sprintf("%s:instance-history:%s", lib.RedisNamespace, instanceID)
+}
+
+// ImageHistoryRedisKey provides the key for the sorted set of
+// deregistered image ids scored by deregistration time
+func ImageHistoryRedisKey() string {
+	return fmt.Sprintf("%s:image-history", lib.RedisNamespace)
+}
+
+// ImageHistoryEntryRedisKey provides the key for a deregistered image
+// given the image id
+func ImageHistoryEntryRedisKey(imageID string) string {
+	return fmt.Sprintf("%s:image-history:%s", lib.RedisNamespace, imageID)
+}
+
 // BuildRedisPool builds a *redis.Pool given a redis URL yey ☃
 func BuildRedisPool(redisURL string) (*redis.Pool, error) {
 	u, err := url.Parse(redisURL)
@@ -64,18 +214,36 @@ func FetchInstances(conn redis.Conn, f map[string]string) ([]*lib.Instance, erro
 	if key, ok := f["instance_id"]; ok {
 		keys = append(keys, key)
 	} else {
-		keys, err = redis.Strings(conn.Do("SMEMBERS", fmt.Sprintf("%s:instances", lib.RedisNamespace)))
+		setKeys := []interface{}{fmt.Sprintf("%s:instances", lib.RedisNamespace)}
+		for key, value := range f {
+			// empty values are not indexed, so they are left to the
+			// filter below
+			if isInstanceIndexAttr(key) && value != "" {
+				setKeys = append(setKeys, InstanceIndexRedisKey(key, value))
+			}
+		}
+
+		keys, err = redis.Strings(conn.Do("SINTER", setKeys...))
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	hashKeys := []string{}
+	for _, key := range keys {
+		hashKeys = append(hashKeys, fmt.Sprintf("%s:instance:%s", lib.RedisNamespace, key))
+	}
+
+	replies, err := fetchHashes(conn, hashKeys)
+	if err != nil {
+		return nil, err
+	}
+
 	instances := []*lib.Instance{}
 
-	for _, key := range keys {
-		reply, err := redis.Values(conn.Do("HGETALL", fmt.Sprintf("%s:instance:%s", lib.RedisNamespace, key)))
-		if err != nil {
-			return nil, err
+	for _, reply := range replies {
+		if len(reply) == 0 {
+			continue
 		}
 
 		inst := &lib.Instance{}
@@ -84,29 +252,12 @@ func FetchInstances(conn redis.Conn, f map[string]string) ([]*lib.Instance, erro
 			return nil, err
 		}
 
-		failedChecks := 0
-		for key, value := range f {
-			switch key {
-			case "env":
-				if inst.Env != value {
-					failedChecks++
-				}
-			case "site":
-				if inst.Site != value {
-					failedChecks++
-				}
-			case "role":
-				if inst.Role != value {
-					failedChecks++
-				}
-			case "queue":
-				if inst.Queue != value {
-					failedChecks++
-				}
-			}
+		inst.Tags, err = instanceTagsFromReply(reply)
+		if err != nil {
+			return nil, err
 		}
 
-		if failedChecks == 0 {
+		if instanceMatchesFilter(inst, f) {
 			instances = append(instances, inst)
 		}
 	}
@@ -114,232 +265,1651 @@ func FetchInstances(conn redis.Conn, f map[string]string) ([]*lib.Instance, erro
 	return instances, nil
 }
 
-// StoreInstances stores the ec2 representation of an instance
-// given a redis conn and slice of ec2 instances, as well as an
-// expiry integer that is used to to run EXPIRE on all sets and
-// hashes involved
-func StoreInstances(conn redis.Conn, instances map[string]ec2.Instance, expiry int) error {
-	err := conn.Send("MULTI")
-	if err != nil {
-		return err
-	}
+// FetchInstanceFields gets a slice of instances given a redis conn
+// and optional filter map, with only the instance id and the given
+// fields set.  Indexed fields are read from the instance indexes, and
+// only the others from the instance hashes, which avoids reading any
+// hashes when all fields and filter keys are indexed.
+func FetchInstanceFields(conn redis.Conn, f map[string]string, fields []string) ([]*lib.Instance, error) {
+	setKeys := []interface{}{fmt.Sprintf("%s:instances", lib.RedisNamespace)}
+	for key, value := range f {
+		if !isInstanceIndexAttr(key) || value == "" {
+			return FetchInstances(conn, f)
+		}
 
-	instanceSetKey := fmt.Sprintf("%s:instances", lib.RedisNamespace)
+		setKeys = append(setKeys, InstanceIndexRedisKey(key, value))
+	}
 
-	err = conn.Send("DEL", instanceSetKey)
+	IDs, err := redis.Strings(conn.Do("SINTER", setKeys...))
 	if err != nil {
-		conn.Do("DISCARD")
-		return err
+		return nil, err
 	}
 
-	for ID, inst := range instances {
-		instanceAttrsKey := fmt.Sprintf("%s:instance:%s", lib.RedisNamespace, ID)
+	values := map[string][]interface{}{}
+	for _, ID := range IDs {
+		values[ID] = []interface{}{}
+	}
 
-		err = conn.Send("SADD", instanceSetKey, ID)
-		if err != nil {
-			conn.Do("DISCARD")
-			return err
+	hashFields := []interface{}{}
+	for _, field := range fields {
+		if !isInstanceIndexAttr(field) {
+			hashFields = append(hashFields, field)
+			continue
 		}
 
-		hmSet := []interface{}{
-			instanceAttrsKey,
-			"instance_id", inst.InstanceId,
-			"instance_type", inst.InstanceType,
-			"image_id", inst.ImageId,
-			"ip", inst.PublicIpAddress,
-			"private_ip", inst.PrivateIpAddress,
-			"launch_time", inst.LaunchTime.Format(time.RFC3339),
-		}
-
-		for _, tag := range inst.Tags {
-			switch tag.Key {
-			case "queue", "env", "site", "role":
-				hmSet = append(hmSet, tag.Key, tag.Value)
-			case "Name":
-				hmSet = append(hmSet, "name", tag.Value)
-			}
+		err = appendInstanceIndexValues(conn, field, values)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		err = conn.Send("HMSET", hmSet...)
+	if len(hashFields) > 0 {
+		err = appendInstanceHashValues(conn, IDs, hashFields, values)
 		if err != nil {
-			conn.Do("DISCARD")
-			return err
+			return nil, err
 		}
+	}
 
-		err = conn.Send("EXPIRE", instanceAttrsKey, expiry)
+	instances := []*lib.Instance{}
+	for _, ID := range IDs {
+		inst := &lib.Instance{InstanceID: ID}
+		err = redis.ScanStruct(values[ID], inst)
 		if err != nil {
-			conn.Do("DISCARD")
-			return err
+			return nil, err
 		}
-	}
 
-	err = conn.Send("EXPIRE", instanceSetKey, expiry)
-	if err != nil {
-		conn.Do("DISCARD")
-		return err
+		instances = append(instances, inst)
 	}
 
-	_, err = conn.Do("EXEC")
-	return err
+	return instances, nil
 }
 
-// RemoveInstances removes the given instances from the instance
-// set
-func RemoveInstances(conn redis.Conn, IDs []string) error {
-	err := conn.Send("MULTI")
+// appendInstanceIndexValues appends the value of the given indexed
+// attribute to the field/value pairs of each instance, as found in
+// the index sets of the attribute
+func appendInstanceIndexValues(conn redis.Conn, attr string, values map[string][]interface{}) error {
+	indexKeys, err := redis.Strings(conn.Do("SMEMBERS", InstanceIndexesRedisKey()))
 	if err != nil {
 		return err
 	}
 
-	instanceSetKey := fmt.Sprintf("%s:instances", lib.RedisNamespace)
-
-	for _, ID := range IDs {
-		err = conn.Send("SREM", instanceSetKey, ID)
-		if err != nil {
-			conn.Do("DISCARD")
-			return err
+	prefix := InstanceIndexRedisKey(attr, "")
+	attrKeys := []string{}
+	for _, indexKey := range indexKeys {
+		if strings.HasPrefix(indexKey, prefix) {
+			attrKeys = append(attrKeys, indexKey)
 		}
 	}
 
-	_, err = conn.Do("EXEC")
-	return err
-}
-
-// FetchImages gets a slice of images given a redis conn and
-// optional filter map
-func FetchImages(conn redis.Conn, f map[string]string) ([]*lib.Image, error) {
-	var err error
-	keys := []string{}
-
-	if key, ok := f["image_id"]; ok {
-		keys = append(keys, key)
-	} else {
-		keys, err = redis.Strings(conn.Do("SMEMBERS", fmt.Sprintf("%s:images", lib.RedisNamespace)))
+	for _, indexKey := range attrKeys {
+		err = conn.Send("SMEMBERS", indexKey)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	images := []*lib.Image{}
+	err = conn.Flush()
+	if err != nil {
+		return err
+	}
 
-	for _, key := range keys {
-		reply, err := redis.Values(conn.Do("HGETALL", fmt.Sprintf("%s:image:%s", lib.RedisNamespace, key)))
+	for _, indexKey := range attrKeys {
+		IDs, err := redis.Strings(conn.Receive())
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		img := &lib.Image{}
-		err = redis.ScanStruct(reply, img)
+		value, err := url.QueryUnescape(strings.TrimPrefix(indexKey, prefix))
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		failedChecks := 0
-		for key, value := range f {
-			switch key {
-			case "active":
-				if img.Active != (value == "true") {
-					failedChecks++
-				}
-			case "role":
-				if img.Role != value {
-					failedChecks++
-				}
+		for _, ID := range IDs {
+			if pairs, ok := values[ID]; ok {
+				values[ID] = append(pairs, []byte(attr), []byte(value))
 			}
 		}
-
-		if failedChecks == 0 {
-			images = append(images, img)
-		}
 	}
 
-	return images, nil
+	return nil
 }
 
-// StoreImages stores the ec2 representation of an image
-// given a redis conn and slice of ec2 images, as well as an
-// expiry integer that is used to to run EXPIRE on all sets and
-// hashes involved
-func StoreImages(conn redis.Conn, images map[string]ec2.Image, expiry int) error {
-	err := conn.Send("MULTI")
-	if err != nil {
-		return err
+// appendInstanceHashValues pipelines HMGET of the given fields for
+// each instance, appending them to its field/value pairs
+func appendInstanceHashValues(conn redis.Conn, IDs []string, fields []interface{}, values map[string][]interface{}) error {
+	for _, ID := range IDs {
+		args := append([]interface{}{fmt.Sprintf("%s:instance:%s", lib.RedisNamespace, ID)}, fields...)
+		err := conn.Send("HMGET", args...)
+		if err != nil {
+			return err
+		}
 	}
 
-	imageSetKey := fmt.Sprintf("%s:images", lib.RedisNamespace)
-
-	err = conn.Send("DEL", imageSetKey)
+	err := conn.Flush()
 	if err != nil {
-		conn.Do("DISCARD")
 		return err
 	}
 
-	for ID, img := range images {
-		imageAttrsKey := fmt.Sprintf("%s:image:%s", lib.RedisNamespace, ID)
-
-		err = conn.Send("SADD", imageSetKey, ID)
+	for _, ID := range IDs {
+		reply, err := redis.Values(conn.Receive())
 		if err != nil {
-			conn.Do("DISCARD")
 			return err
 		}
 
-		hmSet := []interface{}{
-			imageAttrsKey,
-			"image_id", img.Id,
-			"name", img.Name,
-			"state", img.State,
+		for i, field := range fields {
+			if i < len(reply) && reply[i] != nil {
+				values[ID] = append(values[ID], []byte(field.(string)), reply[i])
+			}
 		}
+	}
 
-		for _, tag := range img.Tags {
-			switch tag.Key {
-			case "role":
-				hmSet = append(hmSet, tag.Key, tag.Value)
-			case "active":
-				hmSet = append(hmSet, tag.Key, true)
+	return nil
+}
+
+// instanceMatchesFilter checks the instance against each of the
+// attribute and "tag:"-prefixed filter keys
+func instanceMatchesFilter(inst *lib.Instance, f map[string]string) bool {
+	failedChecks := 0
+	for key, value := range f {
+		if strings.HasPrefix(key, instanceTagFieldPrefix) {
+			if inst.Tags[strings.TrimPrefix(key, instanceTagFieldPrefix)] != value {
+				failedChecks++
 			}
+			continue
 		}
 
-		err = conn.Send("HMSET", hmSet...)
-		if err != nil {
-			conn.Do("DISCARD")
-			return err
+		switch key {
+		case "env":
+			if inst.Env != value {
+				failedChecks++
+			}
+		case "site":
+			if inst.Site != value {
+				failedChecks++
+			}
+		case "role":
+			if inst.Role != value {
+				failedChecks++
+			}
+		case "queue":
+			if inst.Queue != value {
+				failedChecks++
+			}
+		case "region":
+			if inst.Region != value {
+				failedChecks++
+			}
+		case "account":
+			if inst.Account != value {
+				failedChecks++
+			}
+		case "state":
+			if inst.State != value {
+				failedChecks++
+			}
+		case "instance_build_id":
+			if inst.InstanceBuildID != value {
+				failedChecks++
+			}
 		}
+	}
 
-		err = conn.Send("EXPIRE", imageAttrsKey, expiry)
-		if err != nil {
-			conn.Do("DISCARD")
-			return err
+	return failedChecks == 0
+}
+
+// SyncInstances applies the difference between the instances stored
+// for the given locations and the current instances found there,
+// keyed by instance id.  Only added and changed instance hashes are
+// rewritten, removed instances are deleted along with their index
+// entries, and the expiry of all current instances is refreshed.  The
+// resulting events are appended to the events of each instance and,
+// when there are any, to the ec2 sync history.
+func SyncInstances(conn redis.Conn, current map[string]*lib.Instance, locations []*lib.Location, expiry int) ([]*lib.InstanceEvent, error) {
+	stored, err := FetchInstances(conn, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+
+	synced := map[string]bool{}
+	locationNames := []string{}
+	for _, loc := range locations {
+		synced[loc.String()] = true
+		locationNames = append(locationNames, loc.String())
+	}
+
+	previous := map[string]*lib.Instance{}
+	for _, inst := range stored {
+		if inst.Region == "" || synced[inst.Location().String()] {
+			previous[inst.InstanceID] = inst
 		}
 	}
 
-	err = conn.Send("EXPIRE", imageSetKey, expiry)
+	now := time.Now().UTC()
+	events := lib.DiffInstances(previous, current, now)
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return nil, err
+	}
+
+	err = sendInstanceSync(conn, previous, current, events, expiry)
 	if err != nil {
 		conn.Do("DISCARD")
-		return err
+		return nil, err
 	}
 
-	_, err = conn.Do("EXEC")
-	return err
-}
+	err = sendInstanceEvents(conn, events, locationNames, now)
+	if err != nil {
+		conn.Do("DISCARD")
+		return nil, err
+	}
 
-// RemoveImages removes the given images from the image
-// set
-func RemoveImages(conn redis.Conn, IDs []string) error {
-	err := conn.Send("MULTI")
+	_, err = conn.Do("EXEC")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	imageSetKey := fmt.Sprintf("%s:images", lib.RedisNamespace)
+	return events, nil
+}
 
-	for _, ID := range IDs {
-		err = conn.Send("SREM", imageSetKey, ID)
-		if err != nil {
-			conn.Do("DISCARD")
-			return err
-		}
-	}
+// sendInstanceSync queues, within a transaction, the writes needed to
+// apply the instance events and refresh the expiry of every current
+// instance
+func sendInstanceSync(conn redis.Conn, previous, current map[string]*lib.Instance, events []*lib.InstanceEvent, expiry int) error {
+	instanceSetKey := fmt.Sprintf("%s:instances", lib.RedisNamespace)
+	rewrite := map[string]bool{}
+
+	for _, event := range events {
+		instanceAttrsKey := fmt.Sprintf("%s:instance:%s", lib.RedisNamespace, event.InstanceID)
+
+		switch event.Type {
+		case "added":
+			rewrite[event.InstanceID] = true
+		case "changed":
+			rewrite[event.InstanceID] = true
+			for attr, change := range event.Changes {
+				if isInstanceIndexAttr(attr) && change.Old != "" {
+					err := conn.Send("SREM", InstanceIndexRedisKey(attr, change.Old), event.InstanceID)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		case "removed":
+			err := conn.Send("SREM", instanceSetKey, event.InstanceID)
+			if err != nil {
+				return err
+			}
+
+			for attr, value := range previous[event.InstanceID].Attributes() {
+				if isInstanceIndexAttr(attr) && value != "" {
+					err = conn.Send("SREM", InstanceIndexRedisKey(attr, value), event.InstanceID)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			err = conn.Send("DEL", instanceAttrsKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	indexes := map[string][]interface{}{}
+	for ID, inst := range current {
+		instanceAttrsKey := fmt.Sprintf("%s:instance:%s", lib.RedisNamespace, ID)
+		attrs := inst.Attributes()
+
+		if rewrite[ID] {
+			hmSet := []interface{}{instanceAttrsKey}
+			for attr, value := range attrs {
+				hmSet = append(hmSet, attr, value)
+			}
+
+			err := conn.Send("DEL", instanceAttrsKey)
+			if err != nil {
+				return err
+			}
+
+			err = conn.Send("HMSET", hmSet...)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := conn.Send("EXPIRE", instanceAttrsKey, expiry)
+		if err != nil {
+			return err
+		}
+
+		err = conn.Send("SADD", instanceSetKey, ID)
+		if err != nil {
+			return err
+		}
+
+		for attr, value := range attrs {
+			if isInstanceIndexAttr(attr) && value != "" {
+				indexKey := InstanceIndexRedisKey(attr, value)
+				indexes[indexKey] = append(indexes[indexKey], ID)
+			}
+		}
+	}
+
+	err := sendIndexes(conn, InstanceIndexesRedisKey(), indexes, expiry)
+	if err != nil {
+		return err
+	}
+
+	return conn.Send("EXPIRE", instanceSetKey, expiry)
+}
+
+// sendInstanceEvents queues, within a transaction, the appending of
+// each event to the events of its instance, and of a history entry
+// for the sync when there are any events
+func sendInstanceEvents(conn redis.Conn, events []*lib.InstanceEvent, locationNames []string, now time.Time) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	entry := &lib.EC2SyncHistoryEntry{
+		Time:      now.Format(time.RFC3339),
+		Locations: locationNames,
+		Events:    events,
+	}
+
+	for _, event := range events {
+		switch event.Type {
+		case "added":
+			entry.Added++
+		case "removed":
+			entry.Removed++
+		case "changed":
+			entry.Changed++
+		}
+
+		eventJSON, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		eventsKey := InstanceEventsRedisKey(event.InstanceID)
+		err = conn.Send("LPUSH", eventsKey, string(eventJSON))
+		if err != nil {
+			return err
+		}
+
+		err = conn.Send("LTRIM", eventsKey, 0, instanceEventsMax-1)
+		if err != nil {
+			return err
+		}
+
+		err = conn.Send("EXPIRE", eventsKey, instanceEventsExpiry)
+		if err != nil {
+			return err
+		}
+	}
+
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("LPUSH", EC2SyncHistoryRedisKey(), string(entryJSON))
+	if err != nil {
+		return err
+	}
+
+	return conn.Send("LTRIM", EC2SyncHistoryRedisKey(), 0, ec2SyncHistoryMax-1)
+}
+
+// FetchInstanceEvents gets the events of the given instance id, most
+// recent first
+func FetchInstanceEvents(conn redis.Conn, instanceID string) ([]*lib.InstanceEvent, error) {
+	values, err := redis.Strings(conn.Do("LRANGE", InstanceEventsRedisKey(instanceID), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*lib.InstanceEvent{}
+	for _, value := range values {
+		event := &lib.InstanceEvent{}
+		err = json.Unmarshal([]byte(value), event)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// FetchEC2SyncHistory gets up to limit ec2 sync history entries, most
+// recent first
+func FetchEC2SyncHistory(conn redis.Conn, limit int) ([]*lib.EC2SyncHistoryEntry, error) {
+	values, err := redis.Strings(conn.Do("LRANGE", EC2SyncHistoryRedisKey(), 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*lib.EC2SyncHistoryEntry{}
+	for _, value := range values {
+		entry := &lib.EC2SyncHistoryEntry{}
+		err = json.Unmarshal([]byte(value), entry)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// instanceTagsFromReply collects the user tags stored as
+// "tag:"-prefixed fields of an instance hash
+func instanceTagsFromReply(reply []interface{}) (map[string]string, error) {
+	fields, err := redis.StringMap(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{}
+	for key, value := range fields {
+		if strings.HasPrefix(key, instanceTagFieldPrefix) {
+			tags[strings.TrimPrefix(key, instanceTagFieldPrefix)] = value
+		}
+	}
+
+	return tags, nil
+}
+
+// isInstanceIndexAttr checks if an instance hash field or filter key
+// is kept in an index set
+func isInstanceIndexAttr(attr string) bool {
+	switch attr {
+	case "site", "env", "queue", "role", "region", "account", "state", "instance_build_id":
+		return true
+	}
+
+	return strings.HasPrefix(attr, instanceTagFieldPrefix)
+}
+
+// fetchHashes pipelines HGETALL for each of the given keys, returning
+// the replies in the same order, where missing hashes are empty
+func fetchHashes(conn redis.Conn, keys []string) ([][]interface{}, error) {
+	for _, key := range keys {
+		err := conn.Send("HGETALL", key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := conn.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	replies := [][]interface{}{}
+	for range keys {
+		reply, err := redis.Values(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+
+		replies = append(replies, reply)
+	}
+
+	return replies, nil
+}
+
+// sendIndexes queues the SADD and EXPIRE of each index set within a
+// transaction, along with the SADD of each index key to the set of
+// all index keys
+func sendIndexes(conn redis.Conn, indexesKey string, indexes map[string][]interface{}, expiry int) error {
+	for indexKey, IDs := range indexes {
+		err := conn.Send("SADD", append([]interface{}{indexKey}, IDs...)...)
+		if err != nil {
+			return err
+		}
+
+		err = conn.Send("EXPIRE", indexKey, expiry)
+		if err != nil {
+			return err
+		}
+
+		err = conn.Send("SADD", indexesKey, indexKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return conn.Send("EXPIRE", indexesKey, expiry)
+}
+
+func stringsToArgs(values []string) []interface{} {
+	args := []interface{}{}
+	for _, value := range values {
+		args = append(args, value)
+	}
+
+	return args
+}
+
+// RemoveInstances removes the given instances from the instance
+// set
+func RemoveInstances(conn redis.Conn, IDs []string) error {
+	if len(IDs) == 0 {
+		return nil
+	}
+
+	indexKeys, err := redis.Strings(conn.Do("SMEMBERS", InstanceIndexesRedisKey()))
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	instanceSetKey := fmt.Sprintf("%s:instances", lib.RedisNamespace)
+
+	for _, setKey := range append([]string{instanceSetKey}, indexKeys...) {
+		err = conn.Send("SREM", append([]interface{}{setKey}, stringsToArgs(IDs)...)...)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// FetchImages gets a slice of images given a redis conn and
+// optional filter map
+func FetchImages(conn redis.Conn, f map[string]string) ([]*lib.Image, error) {
+	var err error
+	keys := []string{}
+
+	if key, ok := f["image_id"]; ok {
+		keys = append(keys, key)
+	} else {
+		setKeys := []interface{}{fmt.Sprintf("%s:images", lib.RedisNamespace)}
+		for key, value := range f {
+			switch key {
+			case "role":
+				setKeys = append(setKeys, ImageIndexRedisKey(key, value))
+			case "active":
+				setKeys = append(setKeys, ImageIndexRedisKey(key, fmt.Sprintf("%v", value == "true")))
+			}
+		}
+
+		keys, err = redis.Strings(conn.Do("SINTER", setKeys...))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hashKeys := []string{}
+	for _, key := range keys {
+		hashKeys = append(hashKeys, fmt.Sprintf("%s:image:%s", lib.RedisNamespace, key))
+	}
+
+	replies, err := fetchHashes(conn, hashKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []*lib.Image{}
+
+	for _, reply := range replies {
+		if len(reply) == 0 {
+			continue
+		}
+
+		img := &lib.Image{}
+		err = redis.ScanStruct(reply, img)
+		if err != nil {
+			return nil, err
+		}
+
+		if imageMatchesFilter(img, f) {
+			images = append(images, img)
+		}
+	}
+
+	return images, nil
+}
+
+// imageMatchesFilter checks the image against each of the filter keys
+func imageMatchesFilter(img *lib.Image, f map[string]string) bool {
+	failedChecks := 0
+	for key, value := range f {
+		switch key {
+		case "active":
+			if img.Active != (value == "true") {
+				failedChecks++
+			}
+		case "role":
+			if img.Role != value {
+				failedChecks++
+			}
+		case "region":
+			if img.Region != value {
+				failedChecks++
+			}
+		case "account":
+			if img.Account != value {
+				failedChecks++
+			}
+		}
+	}
+
+	return failedChecks == 0
+}
+
+// StoreImages stores the internal representation of an image
+// given a redis conn and map of images, as well as an
+// expiry integer that is used to to run EXPIRE on all sets and
+// hashes involved
+func StoreImages(conn redis.Conn, images map[string]*lib.Image, expiry int) error {
+	oldIndexKeys, err := redis.Strings(conn.Do("SMEMBERS", ImageIndexesRedisKey()))
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	imageSetKey := fmt.Sprintf("%s:images", lib.RedisNamespace)
+
+	err = conn.Send("DEL", append([]interface{}{imageSetKey, ImageIndexesRedisKey()}, stringsToArgs(oldIndexKeys)...)...)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	indexes := map[string][]interface{}{}
+
+	for ID, img := range images {
+		imageAttrsKey := fmt.Sprintf("%s:image:%s", lib.RedisNamespace, ID)
+
+		err = conn.Send("SADD", imageSetKey, ID)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+
+		hmSet := []interface{}{
+			imageAttrsKey,
+			"image_id", img.ImageID,
+			"name", img.Name,
+			"state", img.State,
+			"creation_date", img.CreationDate,
+			"active", img.Active,
+			"region", img.Region,
+			"account", img.Account,
+		}
+
+		if img.Role != "" {
+			hmSet = append(hmSet, "role", img.Role)
+			indexKey := ImageIndexRedisKey("role", img.Role)
+			indexes[indexKey] = append(indexes[indexKey], ID)
+		}
+
+		if img.Version != "" {
+			hmSet = append(hmSet, "version", img.Version)
+		}
+
+		indexKey := ImageIndexRedisKey("active", fmt.Sprintf("%v", img.Active))
+		indexes[indexKey] = append(indexes[indexKey], ID)
+
+		err = conn.Send("HMSET", hmSet...)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+
+		err = conn.Send("EXPIRE", imageAttrsKey, expiry)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+
+	err = sendIndexes(conn, ImageIndexesRedisKey(), indexes, expiry)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("EXPIRE", imageSetKey, expiry)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// RemoveImages removes the given images from the image
+// set
+func RemoveImages(conn redis.Conn, IDs []string) error {
+	if len(IDs) == 0 {
+		return nil
+	}
+
+	indexKeys, err := redis.Strings(conn.Do("SMEMBERS", ImageIndexesRedisKey()))
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	imageSetKey := fmt.Sprintf("%s:images", lib.RedisNamespace)
+
+	for _, setKey := range append([]string{imageSetKey}, indexKeys...) {
+		err = conn.Send("SREM", append([]interface{}{setKey}, stringsToArgs(IDs)...)...)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// FetchInstanceBuild gets an instance build by id, returning nil if
+// no such build has been stored
+func FetchInstanceBuild(conn redis.Conn, ID string) (*lib.InstanceBuild, error) {
+	reply, err := redis.Values(conn.Do("HGETALL", InstanceBuildRedisKey(ID)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reply) == 0 {
+		return nil, nil
+	}
+
+	b := &lib.InstanceBuild{}
+	err = redis.ScanStruct(reply, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// StoreInstanceBuild stores the given instance build as a hash with
+// the given expiry
+func StoreInstanceBuild(conn redis.Conn, b *lib.InstanceBuild, expiry int) error {
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	buildKey := InstanceBuildRedisKey(b.ID)
+
+	err = conn.Send("HMSET", redis.Args{buildKey}.AddFlat(b)...)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("EXPIRE", buildKey, expiry)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// FetchRollouts gets a slice of rollouts given a redis conn and
+// optional filter map
+func FetchRollouts(conn redis.Conn, f map[string]string) ([]*lib.Rollout, error) {
+	var err error
+	keys := []string{}
+
+	if key, ok := f["rollout_id"]; ok {
+		keys = append(keys, key)
+	} else {
+		keys, err = redis.Strings(conn.Do("SMEMBERS", fmt.Sprintf("%s:rollouts", lib.RedisNamespace)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rollouts := []*lib.Rollout{}
+
+	for _, key := range keys {
+		reply, err := redis.Values(conn.Do("HGETALL", RolloutRedisKey(key)))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(reply) == 0 {
+			continue
+		}
+
+		ro := &lib.Rollout{}
+		err = redis.ScanStruct(reply, ro)
+		if err != nil {
+			return nil, err
+		}
+
+		failedChecks := 0
+		for key, value := range f {
+			switch key {
+			case "state":
+				if ro.State != value {
+					failedChecks++
+				}
+			case "site":
+				if ro.Site != value {
+					failedChecks++
+				}
+			case "env":
+				if ro.Env != value {
+					failedChecks++
+				}
+			case "queue":
+				if ro.Queue != value {
+					failedChecks++
+				}
+			}
+		}
+
+		if failedChecks == 0 {
+			rollouts = append(rollouts, ro)
+		}
+	}
+
+	return rollouts, nil
+}
+
+// StoreRollout stores the given rollout as a hash and adds it to the
+// rollout set
+func StoreRollout(conn redis.Conn, ro *lib.Rollout) error {
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("SADD", fmt.Sprintf("%s:rollouts", lib.RedisNamespace), ro.ID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("HMSET", redis.Args{RolloutRedisKey(ro.ID)}.AddFlat(ro)...)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// SetImageActive updates the stored active flag for the given image
+// id, if the image is present
+func SetImageActive(conn redis.Conn, ID string, active bool) error {
+	imageAttrsKey := fmt.Sprintf("%s:image:%s", lib.RedisNamespace, ID)
+
+	exists, err := redis.Bool(conn.Do("EXISTS", imageAttrsKey))
+	if err != nil || !exists {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("HSET", imageAttrsKey, "active", active)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("SREM", ImageIndexRedisKey("active", fmt.Sprintf("%v", !active)), ID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	indexKey := ImageIndexRedisKey("active", fmt.Sprintf("%v", active))
+	err = conn.Send("SADD", indexKey, ID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("SADD", ImageIndexesRedisKey(), indexKey)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func imagePinField(role, site, env string) string {
+	return fmt.Sprintf("%s:%s:%s", role, site, env)
+}
+
+// FetchImagePins gets a slice of all image pins given a redis conn
+func FetchImagePins(conn redis.Conn) ([]*lib.ImagePin, error) {
+	pinMap, err := redis.StringMap(conn.Do("HGETALL", fmt.Sprintf("%s:image-pins", lib.RedisNamespace)))
+	if err != nil {
+		return nil, err
+	}
+
+	pins := []*lib.ImagePin{}
+	for field, imageID := range pinMap {
+		parts := strings.SplitN(field, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		pins = append(pins, &lib.ImagePin{
+			Role:    parts[0],
+			Site:    parts[1],
+			Env:     parts[2],
+			ImageID: imageID,
+		})
+	}
+
+	return pins, nil
+}
+
+// FetchImagePin gets the pinned image id for the given role, site,
+// and env, returning an empty string if there is no pin
+func FetchImagePin(conn redis.Conn, role, site, env string) (string, error) {
+	imageID, err := redis.String(conn.Do("HGET", fmt.Sprintf("%s:image-pins", lib.RedisNamespace), imagePinField(role, site, env)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+
+	return imageID, err
+}
+
+// StoreImagePin stores the given image pin, replacing any existing
+// pin for the same role, site, and env
+func StoreImagePin(conn redis.Conn, pin *lib.ImagePin) error {
+	_, err := conn.Do("HSET", fmt.Sprintf("%s:image-pins", lib.RedisNamespace),
+		imagePinField(pin.Role, pin.Site, pin.Env), pin.ImageID)
+	return err
+}
+
+// RemoveImagePin removes the image pin for the given role, site, and
+// env
+func RemoveImagePin(conn redis.Conn, role, site, env string) error {
+	_, err := conn.Do("HDEL", fmt.Sprintf("%s:image-pins", lib.RedisNamespace), imagePinField(role, site, env))
+	return err
+}
+
+// SpotInstanceBuildsRedisKey provides the key for the hash of
+// instance builds by the id of the spot instance launched for them
+func SpotInstanceBuildsRedisKey() string {
+	return fmt.Sprintf("%s:spot-instance-builds", lib.RedisNamespace)
+}
+
+// FetchSpotInstanceBuilds gets a map of instance builds by the id of
+// the spot instance launched for them
+func FetchSpotInstanceBuilds(conn redis.Conn) (map[string]*lib.InstanceBuild, error) {
+	buildMap, err := redis.StringMap(conn.Do("HGETALL", SpotInstanceBuildsRedisKey()))
+	if err != nil {
+		return nil, err
+	}
+
+	builds := map[string]*lib.InstanceBuild{}
+	for instanceID, buildJSON := range buildMap {
+		b := &lib.InstanceBuild{}
+		err = json.Unmarshal([]byte(buildJSON), b)
+		if err != nil {
+			return nil, err
+		}
+
+		builds[instanceID] = b
+	}
+
+	return builds, nil
+}
+
+// StoreSpotInstanceBuild stores the instance build for which the given
+// spot instance was launched
+func StoreSpotInstanceBuild(conn redis.Conn, instanceID string, b *lib.InstanceBuild) error {
+	buildJSON, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("HSET", SpotInstanceBuildsRedisKey(), instanceID, string(buildJSON))
+	return err
+}
+
+// ClaimSpotInstanceBuild removes the instance build stored for the
+// given spot instance, returning true only for the caller that
+// actually removed it
+func ClaimSpotInstanceBuild(conn redis.Conn, instanceID string) (bool, error) {
+	removed, err := redis.Int(conn.Do("HDEL", SpotInstanceBuildsRedisKey(), instanceID))
+	return removed == 1, err
+}
+
+// BootingInstanceBuildsRedisKey provides the key for the sorted set of
+// ids of started instance builds that have not yet finished, scored
+// by the time they were started
+func BootingInstanceBuildsRedisKey() string {
+	return fmt.Sprintf("%s:instance-builds:booting", lib.RedisNamespace)
+}
+
+// StoreBootingInstanceBuild adds the given instance build id to the
+// booting instance builds as started at the given time
+func StoreBootingInstanceBuild(conn redis.Conn, ID string, startedAt time.Time, expiry int) error {
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("ZADD", BootingInstanceBuildsRedisKey(), startedAt.Unix(), ID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("EXPIRE", BootingInstanceBuildsRedisKey(), expiry)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// FetchBootingInstanceBuildIDs gets the ids of the booting instance
+// builds started before the given time
+func FetchBootingInstanceBuildIDs(conn redis.Conn, startedBefore time.Time) ([]string, error) {
+	return redis.Strings(conn.Do("ZRANGEBYSCORE", BootingInstanceBuildsRedisKey(), "-inf", startedBefore.Unix()))
+}
+
+// ClaimBootingInstanceBuild removes the given instance build id from
+// the booting instance builds, returning true if this call was the
+// one to remove it
+func ClaimBootingInstanceBuild(conn redis.Conn, ID string) (bool, error) {
+	removed, err := redis.Int(conn.Do("ZREM", BootingInstanceBuildsRedisKey(), ID))
+	return removed == 1, err
+}
+
+// FetchImageCleanupReports gets the most recent image cleanup report
+// for every role
+func FetchImageCleanupReports(conn redis.Conn) ([]*lib.ImageCleanupReport, error) {
+	reportMap, err := redis.StringMap(conn.Do("HGETALL", fmt.Sprintf("%s:image-cleanup-reports", lib.RedisNamespace)))
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []*lib.ImageCleanupReport{}
+	for _, reportJSON := range reportMap {
+		report := &lib.ImageCleanupReport{}
+		err = json.Unmarshal([]byte(reportJSON), report)
+		if err != nil {
+			return nil, err
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// StoreImageCleanupReport stores the given image cleanup report,
+// replacing the previous report for the same role
+func StoreImageCleanupReport(conn redis.Conn, report *lib.ImageCleanupReport) error {
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("HSET", fmt.Sprintf("%s:image-cleanup-reports", lib.RedisNamespace), report.Role, string(reportJSON))
+	return err
+}
+
+// FetchInitScriptFetches returns every recorded init script fetch
+// attempt for the given instance build id, oldest first
+func FetchInitScriptFetches(conn redis.Conn, ID string) ([]*lib.InitScriptFetch, error) {
+	fetchJSONs, err := redis.Strings(conn.Do("LRANGE", InitScriptFetchesRedisKey(ID), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	fetches := []*lib.InitScriptFetch{}
+	for _, fetchJSON := range fetchJSONs {
+		f := &lib.InitScriptFetch{}
+		err = json.Unmarshal([]byte(fetchJSON), f)
+		if err != nil {
+			return nil, err
+		}
+
+		fetches = append(fetches, f)
+	}
+
+	return fetches, nil
+}
+
+// StoreInitScriptFetch records an init script fetch attempt for the
+// given instance build id
+func StoreInitScriptFetch(conn redis.Conn, ID string, f *lib.InitScriptFetch, expiry int) error {
+	fetchJSON, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	key := InitScriptFetchesRedisKey(ID)
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("RPUSH", key, string(fetchJSON))
+	if err != nil {
+		conn.Send("DISCARD")
+		return err
+	}
+
+	err = conn.Send("EXPIRE", key, expiry)
+	if err != nil {
+		conn.Send("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// FetchInitScriptTemplates returns the current version of every
+// stored init script template
+func FetchInitScriptTemplates(conn redis.Conn) ([]*lib.InitScriptTemplate, error) {
+	names, err := redis.Strings(conn.Do("SMEMBERS", fmt.Sprintf("%s:init-script-templates", lib.RedisNamespace)))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+
+	templates := []*lib.InitScriptTemplate{}
+	for _, name := range names {
+		t, err := FetchInitScriptTemplate(conn, name, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if t != nil {
+			templates = append(templates, t)
+		}
+	}
+
+	return templates, nil
+}
+
+// FetchInitScriptTemplateVersions returns every version of the named
+// init script template, oldest first
+func FetchInitScriptTemplateVersions(conn redis.Conn, name string) ([]*lib.InitScriptTemplate, error) {
+	current, err := fetchCurrentInitScriptTemplateVersion(conn, name)
+	if err != nil {
+		return nil, err
+	}
+
+	versionMap, err := redis.StringMap(conn.Do("HGETALL", InitScriptTemplateVersionsRedisKey(name)))
+	if err != nil {
+		return nil, err
+	}
+
+	templates := []*lib.InitScriptTemplate{}
+	for _, tJSON := range versionMap {
+		t := &lib.InitScriptTemplate{}
+		err = json.Unmarshal([]byte(tJSON), t)
+		if err != nil {
+			return nil, err
+		}
+
+		t.Current = t.Version == current
+		templates = append(templates, t)
+	}
+
+	sort.Sort(initScriptTemplatesByVersion(templates))
+	return templates, nil
+}
+
+// FetchInitScriptTemplate returns the given version of the named
+// init script template, or the current version if version is 0, or
+// nil if it does not exist
+func FetchInitScriptTemplate(conn redis.Conn, name string, version int) (*lib.InitScriptTemplate, error) {
+	current, err := fetchCurrentInitScriptTemplateVersion(conn, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == 0 {
+		version = current
+	}
+
+	if version == 0 {
+		return nil, nil
+	}
+
+	tJSON, err := redis.String(conn.Do("HGET", InitScriptTemplateVersionsRedisKey(name), version))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := &lib.InitScriptTemplate{}
+	err = json.Unmarshal([]byte(tJSON), t)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Current = t.Version == current
+	return t, nil
+}
+
+// StoreInitScriptTemplate stores the given init script template as
+// the next version of its name and makes it the current version
+func StoreInitScriptTemplate(conn redis.Conn, t *lib.InitScriptTemplate) error {
+	version, err := redis.Int(conn.Do("INCR", InitScriptTemplateSerialRedisKey(t.Name)))
+	if err != nil {
+		return err
+	}
+
+	t.Version = version
+	t.Current = true
+	if t.CreatedAt == "" {
+		t.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	tJSON, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("SADD", fmt.Sprintf("%s:init-script-templates", lib.RedisNamespace), t.Name)
+	if err != nil {
+		conn.Send("DISCARD")
+		return err
+	}
+
+	err = conn.Send("HSET", InitScriptTemplateVersionsRedisKey(t.Name), t.Version, string(tJSON))
+	if err != nil {
+		conn.Send("DISCARD")
+		return err
+	}
+
+	err = conn.Send("SET", InitScriptTemplateCurrentRedisKey(t.Name), t.Version)
+	if err != nil {
+		conn.Send("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// SetCurrentInitScriptTemplate makes an existing version of the named
+// init script template the current version, e.g. for rolling back
+func SetCurrentInitScriptTemplate(conn redis.Conn, name string, version int) (*lib.InitScriptTemplate, error) {
+	t, err := FetchInitScriptTemplate(conn, name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if t == nil {
+		return nil, nil
+	}
+
+	_, err = conn.Do("SET", InitScriptTemplateCurrentRedisKey(name), version)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Current = true
+	return t, nil
+}
+
+func fetchCurrentInitScriptTemplateVersion(conn redis.Conn, name string) (int, error) {
+	current, err := redis.Int(conn.Do("GET", InitScriptTemplateCurrentRedisKey(name)))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+
+	return current, err
+}
+
+type initScriptTemplatesByVersion []*lib.InitScriptTemplate
+
+func (s initScriptTemplatesByVersion) Len() int           { return len(s) }
+func (s initScriptTemplatesByVersion) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s initScriptTemplatesByVersion) Less(i, j int) bool { return s[i].Version < s[j].Version }
+
+// ResolveInitScriptTemplate picks the current (or requested) version
+// of the stored init script template named by the instance build, or
+// else the one named after its role, or else the default one, falling
+// back to the given template.  The name and version used are recorded
+// on the instance build.
+func ResolveInitScriptTemplate(conn redis.Conn, b *lib.InstanceBuild, fallback *template.Template) (*template.Template, error) {
+	names := []string{b.InitScriptTemplate}
+	if b.InitScriptTemplate == "" {
+		names = []string{b.Role, lib.DefaultInitScriptTemplateName}
+	}
+
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+
+		stored, err := FetchInitScriptTemplate(conn, name, b.InitScriptTemplateVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		if stored == nil {
+			continue
+		}
+
+		t, err := stored.Parse()
+		if err != nil {
+			return nil, err
+		}
+
+		b.InitScriptTemplate = stored.Name
+		b.InitScriptTemplateVersion = stored.Version
+		return t, nil
+	}
+
+	if b.InitScriptTemplateVersion > 0 {
+		return nil, fmt.Errorf("unknown init script template %q version %d",
+			b.InitScriptTemplate, b.InitScriptTemplateVersion)
+	}
+
+	if b.InitScriptTemplate != "" {
+		return nil, fmt.Errorf("unknown init script template %q", b.InitScriptTemplate)
+	}
+
+	return fallback, nil
+}
+
+// StoreTerminatedInstance adds the given terminated instance to the
+// instance history for expiry seconds, returning false without
+// changing anything if the instance is already in the history
+func StoreTerminatedInstance(conn redis.Conn, inst *lib.Instance, expiry int) (bool, error) {
+	terminatedAt, err := time.Parse(time.RFC3339, inst.TerminatedAt)
+	if err != nil {
+		return false, err
+	}
+
+	return storeHistoryEntry(conn, InstanceHistoryRedisKey(), InstanceHistoryEntryRedisKey(inst.InstanceID),
+		inst.InstanceID, inst, terminatedAt, expiry)
+}
+
+// FetchTerminatedInstances gets the instances in the instance history,
+// most recently terminated first, optionally with filter params
+func FetchTerminatedInstances(conn redis.Conn, f map[string]string) ([]*lib.Instance, error) {
+	values, err := fetchHistoryEntries(conn, InstanceHistoryRedisKey(), InstanceHistoryEntryRedisKey)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := []*lib.Instance{}
+	for _, value := range values {
+		inst := &lib.Instance{}
+		err = json.Unmarshal([]byte(value), inst)
+		if err != nil {
+			return nil, err
+		}
+
+		if id, ok := f["instance_id"]; ok && inst.InstanceID != id {
+			continue
+		}
+
+		if instanceMatchesFilter(inst, f) {
+			instances = append(instances, inst)
+		}
+	}
+
+	return instances, nil
+}
+
+// StoreDeregisteredImage adds the given deregistered image to the
+// image history for expiry seconds, returning false without changing
+// anything if the image is already in the history
+func StoreDeregisteredImage(conn redis.Conn, img *lib.Image, expiry int) (bool, error) {
+	deregisteredAt, err := time.Parse(time.RFC3339, img.DeregisteredAt)
+	if err != nil {
+		return false, err
+	}
+
+	return storeHistoryEntry(conn, ImageHistoryRedisKey(), ImageHistoryEntryRedisKey(img.ImageID),
+		img.ImageID, img, deregisteredAt, expiry)
+}
+
+// FetchDeregisteredImages gets the images in the image history, most
+// recently deregistered first, optionally with filter params
+func FetchDeregisteredImages(conn redis.Conn, f map[string]string) ([]*lib.Image, error) {
+	values, err := fetchHistoryEntries(conn, ImageHistoryRedisKey(), ImageHistoryEntryRedisKey)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []*lib.Image{}
+	for _, value := range values {
+		img := &lib.Image{}
+		err = json.Unmarshal([]byte(value), img)
+		if err != nil {
+			return nil, err
+		}
+
+		if id, ok := f["image_id"]; ok && img.ImageID != id {
+			continue
+		}
+
+		if imageMatchesFilter(img, f) {
+			images = append(images, img)
+		}
+	}
+
+	return images, nil
+}
+
+// storeHistoryEntry sets the json entry unless already present, adds
+// the id to the history sorted set scored by the given time, and
+// drops ids older than expiry seconds from the sorted set
+func storeHistoryEntry(conn redis.Conn, historyKey, entryKey, ID string, entry interface{}, at time.Time, expiry int) (bool, error) {
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return false, err
+	}
+
+	reply, err := conn.Do("SET", entryKey, string(entryJSON), "EX", expiry, "NX")
+	if err != nil || reply == nil {
+		return false, err
+	}
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return false, err
+	}
+
+	err = conn.Send("ZADD", historyKey, at.Unix(), ID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return false, err
+	}
+
+	err = conn.Send("ZREMRANGEBYSCORE", historyKey, "-inf", time.Now().Unix()-int64(expiry))
+	if err != nil {
+		conn.Do("DISCARD")
+		return false, err
+	}
+
+	err = conn.Send("EXPIRE", historyKey, expiry)
+	if err != nil {
+		conn.Do("DISCARD")
+		return false, err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err == nil, err
+}
+
+// fetchHistoryEntries gets the json entries of all ids in the history
+// sorted set, most recent first, skipping any that have expired
+func fetchHistoryEntries(conn redis.Conn, historyKey string, entryKey func(string) string) ([]string, error) {
+	IDs, err := redis.Strings(conn.Do("ZREVRANGE", historyKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(IDs) == 0 {
+		return []string{}, nil
+	}
+
+	keys := []interface{}{}
+	for _, ID := range IDs {
+		keys = append(keys, entryKey(ID))
+	}
+
+	values, err := redis.Values(conn.Do("MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []string{}
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+
+		entry, err := redis.String(value, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// StoreInstanceStateReason stores the action requested for the given
+// instance id and the reason for it for expiry seconds
+func StoreInstanceStateReason(conn redis.Conn, instanceID, action, reason string, expiry int) error {
+	key := InstanceStateReasonRedisKey(instanceID)
+
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("HMSET", key, "action", action, "reason", reason)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("EXPIRE", key, expiry)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
 
 	_, err = conn.Do("EXEC")
 	return err
 }
+
+// ApplyInstanceStateReasons sets the state reason of each of the
+// given instances for which an action was requested and that is still
+// in one of the states resulting from that action
+func ApplyInstanceStateReasons(conn redis.Conn, instances map[string]*lib.Instance) error {
+	IDs := []string{}
+	keys := []string{}
+	for ID := range instances {
+		IDs = append(IDs, ID)
+		keys = append(keys, InstanceStateReasonRedisKey(ID))
+	}
+
+	replies, err := fetchHashes(conn, keys)
+	if err != nil {
+		return err
+	}
+
+	for i, reply := range replies {
+		if len(reply) == 0 {
+			continue
+		}
+
+		fields, err := redis.StringMap(reply, nil)
+		if err != nil {
+			return err
+		}
+
+		instances[IDs[i]].ApplyStateReason(fields["action"], fields["reason"])
+	}
+
+	return nil
+}
+
+// StoreInstanceConsoleOutput caches the given console output
+func StoreInstanceConsoleOutput(conn redis.Conn, co *lib.ConsoleOutput) error {
+	coJSON, err := json.Marshal(co)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("SETEX", InstanceConsoleOutputRedisKey(co.InstanceID), consoleOutputExpiry, string(coJSON))
+	return err
+}
+
+// FetchInstanceConsoleOutput gets the cached console output of the
+// given instance id, or nil if none is cached
+func FetchInstanceConsoleOutput(conn redis.Conn, instanceID string) (*lib.ConsoleOutput, error) {
+	coJSON, err := redis.Bytes(conn.Do("GET", InstanceConsoleOutputRedisKey(instanceID)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	co := &lib.ConsoleOutput{}
+	err = json.Unmarshal(coJSON, co)
+	if err != nil {
+		return nil, err
+	}
+
+	return co, nil
+}
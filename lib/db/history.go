@@ -0,0 +1,74 @@
+package db
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding/lib"
+)
+
+// HistoryFetcherStorer defines the interface for fetching and
+// storing terminated instances and deregistered images
+type HistoryFetcherStorer interface {
+	FetchInstances(map[string]string) ([]*lib.Instance, error)
+	StoreInstance(*lib.Instance) (bool, error)
+	FetchImages(map[string]string) ([]*lib.Image, error)
+	StoreImage(*lib.Image) (bool, error)
+}
+
+// History represents the collection of terminated instances and
+// deregistered images, each kept for Expiry seconds
+type History struct {
+	Expiry int
+	r      *redis.Pool
+	log    *logrus.Logger
+}
+
+// NewHistory creates a new History collection
+func NewHistory(redisURL string, log *logrus.Logger, expiry int) (*History, error) {
+	r, err := BuildRedisPool(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &History{
+		Expiry: expiry,
+		r:      r,
+		log:    log,
+	}, nil
+}
+
+// FetchInstances returns a slice of terminated instances, most recent
+// first, optionally with filter params
+func (h *History) FetchInstances(f map[string]string) ([]*lib.Instance, error) {
+	conn := h.r.Get()
+	defer conn.Close()
+
+	return FetchTerminatedInstances(conn, f)
+}
+
+// StoreInstance accepts a terminated instance and stores it unless
+// already present, returning true if this call stored it
+func (h *History) StoreInstance(inst *lib.Instance) (bool, error) {
+	conn := h.r.Get()
+	defer conn.Close()
+
+	return StoreTerminatedInstance(conn, inst, h.Expiry)
+}
+
+// FetchImages returns a slice of deregistered images, most recent
+// first, optionally with filter params
+func (h *History) FetchImages(f map[string]string) ([]*lib.Image, error) {
+	conn := h.r.Get()
+	defer conn.Close()
+
+	return FetchDeregisteredImages(conn, f)
+}
+
+// StoreImage accepts a deregistered image and stores it unless
+// already present, returning true if this call stored it
+func (h *History) StoreImage(img *lib.Image) (bool, error) {
+	conn := h.r.Get()
+	defer conn.Close()
+
+	return StoreDeregisteredImage(conn, img, h.Expiry)
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding/lib"
+)
+
+// ImagePinFetcherStorer defines the interface for fetching and
+// storing image pins
+type ImagePinFetcherStorer interface {
+	Fetch() ([]*lib.ImagePin, error)
+	Get(string, string, string) (string, error)
+	Store(*lib.ImagePin) error
+	Remove(string, string, string) error
+}
+
+// ImagePins represents the image pin collection
+type ImagePins struct {
+	r   *redis.Pool
+	log *logrus.Logger
+}
+
+// NewImagePins creates a new ImagePins collection
+func NewImagePins(redisURL string, log *logrus.Logger) (*ImagePins, error) {
+	r, err := BuildRedisPool(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImagePins{
+		r:   r,
+		log: log,
+	}, nil
+}
+
+// Fetch returns a slice of all image pins
+func (ip *ImagePins) Fetch() ([]*lib.ImagePin, error) {
+	conn := ip.r.Get()
+	defer conn.Close()
+
+	return FetchImagePins(conn)
+}
+
+// Get returns the pinned image id for the given role, site, and env,
+// or an empty string if there is no pin
+func (ip *ImagePins) Get(role, site, env string) (string, error) {
+	conn := ip.r.Get()
+	defer conn.Close()
+
+	return FetchImagePin(conn, role, site, env)
+}
+
+// Store accepts an image pin and stores it
+func (ip *ImagePins) Store(pin *lib.ImagePin) error {
+	conn := ip.r.Get()
+	defer conn.Close()
+
+	return StoreImagePin(conn, pin)
+}
+
+// Remove removes the image pin for the given role, site, and env
+func (ip *ImagePins) Remove(role, site, env string) error {
+	conn := ip.r.Get()
+	defer conn.Close()
+
+	return RemoveImagePin(conn, role, site, env)
+}
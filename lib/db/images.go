@@ -3,7 +3,6 @@ package db
 import (
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
-	"github.com/mitchellh/goamz/ec2"
 	"github.com/travis-ci/pudding/lib"
 )
 
@@ -11,7 +10,8 @@ import (
 // storing the internal image representation
 type ImageFetcherStorer interface {
 	Fetch(map[string]string) ([]*lib.Image, error)
-	Store(map[string]ec2.Image) error
+	Store(map[string]*lib.Image) error
+	CleanupReports() ([]*lib.ImageCleanupReport, error)
 }
 
 // Images represents the instance collection
@@ -43,10 +43,19 @@ func (i *Images) Fetch(f map[string]string) ([]*lib.Image, error) {
 	return FetchImages(conn, f)
 }
 
-// Store accepts the ec2 representation of an image and stores it
-func (i *Images) Store(images map[string]ec2.Image) error {
+// Store accepts the internal representation of images and stores them
+func (i *Images) Store(images map[string]*lib.Image) error {
 	conn := i.r.Get()
 	defer conn.Close()
 
 	return StoreImages(conn, images, i.Expiry)
 }
+
+// CleanupReports returns the most recent image cleanup report for
+// every role
+func (i *Images) CleanupReports() ([]*lib.ImageCleanupReport, error) {
+	conn := i.r.Get()
+	defer conn.Close()
+
+	return FetchImageCleanupReports(conn)
+}
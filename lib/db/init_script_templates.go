@@ -0,0 +1,90 @@
+package db
+
+import (
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding/lib"
+)
+
+// InitScriptTemplateFetcherStorer defines the interface for fetching
+// and storing versioned init script templates
+type InitScriptTemplateFetcherStorer interface {
+	Fetch() ([]*lib.InitScriptTemplate, error)
+	Versions(string) ([]*lib.InitScriptTemplate, error)
+	Get(string, int) (*lib.InitScriptTemplate, error)
+	Store(*lib.InitScriptTemplate) error
+	SetCurrent(string, int) (*lib.InitScriptTemplate, error)
+	Resolve(*lib.InstanceBuild, *template.Template) (*template.Template, error)
+}
+
+// InitScriptTemplates represents the init script template collection
+type InitScriptTemplates struct {
+	r   *redis.Pool
+	log *logrus.Logger
+}
+
+// NewInitScriptTemplates creates a new InitScriptTemplates collection
+func NewInitScriptTemplates(redisURL string, log *logrus.Logger) (*InitScriptTemplates, error) {
+	r, err := BuildRedisPool(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &InitScriptTemplates{
+		r:   r,
+		log: log,
+	}, nil
+}
+
+// Fetch returns the current version of every init script template
+func (ist *InitScriptTemplates) Fetch() ([]*lib.InitScriptTemplate, error) {
+	conn := ist.r.Get()
+	defer conn.Close()
+
+	return FetchInitScriptTemplates(conn)
+}
+
+// Versions returns every version of the named init script template
+func (ist *InitScriptTemplates) Versions(name string) ([]*lib.InitScriptTemplate, error) {
+	conn := ist.r.Get()
+	defer conn.Close()
+
+	return FetchInitScriptTemplateVersions(conn, name)
+}
+
+// Get returns the given version of the named init script template,
+// or the current version if version is 0, or nil if it does not exist
+func (ist *InitScriptTemplates) Get(name string, version int) (*lib.InitScriptTemplate, error) {
+	conn := ist.r.Get()
+	defer conn.Close()
+
+	return FetchInitScriptTemplate(conn, name, version)
+}
+
+// Store stores the init script template as a new current version
+func (ist *InitScriptTemplates) Store(t *lib.InitScriptTemplate) error {
+	conn := ist.r.Get()
+	defer conn.Close()
+
+	return StoreInitScriptTemplate(conn, t)
+}
+
+// SetCurrent makes an existing version of the named init script
+// template the current version, returning nil if it does not exist
+func (ist *InitScriptTemplates) SetCurrent(name string, version int) (*lib.InitScriptTemplate, error) {
+	conn := ist.r.Get()
+	defer conn.Close()
+
+	return SetCurrentInitScriptTemplate(conn, name, version)
+}
+
+// Resolve picks the init script template to use for the given
+// instance build, as in ResolveInitScriptTemplate
+func (ist *InitScriptTemplates) Resolve(b *lib.InstanceBuild, fallback *template.Template) (*template.Template, error) {
+	conn := ist.r.Get()
+	defer conn.Close()
+
+	return ResolveInitScriptTemplate(conn, b, fallback)
+}
@@ -3,12 +3,15 @@ package db
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/subtle"
 	"encoding/base64"
+	"fmt"
 	"io/ioutil"
 	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding/lib"
 )
 
 // InstanceBuildAuther is the interface used to authenticate
@@ -23,16 +26,19 @@ type InstanceBuildAuther interface {
 type InitScriptGetterAuther interface {
 	InstanceBuildAuther
 	Get(string) (string, error)
+	Consume(string) (string, error)
 }
 
-// InitScripts represents the internal init scripts collection
+// InitScripts represents the internal init scripts collection, which
+// transparently opens scripts and auths sealed with the keyring
 type InitScripts struct {
 	r   *redis.Pool
+	kr  *lib.Keyring
 	log *logrus.Logger
 }
 
 // NewInitScripts creates a new *InitScripts
-func NewInitScripts(redisURL string, log *logrus.Logger) (*InitScripts, error) {
+func NewInitScripts(redisURL string, kr *lib.Keyring, log *logrus.Logger) (*InitScripts, error) {
 	r, err := BuildRedisPool(redisURL)
 	if err != nil {
 		return nil, err
@@ -40,22 +46,82 @@ func NewInitScripts(redisURL string, log *logrus.Logger) (*InitScripts, error) {
 
 	return &InitScripts{
 		r:   r,
+		kr:  kr,
 		log: log,
 	}, nil
 }
 
+// ErrInitScriptNotFound is returned when consuming an init script
+// that has expired or has already been consumed
+var ErrInitScriptNotFound = fmt.Errorf("init script not found or already fetched")
+
 // Get retrieves a given init script by ID, which is expected to be
 // a uuid, although it really doesn't matter ☃
 func (is *InitScripts) Get(ID string) (string, error) {
 	conn := is.r.Get()
 	defer conn.Close()
 
-	b64Script, err := redis.String(conn.Do("GET", InitScriptRedisKey(ID)))
+	dbScript, err := redis.String(conn.Do("GET", InitScriptRedisKey(ID)))
+	if err != nil {
+		return "", err
+	}
+
+	return is.open(dbScript)
+}
+
+// Consume retrieves a given init script by ID and atomically deletes
+// it, so that it may only be fetched once.  The auth is kept, since
+// the instance uses it again to report its build finished, and is
+// removed along with any remains once that happens.
+func (is *InitScripts) Consume(ID string) (string, error) {
+	conn := is.r.Get()
+	defer conn.Close()
+
+	err := conn.Send("MULTI")
+	if err != nil {
+		return "", err
+	}
+
+	err = conn.Send("GET", InitScriptRedisKey(ID))
+	if err != nil {
+		conn.Send("DISCARD")
+		return "", err
+	}
+
+	err = conn.Send("DEL", InitScriptRedisKey(ID))
 	if err != nil {
+		conn.Send("DISCARD")
 		return "", err
 	}
 
-	b, err := base64.StdEncoding.DecodeString(string(b64Script))
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return "", err
+	}
+
+	if len(reply) == 0 || reply[0] == nil {
+		return "", ErrInitScriptNotFound
+	}
+
+	dbScript, err := redis.String(reply[0], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return is.open(dbScript)
+}
+
+func (is *InitScripts) open(dbScript string) (string, error) {
+	var (
+		b   []byte
+		err error
+	)
+
+	if lib.IsSealed(dbScript) {
+		b, err = is.kr.Open(dbScript)
+	} else {
+		b, err = base64.StdEncoding.DecodeString(dbScript)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -90,11 +156,19 @@ func (is *InitScripts) HasValidAuth(ID, auth string) bool {
 		return false
 	}
 
-	is.log.WithFields(logrus.Fields{
-		"instance_build_id": ID,
-		"auth":              auth,
-		"db_auth":           dbAuth,
-	}).Debug("comparing auths")
+	if lib.IsSealed(dbAuth) {
+		b, err := is.kr.Open(dbAuth)
+		if err != nil {
+			is.log.WithFields(logrus.Fields{
+				"err": err,
+				"key": redisKey,
+			}).Error("failed to open sealed auth")
+			return false
+		}
+		dbAuth = string(b)
+	}
+
+	is.log.WithField("instance_build_id", ID).Debug("comparing auths")
 
-	return strings.TrimSpace(dbAuth) == strings.TrimSpace(auth)
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(dbAuth)), []byte(strings.TrimSpace(auth))) == 1
 }
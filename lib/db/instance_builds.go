@@ -0,0 +1,82 @@
+package db
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding/lib"
+)
+
+// InstanceBuildGetterStorer defines the interface for getting and
+// storing instance builds
+type InstanceBuildGetterStorer interface {
+	Get(string) (*lib.InstanceBuild, error)
+	Store(*lib.InstanceBuild) error
+	InitScriptFetches(string) ([]*lib.InitScriptFetch, error)
+	RecordInitScriptFetch(string, *lib.InitScriptFetch) error
+	ClaimBooting(string) (bool, error)
+}
+
+// InstanceBuilds represents the instance build collection
+type InstanceBuilds struct {
+	Expiry int
+	r      *redis.Pool
+	log    *logrus.Logger
+}
+
+// NewInstanceBuilds creates a new InstanceBuilds collection
+func NewInstanceBuilds(redisURL string, log *logrus.Logger, expiry int) (*InstanceBuilds, error) {
+	r, err := BuildRedisPool(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &InstanceBuilds{
+		Expiry: expiry,
+		r:      r,
+		log:    log,
+	}, nil
+}
+
+// Get returns the instance build with the given id, or nil if it
+// does not exist
+func (ib *InstanceBuilds) Get(ID string) (*lib.InstanceBuild, error) {
+	conn := ib.r.Get()
+	defer conn.Close()
+
+	return FetchInstanceBuild(conn, ID)
+}
+
+// Store accepts an instance build and stores it
+func (ib *InstanceBuilds) Store(b *lib.InstanceBuild) error {
+	conn := ib.r.Get()
+	defer conn.Close()
+
+	return StoreInstanceBuild(conn, b, ib.Expiry)
+}
+
+// InitScriptFetches returns the init script fetch attempts recorded
+// for the given instance build id
+func (ib *InstanceBuilds) InitScriptFetches(ID string) ([]*lib.InitScriptFetch, error) {
+	conn := ib.r.Get()
+	defer conn.Close()
+
+	return FetchInitScriptFetches(conn, ID)
+}
+
+// RecordInitScriptFetch records an init script fetch attempt for the
+// given instance build id
+func (ib *InstanceBuilds) RecordInitScriptFetch(ID string, f *lib.InitScriptFetch) error {
+	conn := ib.r.Get()
+	defer conn.Close()
+
+	return StoreInitScriptFetch(conn, ID, f, ib.Expiry)
+}
+
+// ClaimBooting removes the given instance build id from the booting
+// instance builds, returning true if this call was the one to remove it
+func (ib *InstanceBuilds) ClaimBooting(ID string) (bool, error) {
+	conn := ib.r.Get()
+	defer conn.Close()
+
+	return ClaimBootingInstanceBuild(conn, ID)
+}
@@ -3,7 +3,6 @@ package db
 import (
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
-	"github.com/mitchellh/goamz/ec2"
 	"github.com/travis-ci/pudding/lib"
 )
 
@@ -11,7 +10,11 @@ import (
 // storing the internal instance representation
 type InstanceFetcherStorer interface {
 	Fetch(map[string]string) ([]*lib.Instance, error)
-	Store(map[string]ec2.Instance) error
+	FetchFields(map[string]string, []string) ([]*lib.Instance, error)
+	Sync(map[string]*lib.Instance, []*lib.Location) ([]*lib.InstanceEvent, error)
+	FetchEvents(string) ([]*lib.InstanceEvent, error)
+	FetchSyncHistory(int) ([]*lib.EC2SyncHistoryEntry, error)
+	FetchConsoleOutput(string) (*lib.ConsoleOutput, error)
 }
 
 // Instances represents the instance collection
@@ -43,10 +46,48 @@ func (i *Instances) Fetch(f map[string]string) ([]*lib.Instance, error) {
 	return FetchInstances(conn, f)
 }
 
-// Store accepts the ec2 representation of an instance and stores it
-func (i *Instances) Store(instances map[string]ec2.Instance) error {
+// FetchFields returns a slice of instances, optionally with filter
+// params, with only the given fields set
+func (i *Instances) FetchFields(f map[string]string, fields []string) ([]*lib.Instance, error) {
 	conn := i.r.Get()
 	defer conn.Close()
 
-	return StoreInstances(conn, instances, i.Expiry)
+	return FetchInstanceFields(conn, f, fields)
+}
+
+// Sync accepts the current instances found in the given locations
+// and applies the difference from those stored, returning the
+// resulting events
+func (i *Instances) Sync(instances map[string]*lib.Instance, locations []*lib.Location) ([]*lib.InstanceEvent, error) {
+	conn := i.r.Get()
+	defer conn.Close()
+
+	return SyncInstances(conn, instances, locations, i.Expiry)
+}
+
+// FetchEvents returns the events of the given instance id, most
+// recent first
+func (i *Instances) FetchEvents(instanceID string) ([]*lib.InstanceEvent, error) {
+	conn := i.r.Get()
+	defer conn.Close()
+
+	return FetchInstanceEvents(conn, instanceID)
+}
+
+// FetchSyncHistory returns up to limit ec2 sync history entries, most
+// recent first
+func (i *Instances) FetchSyncHistory(limit int) ([]*lib.EC2SyncHistoryEntry, error) {
+	conn := i.r.Get()
+	defer conn.Close()
+
+	return FetchEC2SyncHistory(conn, limit)
+}
+
+// FetchConsoleOutput returns the cached console output of the given
+// instance id, or nil if none is cached
+func (i *Instances) FetchConsoleOutput(instanceID string) (*lib.ConsoleOutput, error) {
+	conn := i.r.Get()
+	defer conn.Close()
+
+	return FetchInstanceConsoleOutput(conn, instanceID)
 }
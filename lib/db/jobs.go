@@ -1,7 +1,9 @@
 package db
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/travis-ci/pudding/lib"
@@ -29,3 +31,109 @@ func EnqueueJob(conn redis.Conn, queueName, payload string) error {
 	_, err = conn.Do("EXEC")
 	return err
 }
+
+// EnqueueInstanceBuild wraps the given instance build in a payload
+// and pushes it onto the given queue name
+func EnqueueInstanceBuild(conn redis.Conn, queueName string, b *lib.InstanceBuild) error {
+	buildPayload := &lib.InstanceBuildPayload{
+		Args:       []*lib.InstanceBuild{b},
+		Queue:      queueName,
+		JID:        b.ID,
+		Retry:      true,
+		EnqueuedAt: float64(time.Now().UTC().Unix()),
+	}
+
+	buildPayloadJSON, err := json.Marshal(buildPayload)
+	if err != nil {
+		return err
+	}
+
+	return EnqueueJob(conn, queueName, string(buildPayloadJSON))
+}
+
+// EnqueueInstanceTermination pushes an instance termination payload
+// for the given instance id onto the given queue name, where the
+// requester is recorded in the instance history
+func EnqueueInstanceTermination(conn redis.Conn, queueName, instanceID, slackChannel, requester string) error {
+	terminationPayload := &lib.InstanceTerminationPayload{
+		InstanceID:   instanceID,
+		SlackChannel: slackChannel,
+		Requester:    requester,
+	}
+
+	terminationPayloadJSON, err := json.Marshal(terminationPayload)
+	if err != nil {
+		return err
+	}
+
+	return EnqueueJob(conn, queueName, string(terminationPayloadJSON))
+}
+
+// EnqueueInstanceStateChange pushes an instance state change payload
+// to start or stop the given instance id onto the given queue name
+func EnqueueInstanceStateChange(conn redis.Conn, queueName, instanceID, action, slackChannel, requester string) error {
+	changePayload := &lib.InstanceStateChangePayload{
+		InstanceID:   instanceID,
+		Action:       action,
+		SlackChannel: slackChannel,
+		Requester:    requester,
+	}
+
+	changePayloadJSON, err := json.Marshal(changePayload)
+	if err != nil {
+		return err
+	}
+
+	return EnqueueJob(conn, queueName, string(changePayloadJSON))
+}
+
+// EnqueueInstanceConsole pushes an instance console payload for the
+// given instance id onto the given queue name, where the console
+// output is attached to the given instance build id, if any
+func EnqueueInstanceConsole(conn redis.Conn, queueName, instanceID, instanceBuildID string) error {
+	consolePayload := &lib.InstanceConsolePayload{
+		InstanceID:      instanceID,
+		InstanceBuildID: instanceBuildID,
+		Retry:           true,
+	}
+
+	consolePayloadJSON, err := json.Marshal(consolePayload)
+	if err != nil {
+		return err
+	}
+
+	return EnqueueJob(conn, queueName, string(consolePayloadJSON))
+}
+
+// EnqueueImageUpdate pushes an image update payload for the given
+// image id onto the given queue name
+func EnqueueImageUpdate(conn redis.Conn, queueName, imageID string, active bool, slackChannel string) error {
+	updatePayload := &lib.ImageUpdatePayload{
+		ImageID:      imageID,
+		Active:       active,
+		SlackChannel: slackChannel,
+	}
+
+	updatePayloadJSON, err := json.Marshal(updatePayload)
+	if err != nil {
+		return err
+	}
+
+	return EnqueueJob(conn, queueName, string(updatePayloadJSON))
+}
+
+// FetchQueueDepths returns the number of jobs waiting in each of the
+// given queue names
+func FetchQueueDepths(conn redis.Conn, queueNames []string) (map[string]int, error) {
+	depths := map[string]int{}
+	for _, queueName := range queueNames {
+		depth, err := redis.Int(conn.Do("LLEN", fmt.Sprintf("%s:queue:%s", lib.RedisNamespace, queueName)))
+		if err != nil {
+			return nil, err
+		}
+
+		depths[queueName] = depth
+	}
+
+	return depths, nil
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding/lib"
+)
+
+// unlockScript deletes a lock only if it is still held by the given
+// owner, so that a lock which expired and was taken by another owner
+// is left alone
+var unlockScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// RolloutFetcherStorer defines the interface for fetching and
+// storing rollouts
+type RolloutFetcherStorer interface {
+	Fetch(map[string]string) ([]*lib.Rollout, error)
+	Store(*lib.Rollout) error
+}
+
+// RolloutBatcher is the extension of RolloutFetcherStorer that
+// locks rollouts and tracks their in-flight batches
+type RolloutBatcher interface {
+	RolloutFetcherStorer
+	Lock(string, string, int) (bool, error)
+	Unlock(string, string) error
+	Batch(string) (map[string]string, error)
+	AddToBatch(string, string, string) error
+	RemoveFromBatch(string, string) error
+	RequeueFromBatch(string, string, string) error
+	Replaced(string) (map[string]bool, error)
+}
+
+// Rollouts represents the rollout collection
+type Rollouts struct {
+	r   *redis.Pool
+	log *logrus.Logger
+}
+
+// NewRollouts creates a new Rollouts collection
+func NewRollouts(redisURL string, log *logrus.Logger) (*Rollouts, error) {
+	r, err := BuildRedisPool(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Rollouts{
+		r:   r,
+		log: log,
+	}, nil
+}
+
+// Fetch returns a slice of rollouts, optionally with filter params
+func (ro *Rollouts) Fetch(f map[string]string) ([]*lib.Rollout, error) {
+	conn := ro.r.Get()
+	defer conn.Close()
+
+	return FetchRollouts(conn, f)
+}
+
+// Store accepts a rollout and stores it
+func (ro *Rollouts) Store(rollout *lib.Rollout) error {
+	conn := ro.r.Get()
+	defer conn.Close()
+
+	return StoreRollout(conn, rollout)
+}
+
+// Lock attempts to take the advancement lock for the given rollout
+// id, returning true if the lock was acquired
+func (ro *Rollouts) Lock(ID, owner string, expiry int) (bool, error) {
+	conn := ro.r.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("SET", RolloutLockRedisKey(ID), owner, "EX", expiry, "NX")
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
+// Unlock releases the advancement lock for the given rollout id if
+// it is still held by the given owner
+func (ro *Rollouts) Unlock(ID, owner string) error {
+	conn := ro.r.Get()
+	defer conn.Close()
+
+	_, err := unlockScript.Do(conn, RolloutLockRedisKey(ID), owner)
+	return err
+}
+
+// Batch returns the in-flight instance build ids mapped to the
+// instance ids they are replacing
+func (ro *Rollouts) Batch(ID string) (map[string]string, error) {
+	conn := ro.r.Get()
+	defer conn.Close()
+
+	return redis.StringMap(conn.Do("HGETALL", RolloutBatchRedisKey(ID)))
+}
+
+// AddToBatch records an in-flight instance build along with the
+// instance it is replacing, which is also marked as replaced
+func (ro *Rollouts) AddToBatch(ID, instanceBuildID, instanceID string) error {
+	conn := ro.r.Get()
+	defer conn.Close()
+
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("HSET", RolloutBatchRedisKey(ID), instanceBuildID, instanceID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("SADD", RolloutReplacedRedisKey(ID), instanceID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// RemoveFromBatch removes an instance build from the in-flight batch
+func (ro *Rollouts) RemoveFromBatch(ID, instanceBuildID string) error {
+	conn := ro.r.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HDEL", RolloutBatchRedisKey(ID), instanceBuildID)
+	return err
+}
+
+// RequeueFromBatch removes a failed instance build from the in-flight
+// batch and unmarks the instance it was replacing, so that the
+// instance is picked for replacement again
+func (ro *Rollouts) RequeueFromBatch(ID, instanceBuildID, instanceID string) error {
+	conn := ro.r.Get()
+	defer conn.Close()
+
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+
+	err = conn.Send("HDEL", RolloutBatchRedisKey(ID), instanceBuildID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	err = conn.Send("SREM", RolloutReplacedRedisKey(ID), instanceID)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// Replaced returns the set of instance ids that have already been
+// picked for replacement
+func (ro *Rollouts) Replaced(ID string) (map[string]bool, error) {
+	conn := ro.r.Get()
+	defer conn.Close()
+
+	IDs, err := redis.Strings(conn.Do("SMEMBERS", RolloutReplacedRedisKey(ID)))
+	if err != nil {
+		return nil, err
+	}
+
+	replaced := map[string]bool{}
+	for _, instanceID := range IDs {
+		replaced[instanceID] = true
+	}
+
+	return replaced, nil
+}
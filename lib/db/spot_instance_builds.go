@@ -0,0 +1,61 @@
+package db
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding/lib"
+)
+
+// SpotInstanceBuildFetcherStorer defines the interface for fetching,
+// storing, and claiming the instance builds of spot instances
+type SpotInstanceBuildFetcherStorer interface {
+	Fetch() (map[string]*lib.InstanceBuild, error)
+	Store(string, *lib.InstanceBuild) error
+	Claim(string) (bool, error)
+}
+
+// SpotInstanceBuilds represents the collection of instance builds
+// by spot instance id
+type SpotInstanceBuilds struct {
+	r   *redis.Pool
+	log *logrus.Logger
+}
+
+// NewSpotInstanceBuilds creates a new SpotInstanceBuilds collection
+func NewSpotInstanceBuilds(redisURL string, log *logrus.Logger) (*SpotInstanceBuilds, error) {
+	r, err := BuildRedisPool(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SpotInstanceBuilds{
+		r:   r,
+		log: log,
+	}, nil
+}
+
+// Fetch returns a map of all instance builds by spot instance id
+func (sib *SpotInstanceBuilds) Fetch() (map[string]*lib.InstanceBuild, error) {
+	conn := sib.r.Get()
+	defer conn.Close()
+
+	return FetchSpotInstanceBuilds(conn)
+}
+
+// Store accepts a spot instance id and the instance build it was
+// launched for and stores it
+func (sib *SpotInstanceBuilds) Store(instanceID string, b *lib.InstanceBuild) error {
+	conn := sib.r.Get()
+	defer conn.Close()
+
+	return StoreSpotInstanceBuild(conn, instanceID, b)
+}
+
+// Claim removes the instance build for the given spot instance id,
+// returning true if this call was the one to remove it
+func (sib *SpotInstanceBuilds) Claim(instanceID string) (bool, error) {
+	conn := sib.r.Get()
+	defer conn.Close()
+
+	return ClaimSpotInstanceBuild(conn, instanceID)
+}
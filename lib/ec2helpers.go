@@ -2,40 +2,50 @@ package lib
 
 import (
 	"fmt"
-	"sort"
 
 	"github.com/mitchellh/goamz/ec2"
 )
 
 var (
 	errNoLatestImage = fmt.Errorf("no latest image available matching filter")
+
+	capacityErrorCodes = []string{
+		"InsufficientInstanceCapacity",
+		"InsufficientCapacity",
+		"InsufficientFreeAddressesInSubnet",
+		"Unsupported",
+	}
 )
 
-// ResolveAMI attempts to get an ec2.Image by id, falling back to
-// fetching the most recently provisioned worker ami via
-// FetchLatestWorkerAMI
-func ResolveAMI(conn *ec2.EC2, ID string, f *ec2.Filter) (*ec2.Image, error) {
-	if ID != "" {
-		resp, err := conn.Images([]string{ID}, ec2.NewFilter())
+// ResolveAMI attempts to get an ec2.Image by id, then by pinned id,
+// falling back to fetching the latest ami according to the given
+// selector via FetchLatestAMIWithFilter
+func ResolveAMI(conn *ec2.EC2, ID, pinnedID string, f *ec2.Filter, sel *ImageSelector) (*ec2.Image, error) {
+	for _, candidateID := range []string{ID, pinnedID} {
+		if candidateID == "" {
+			continue
+		}
+
+		resp, err := conn.Images([]string{candidateID}, ec2.NewFilter())
 		if err != nil {
 			return nil, err
 		}
 		for _, img := range resp.Images {
-			if img.Id == ID {
+			if img.Id == candidateID {
 				return &img, nil
 			}
 		}
 	}
 
-	return FetchLatestAMIWithFilter(conn, f)
+	return FetchLatestAMIWithFilter(conn, f, sel)
 }
 
 // FetchLatestAMIWithFilter looks up all images matching the given
-// filter (with `tag:active=true` added), then sorts by the image
-// name which is assumed to contain a timestamp, then returns the
-// most recent image.
-func FetchLatestAMIWithFilter(conn *ec2.EC2, f *ec2.Filter) (*ec2.Image, error) {
-	f.Add("tag-key", "active")
+// filter (with `tag:active=true` added), then returns the latest
+// image as chosen by the given selector, which defaults to sorting
+// by image name
+func FetchLatestAMIWithFilter(conn *ec2.EC2, f *ec2.Filter, sel *ImageSelector) (*ec2.Image, error) {
+	f.Add("tag:active", "true")
 
 	allImages, err := conn.Images([]string{}, f)
 	if err != nil {
@@ -46,16 +56,24 @@ func FetchLatestAMIWithFilter(conn *ec2.EC2, f *ec2.Filter) (*ec2.Image, error)
 		return nil, errNoLatestImage
 	}
 
-	imgNames := []string{}
+	if sel == nil {
+		sel = DefaultImageSelector
+	}
+
+	images := []*Image{}
 	imgMap := map[string]ec2.Image{}
 
 	for _, img := range allImages.Images {
-		imgNames = append(imgNames, img.Name)
-		imgMap[img.Name] = img
+		images = append(images, NewImageFromEC2(img, nil))
+		imgMap[img.Id] = img
+	}
+
+	selection, err := sel.Select(images)
+	if err != nil {
+		return nil, err
 	}
 
-	sort.Strings(imgNames)
-	img := imgMap[imgNames[len(imgNames)-1]]
+	img := imgMap[selection.Chosen.ImageID]
 	return &img, nil
 }
 
@@ -96,3 +114,15 @@ func GetImagesWithFilter(conn *ec2.EC2, f *ec2.Filter) (map[string]ec2.Image, er
 
 	return images, nil
 }
+
+// IsCapacityError checks if the error returned by ec2 means that the
+// requested instance type is not currently available in the requested
+// subnet or availability zone, such that another may be tried
+func IsCapacityError(err error) bool {
+	ec2Err, ok := err.(*ec2.Error)
+	if !ok {
+		return false
+	}
+
+	return containsString(capacityErrorCodes, ec2Err.Code)
+}
@@ -58,6 +58,52 @@ var (
 		Usage:  "expiry in seconds for image attributes",
 		EnvVar: "PUDDING_IMAGE_EXPIRY",
 	}
+	// InstanceBuildExpiryFlag is the flag used to for defining the
+	// expiry used in redis when storing instance builds
+	InstanceBuildExpiryFlag = cli.IntFlag{
+		Name:   "instance-build-expiry",
+		Value:  86400,
+		Usage:  "expiry in seconds for instance build records",
+		EnvVar: "PUDDING_INSTANCE_BUILD_EXPIRY",
+	}
+	// HistoryExpiryFlag is the flag used to for defining the expiry
+	// used in redis when storing terminated instances and
+	// deregistered images
+	HistoryExpiryFlag = cli.IntFlag{
+		Name:   "history-expiry",
+		Value:  2592000,
+		Usage:  "expiry in seconds for terminated instance and deregistered image history",
+		EnvVar: "PUDDING_HISTORY_EXPIRY",
+	}
+	// ImageSelectorsFlag is the flag used to configure how the
+	// latest image is chosen per role
+	ImageSelectorsFlag = cli.StringFlag{
+		Name:   "image-selectors",
+		Usage:  "semicolon-delimited role=strategy[:pattern] image selectors, where strategy is one of name, creation-date, version-tag, or name-pattern",
+		EnvVar: "PUDDING_IMAGE_SELECTORS",
+	}
+	// InitScriptKeysFlag is the flag used to configure the keyring
+	// with which init scripts and their temporary auths are sealed
+	InitScriptKeysFlag = cli.StringFlag{
+		Name:   "init-script-keys",
+		Usage:  "semicolon-delimited id=base64key keys for sealing init scripts, where the first key is the primary",
+		EnvVar: "PUDDING_INIT_SCRIPT_KEYS",
+	}
+	// TopologyFlag is the flag used to configure the sites, envs,
+	// and roles instances may be built for, along with per-role
+	// defaults
+	TopologyFlag = cli.StringFlag{
+		Name:   "topology",
+		Usage:  "yml or json with the allowed sites, envs, and roles, and per-role defaults",
+		EnvVar: "PUDDING_TOPOLOGY",
+	}
+	// TagPolicyFlag is the flag used to configure which user tags
+	// are required and allowed on instance builds
+	TagPolicyFlag = cli.StringFlag{
+		Name:   "tag-policy",
+		Usage:  "yml or json with the required user tag keys and allowed values per key",
+		EnvVar: "PUDDING_TAG_POLICY",
+	}
 	// SlackHookPathFlag is the incoming webhook path for slack integration
 	SlackHookPathFlag = cli.StringFlag{
 		Name:   "slack-hook-path",
@@ -137,6 +183,17 @@ func WriteFlagsToEnv(c *cli.Context) {
 			if envVar != "" {
 				os.Setenv(envVar, fmt.Sprintf("%v", v))
 			}
+		case cli.BoolTFlag:
+			names := strings.Split(flVal.Name, ",")
+			if len(names) < 1 {
+				continue
+			}
+
+			v := c.BoolT(names[0])
+			envVar := flVal.EnvVar
+			if envVar != "" {
+				os.Setenv(envVar, fmt.Sprintf("%v", v))
+			}
 		}
 	}
 }
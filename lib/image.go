@@ -1,10 +1,68 @@
 package lib
 
-// Image is the internal representation of an EC2 instance
+import (
+	"time"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+// Image is the internal representation of an EC2 image, where the
+// deregistration attributes are only set on images in the image
+// history
 type Image struct {
-	ImageID string `json:"image_id" redis:"image_id"`
-	Role    string `json:"role" redis:"role"`
-	Active  bool   `json:"active" redis:"active"`
-	Name    string `json:"name" redis:"name"`
-	State   string `json:"state" redis:"state"`
+	ImageID      string `json:"image_id" redis:"image_id"`
+	Role         string `json:"role" redis:"role"`
+	Active       bool   `json:"active" redis:"active"`
+	Name         string `json:"name" redis:"name"`
+	State        string `json:"state" redis:"state"`
+	CreationDate string `json:"creation_date,omitempty" redis:"creation_date"`
+	Version      string `json:"version,omitempty" redis:"version"`
+	Region       string `json:"region,omitempty" redis:"region"`
+	Account      string `json:"account,omitempty" redis:"account"`
+
+	DeregisteredAt string `json:"deregistered_at,omitempty" redis:"-"`
+	DeregisteredBy string `json:"deregistered_by,omitempty" redis:"-"`
+}
+
+// Location returns the region and account of the image
+func (img *Image) Location() *Location {
+	return &Location{Region: img.Region, Account: img.Account}
+}
+
+// MarkDeregistered sets the state of the image to deregistered along
+// with when and by whom
+func (img *Image) MarkDeregistered(by string, at time.Time) {
+	img.State = "deregistered"
+	img.DeregisteredAt = at.UTC().Format(time.RFC3339)
+	img.DeregisteredBy = by
+}
+
+// NewImageFromEC2 builds an *Image from the ec2 representation,
+// including the role, active, and version tags, along with the
+// location it was found in, if given
+func NewImageFromEC2(img ec2.Image, loc *Location) *Image {
+	image := &Image{
+		ImageID:      img.Id,
+		Name:         img.Name,
+		State:        img.State,
+		CreationDate: img.CreationDate,
+	}
+
+	if loc != nil {
+		image.Region = loc.Region
+		image.Account = loc.Account
+	}
+
+	for _, tag := range img.Tags {
+		switch tag.Key {
+		case "role":
+			image.Role = tag.Value
+		case "active":
+			image.Active = tag.Value == "true"
+		case "version":
+			image.Version = tag.Value
+		}
+	}
+
+	return image
 }
@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidImageRetention = fmt.Errorf("image retention must be of the form role=count")
+)
+
+// ImageCleanupReport describes which images for a role were kept and
+// which were (or would be, in a dry run) deregistered, and why
+type ImageCleanupReport struct {
+	Role        string               `json:"role"`
+	Keep        int                  `json:"keep"`
+	DryRun      bool                 `json:"dry_run"`
+	GeneratedAt string               `json:"generated_at"`
+	Kept        []*ImageCleanupEntry `json:"kept"`
+	Removed     []*ImageCleanupEntry `json:"removed"`
+}
+
+// ImageCleanupEntry is a single image in an ImageCleanupReport
+type ImageCleanupEntry struct {
+	ImageID     string   `json:"image_id"`
+	Name        string   `json:"name"`
+	Region      string   `json:"region,omitempty"`
+	Account     string   `json:"account,omitempty"`
+	Reason      string   `json:"reason"`
+	SnapshotIDs []string `json:"snapshot_ids,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// ParseImageRetention parses a semicolon-delimited string of
+// role=count entries into a map of role to the number of most
+// recent active images to keep, e.g. "worker=3;web=5"
+func ParseImageRetention(s string) (map[string]int, error) {
+	retention := map[string]int{}
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errInvalidImageRetention
+		}
+
+		keep, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil || keep < 1 {
+			return nil, errInvalidImageRetention
+		}
+
+		retention[parts[0]] = int(keep)
+	}
+
+	return retention, nil
+}
+
+// PlanImageCleanup decides which of the given images for a role to
+// keep, which is the `keep` most recent active images according to
+// the selector, any image in use by an instance, any pinned image,
+// and any image the selector cannot rank.  All other images are
+// listed as removed.
+func PlanImageCleanup(role string, keep int, images []*Image, inUse, pinned map[string]bool, sel *ImageSelector) *ImageCleanupReport {
+	report := &ImageCleanupReport{
+		Role:        role,
+		Keep:        keep,
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+		Kept:        []*ImageCleanupEntry{},
+		Removed:     []*ImageCleanupEntry{},
+	}
+
+	if sel == nil {
+		sel = DefaultImageSelector
+	}
+
+	selection, _ := sel.Select(images)
+	activeKept := 0
+
+	for i := len(selection.Candidates) - 1; i >= 0; i-- {
+		cand := selection.Candidates[i]
+		img := cand.img
+		entry := &ImageCleanupEntry{ImageID: img.ImageID, Name: img.Name}
+
+		switch {
+		case cand.Skipped != "":
+			entry.Reason = fmt.Sprintf("not ranked by %s selector: %s", sel.Strategy, cand.Skipped)
+		case img.State != "available":
+			entry.Reason = fmt.Sprintf("image state is %q", img.State)
+		case img.Active && activeKept < keep:
+			activeKept++
+			entry.Reason = fmt.Sprintf("one of the %d most recent active images", keep)
+		case pinned[img.ImageID]:
+			entry.Reason = "pinned"
+		case inUse[img.ImageID]:
+			entry.Reason = "in use by an instance"
+		case img.Active:
+			entry.Reason = fmt.Sprintf("active but older than the %d most recent active images", keep)
+			report.Removed = append(report.Removed, entry)
+			continue
+		default:
+			entry.Reason = "inactive"
+			report.Removed = append(report.Removed, entry)
+			continue
+		}
+
+		report.Kept = append(report.Kept, entry)
+	}
+
+	return report
+}
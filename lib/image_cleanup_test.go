@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestPlanImageCleanup(t *testing.T) {
+	sel, err := NewImageSelector("version-tag", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	images := []*Image{
+		{ImageID: "ami-1", Name: "worker-1", State: "available", Active: true, Version: "1.0.0"},
+		{ImageID: "ami-unranked", Name: "worker-unranked", State: "available", Active: true},
+		{ImageID: "ami-5", Name: "worker-5", State: "available", Active: true, Version: "5.0.0"},
+		{ImageID: "ami-3", Name: "worker-3", State: "available", Active: true, Version: "3.0.0"},
+		{ImageID: "ami-6", Name: "worker-6", State: "pending", Active: true, Version: "6.0.0"},
+		{ImageID: "ami-4", Name: "worker-4", State: "available", Active: true, Version: "4.0.0"},
+		{ImageID: "ami-2", Name: "worker-2", State: "available", Active: true, Version: "2.0.0"},
+		{ImageID: "ami-0.5", Name: "worker-0.5", State: "available", Version: "0.5.0"},
+		{ImageID: "ami-0.4", Name: "worker-0.4", State: "available", Version: "0.4.0"},
+	}
+
+	report := PlanImageCleanup("worker", 2, images,
+		map[string]bool{"ami-2": true, "ami-0.4": true},
+		map[string]bool{"ami-3": true}, sel)
+
+	if report.Role != "worker" || report.Keep != 2 {
+		t.Errorf("expected role worker and keep 2, got %q and %d", report.Role, report.Keep)
+	}
+
+	for _, c := range []struct {
+		desc     string
+		actual   []*ImageCleanupEntry
+		expected []*ImageCleanupEntry
+	}{
+		{
+			"kept",
+			report.Kept,
+			[]*ImageCleanupEntry{
+				{ImageID: "ami-6", Reason: `image state is "pending"`},
+				{ImageID: "ami-5", Reason: "one of the 2 most recent active images"},
+				{ImageID: "ami-4", Reason: "one of the 2 most recent active images"},
+				{ImageID: "ami-3", Reason: "pinned"},
+				{ImageID: "ami-2", Reason: "in use by an instance"},
+				{ImageID: "ami-0.4", Reason: "in use by an instance"},
+				{ImageID: "ami-unranked", Reason: "not ranked by version-tag selector: missing version tag"},
+			},
+		},
+		{
+			"removed",
+			report.Removed,
+			[]*ImageCleanupEntry{
+				{ImageID: "ami-1", Reason: "active but older than the 2 most recent active images"},
+				{ImageID: "ami-0.5", Reason: "inactive"},
+			},
+		},
+	} {
+		if len(c.actual) != len(c.expected) {
+			t.Errorf("%s: expected %d entries, got %d", c.desc, len(c.expected), len(c.actual))
+			continue
+		}
+
+		for i, entry := range c.actual {
+			if entry.ImageID != c.expected[i].ImageID || entry.Reason != c.expected[i].Reason {
+				t.Errorf("%s[%d]: expected %s (%s), got %s (%s)", c.desc, i,
+					c.expected[i].ImageID, c.expected[i].Reason, entry.ImageID, entry.Reason)
+			}
+		}
+	}
+}
+
+func TestPlanImageCleanupDefaultSelector(t *testing.T) {
+	images := []*Image{
+		{ImageID: "ami-a", Name: "worker-a", State: "available", Active: true},
+		{ImageID: "ami-c", Name: "worker-c", State: "available", Active: true},
+		{ImageID: "ami-b", Name: "worker-b", State: "available", Active: true},
+	}
+
+	report := PlanImageCleanup("worker", 1, images, map[string]bool{}, map[string]bool{}, nil)
+
+	if len(report.Kept) != 1 || report.Kept[0].ImageID != "ami-c" {
+		t.Errorf("expected only ami-c to be kept, got %d kept", len(report.Kept))
+	}
+
+	if len(report.Removed) != 2 || report.Removed[0].ImageID != "ami-b" || report.Removed[1].ImageID != "ami-a" {
+		t.Errorf("expected ami-b and ami-a to be removed, got %d removed", len(report.Removed))
+	}
+}
+
+func TestParseImageRetention(t *testing.T) {
+	retention, err := ParseImageRetention("worker=3; web=5;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if retention["worker"] != 3 || retention["web"] != 5 || len(retention) != 2 {
+		t.Errorf("expected worker=3 and web=5, got %v", retention)
+	}
+
+	for _, s := range []string{"worker", "=3", "worker=0", "worker=-1", "worker=many"} {
+		if _, err := ParseImageRetention(s); err != errInvalidImageRetention {
+			t.Errorf("expected %v parsing %q, got %v", errInvalidImageRetention, s, err)
+		}
+	}
+}
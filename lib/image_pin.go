@@ -0,0 +1,37 @@
+package lib
+
+import "fmt"
+
+var (
+	errEmptyRole    = fmt.Errorf("empty \"role\" param")
+	errEmptyImageID = fmt.Errorf("empty \"image_id\" param")
+)
+
+// ImagePin is a specific image id to be used for a given role, site,
+// and env instead of the latest active image
+type ImagePin struct {
+	Role    string `json:"role"`
+	Site    string `json:"site"`
+	Env     string `json:"env"`
+	ImageID string `json:"image_id"`
+}
+
+// Validate performs multiple validity checks and returns a slice
+// of all errors found
+func (ip *ImagePin) Validate() []error {
+	errors := []error{}
+	if ip.Role == "" {
+		errors = append(errors, errEmptyRole)
+	}
+	if ip.Site == "" {
+		errors = append(errors, errEmptySite)
+	}
+	if ip.Env == "" {
+		errors = append(errors, errEmptyEnv)
+	}
+	if ip.ImageID == "" {
+		errors = append(errors, errEmptyImageID)
+	}
+
+	return errors
+}
@@ -0,0 +1,296 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidImageSelector = fmt.Errorf("image selector must be of the form role=strategy[:pattern]")
+	errMissingPatternGroup  = fmt.Errorf("name-pattern image selector requires a pattern with a capture group")
+
+	semverRegexp = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+	// DefaultImageSelector is the selector used for roles without a
+	// configured selector, which preserves the historical behavior
+	// of picking the lexically greatest image name
+	DefaultImageSelector = &ImageSelector{Strategy: "name"}
+)
+
+// ImageSelector describes how the latest image is chosen from a set
+// of candidate images
+type ImageSelector struct {
+	Strategy string `json:"strategy"`
+	Pattern  string `json:"pattern,omitempty"`
+	re       *regexp.Regexp
+}
+
+// ImageSelection is the explanation of which image was chosen by an
+// ImageSelector and why
+type ImageSelection struct {
+	Strategy   string            `json:"strategy"`
+	Pattern    string            `json:"pattern,omitempty"`
+	Chosen     *Image            `json:"chosen"`
+	Reason     string            `json:"reason"`
+	Candidates []*ImageCandidate `json:"candidates"`
+}
+
+// ImageCandidate is a single image considered by an ImageSelector,
+// along with the key it was sorted by or the reason it was skipped
+type ImageCandidate struct {
+	ImageID string `json:"image_id"`
+	Name    string `json:"name"`
+	SortKey string `json:"sort_key,omitempty"`
+	Skipped string `json:"skipped,omitempty"`
+
+	img *Image
+	ver *imageVersion
+}
+
+type imageVersion struct {
+	parts      [3]int
+	prerelease string
+}
+
+// NewImageSelector builds an *ImageSelector given a strategy and an
+// optional pattern, which is only used by the name-pattern strategy
+func NewImageSelector(strategy, pattern string) (*ImageSelector, error) {
+	sel := &ImageSelector{Strategy: strategy, Pattern: pattern}
+
+	switch strategy {
+	case "name", "creation-date", "version-tag":
+		return sel, nil
+	case "name-pattern":
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if re.NumSubexp() < 1 {
+			return nil, errMissingPatternGroup
+		}
+		sel.re = re
+		return sel, nil
+	}
+
+	return nil, fmt.Errorf("unknown image selector strategy %q", strategy)
+}
+
+// ParseImageSelectors parses a semicolon-delimited string of
+// role=strategy[:pattern] entries into a map of role to selector,
+// e.g. "worker=version-tag;web=name-pattern:^web-(\d+)$"
+func ParseImageSelectors(s string) (map[string]*ImageSelector, error) {
+	selectors := map[string]*ImageSelector{}
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errInvalidImageSelector
+		}
+
+		strategyParts := strings.SplitN(parts[1], ":", 2)
+		pattern := ""
+		if len(strategyParts) == 2 {
+			pattern = strategyParts[1]
+		}
+
+		sel, err := NewImageSelector(strategyParts[0], pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		selectors[parts[0]] = sel
+	}
+
+	return selectors, nil
+}
+
+// ImageSelectorForRole returns the configured selector for the given
+// role, or the DefaultImageSelector
+func ImageSelectorForRole(selectors map[string]*ImageSelector, role string) *ImageSelector {
+	if sel, ok := selectors[role]; ok && sel != nil {
+		return sel
+	}
+
+	return DefaultImageSelector
+}
+
+// Select chooses the latest image from the given images, returning
+// an explanation that includes every candidate considered
+func (sel *ImageSelector) Select(images []*Image) (*ImageSelection, error) {
+	selection := &ImageSelection{
+		Strategy:   sel.Strategy,
+		Pattern:    sel.Pattern,
+		Candidates: []*ImageCandidate{},
+	}
+
+	eligible := []*ImageCandidate{}
+
+	for _, img := range images {
+		cand := &ImageCandidate{ImageID: img.ImageID, Name: img.Name, img: img}
+		sel.assignSortKey(cand)
+		selection.Candidates = append(selection.Candidates, cand)
+
+		if cand.Skipped == "" {
+			eligible = append(eligible, cand)
+		}
+	}
+
+	sort.Sort(imageCandidatesBySortKey{sel: sel, c: selection.Candidates})
+
+	if len(eligible) == 0 {
+		selection.Reason = "no candidate images are eligible"
+		return selection, errNoLatestImage
+	}
+
+	sort.Sort(imageCandidatesBySortKey{sel: sel, c: eligible})
+	chosen := eligible[len(eligible)-1]
+
+	selection.Chosen = chosen.img
+	selection.Reason = fmt.Sprintf("greatest %s of %d eligible image(s) out of %d candidate(s)",
+		sel.describeKey(), len(eligible), len(images))
+
+	return selection, nil
+}
+
+func (sel *ImageSelector) assignSortKey(cand *ImageCandidate) {
+	switch sel.Strategy {
+	case "creation-date":
+		if cand.img.CreationDate == "" {
+			cand.Skipped = "missing creation date"
+			return
+		}
+		if _, err := time.Parse(time.RFC3339, cand.img.CreationDate); err != nil {
+			cand.Skipped = fmt.Sprintf("unparseable creation date %q", cand.img.CreationDate)
+			return
+		}
+		cand.SortKey = cand.img.CreationDate
+	case "version-tag":
+		if cand.img.Version == "" {
+			cand.Skipped = "missing version tag"
+			return
+		}
+		ver, err := parseImageVersion(cand.img.Version)
+		if err != nil {
+			cand.Skipped = err.Error()
+			return
+		}
+		cand.ver = ver
+		cand.SortKey = cand.img.Version
+	case "name-pattern":
+		re := sel.re
+		if re == nil {
+			re = regexp.MustCompile(sel.Pattern)
+		}
+		matches := re.FindStringSubmatch(cand.img.Name)
+		if len(matches) < 2 {
+			cand.Skipped = "name does not match pattern"
+			return
+		}
+		cand.SortKey = matches[1]
+	default:
+		cand.SortKey = cand.img.Name
+	}
+}
+
+func (sel *ImageSelector) describeKey() string {
+	switch sel.Strategy {
+	case "creation-date":
+		return "creation date"
+	case "version-tag":
+		return "semantic version from the version tag"
+	case "name-pattern":
+		return "name pattern capture"
+	}
+	return "name"
+}
+
+func (sel *ImageSelector) less(a, b *ImageCandidate) bool {
+	if a.Skipped != "" || b.Skipped != "" {
+		if a.Skipped != "" && b.Skipped != "" {
+			return a.Name < b.Name
+		}
+		return a.Skipped != ""
+	}
+
+	switch sel.Strategy {
+	case "version-tag":
+		if c := a.ver.compare(b.ver); c != 0 {
+			return c < 0
+		}
+	case "name-pattern":
+		aN, aErr := strconv.ParseInt(a.SortKey, 10, 64)
+		bN, bErr := strconv.ParseInt(b.SortKey, 10, 64)
+		if aErr == nil && bErr == nil && aN != bN {
+			return aN < bN
+		}
+		if a.SortKey != b.SortKey {
+			return a.SortKey < b.SortKey
+		}
+	default:
+		if a.SortKey != b.SortKey {
+			return a.SortKey < b.SortKey
+		}
+	}
+
+	return a.Name < b.Name
+}
+
+type imageCandidatesBySortKey struct {
+	sel *ImageSelector
+	c   []*ImageCandidate
+}
+
+func (s imageCandidatesBySortKey) Len() int           { return len(s.c) }
+func (s imageCandidatesBySortKey) Swap(i, j int)      { s.c[i], s.c[j] = s.c[j], s.c[i] }
+func (s imageCandidatesBySortKey) Less(i, j int) bool { return s.sel.less(s.c[i], s.c[j]) }
+
+func parseImageVersion(s string) (*imageVersion, error) {
+	matches := semverRegexp.FindStringSubmatch(s)
+	if matches == nil {
+		return nil, fmt.Errorf("version tag %q is not a semantic version", s)
+	}
+
+	ver := &imageVersion{prerelease: matches[4]}
+	for i := 0; i < 3; i++ {
+		n, err := strconv.Atoi(matches[i+1])
+		if err != nil {
+			return nil, err
+		}
+		ver.parts[i] = n
+	}
+
+	return ver, nil
+}
+
+func (v *imageVersion) compare(o *imageVersion) int {
+	for i := 0; i < 3; i++ {
+		if v.parts[i] != o.parts[i] {
+			if v.parts[i] < o.parts[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// a version without a prerelease has higher precedence
+	switch {
+	case v.prerelease == o.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case o.prerelease == "":
+		return -1
+	case v.prerelease < o.prerelease:
+		return -1
+	}
+	return 1
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestImageSelectorVersionTag(t *testing.T) {
+	sel, err := NewImageSelector("version-tag", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		desc       string
+		versions   []string
+		chosen     string
+		candidates []string
+		skipped    []string
+	}{
+		{
+			"numeric ordering",
+			[]string{"v1.2.3", "1.10.0", "1.9.9"},
+			"1.10.0",
+			[]string{"v1.2.3", "1.9.9", "1.10.0"},
+			[]string{},
+		},
+		{
+			"release after prerelease",
+			[]string{"2.0.0", "2.0.0-rc.1", "1.99.0"},
+			"2.0.0",
+			[]string{"1.99.0", "2.0.0-rc.1", "2.0.0"},
+			[]string{},
+		},
+		{
+			"prerelease ordering",
+			[]string{"3.0.0-beta", "3.0.0-alpha"},
+			"3.0.0-beta",
+			[]string{"3.0.0-alpha", "3.0.0-beta"},
+			[]string{},
+		},
+		{
+			"build metadata",
+			[]string{"1.0.0+build.5", "0.9.0"},
+			"1.0.0+build.5",
+			[]string{"0.9.0", "1.0.0+build.5"},
+			[]string{},
+		},
+		{
+			"unparseable and missing versions are skipped",
+			[]string{"", "latest", "1.0", "0.0.1"},
+			"0.0.1",
+			[]string{"", "1.0", "latest", "0.0.1"},
+			[]string{"", "1.0", "latest"},
+		},
+	} {
+		images := []*Image{}
+		for _, version := range c.versions {
+			images = append(images, &Image{ImageID: "ami-" + version, Name: "img-" + version, Version: version})
+		}
+
+		selection, err := sel.Select(images)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.desc, err)
+			continue
+		}
+
+		if selection.Chosen == nil || selection.Chosen.Version != c.chosen {
+			t.Errorf("%s: expected %q to be chosen, got %+v", c.desc, c.chosen, selection.Chosen)
+		}
+
+		candidates := []string{}
+		skipped := []string{}
+		for _, cand := range selection.Candidates {
+			candidates = append(candidates, cand.img.Version)
+			if cand.Skipped != "" {
+				skipped = append(skipped, cand.img.Version)
+			}
+		}
+
+		if strings.Join(candidates, ",") != strings.Join(c.candidates, ",") {
+			t.Errorf("%s: expected candidates %v, got %v", c.desc, c.candidates, candidates)
+		}
+
+		if strings.Join(skipped, ",") != strings.Join(c.skipped, ",") {
+			t.Errorf("%s: expected skipped %v, got %v", c.desc, c.skipped, skipped)
+		}
+	}
+}
+
+func TestImageSelectorVersionTagNoneEligible(t *testing.T) {
+	sel, err := NewImageSelector("version-tag", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selection, err := sel.Select([]*Image{
+		{ImageID: "ami-a", Name: "a"},
+		{ImageID: "ami-b", Name: "b", Version: "not-a-version"},
+	})
+	if err != errNoLatestImage {
+		t.Errorf("expected %v, got %v", errNoLatestImage, err)
+	}
+
+	if selection.Chosen != nil {
+		t.Errorf("expected no image to be chosen, got %+v", selection.Chosen)
+	}
+
+	if len(selection.Candidates) != 2 {
+		t.Errorf("expected 2 candidates, got %d", len(selection.Candidates))
+	}
+}
+
+func TestParseImageSelectors(t *testing.T) {
+	selectors, err := ParseImageSelectors(`worker=version-tag; web=name-pattern:^web-(\d+)$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ImageSelectorForRole(selectors, "worker").Strategy != "version-tag" {
+		t.Errorf("expected version-tag selector for worker, got %+v", selectors["worker"])
+	}
+
+	if ImageSelectorForRole(selectors, "web").Pattern != `^web-(\d+)$` {
+		t.Errorf("expected name-pattern selector for web, got %+v", selectors["web"])
+	}
+
+	if ImageSelectorForRole(selectors, "other") != DefaultImageSelector {
+		t.Errorf("expected default selector for other role")
+	}
+
+	for _, s := range []string{"worker", "=version-tag", "worker=bogus", "web=name-pattern:^web-\\d+$"} {
+		if _, err := ParseImageSelectors(s); err == nil {
+			t.Errorf("expected an error parsing %q", s)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package lib
+
+// ImageUpdatePayload is the representation used when enqueueing an
+// image update to the background workers
+type ImageUpdatePayload struct {
+	ImageID      string `json:"image_id"`
+	Active       bool   `json:"active"`
+	SlackChannel string `json:"slack_channel"`
+}
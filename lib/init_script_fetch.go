@@ -0,0 +1,9 @@
+package lib
+
+// InitScriptFetch is a single attempt to fetch the init script for
+// an instance build
+type InitScriptFetch struct {
+	RemoteIP string `json:"remote_ip"`
+	Result   string `json:"result"`
+	Time     string `json:"time"`
+}
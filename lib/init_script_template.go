@@ -1,5 +1,68 @@
 package lib
 
+import (
+	"fmt"
+	"regexp"
+	"text/template"
+)
+
+var (
+	errEmptyInitScriptTemplateName = fmt.Errorf("empty \"name\" param")
+	errInvalidInitScriptTemplate   = fmt.Errorf("name may only contain lowercase letters, digits, \"-\", and \"_\"")
+	errEmptyInitScriptTemplate     = fmt.Errorf("empty \"template\" param")
+
+	initScriptTemplateNameRegexp = regexp.MustCompile(`^[a-z0-9_-]+$`)
+)
+
+// DefaultInitScriptTemplateName is the name of the stored init script
+// template used for roles without a template of their own
+const DefaultInitScriptTemplateName = "default"
+
+// InitScriptTemplatesCollectionSingular is the singular
+// representation used in jsonapi bodies
+type InitScriptTemplatesCollectionSingular struct {
+	InitScriptTemplates *InitScriptTemplate `json:"init_script_templates"`
+}
+
+// InitScriptTemplatesCollection is the collection representation
+// used in jsonapi bodies
+type InitScriptTemplatesCollection struct {
+	InitScriptTemplates []*InitScriptTemplate `json:"init_script_templates"`
+}
+
+// InitScriptTemplate is a single version of a named init script
+// template, where the name is typically a role or a variant thereof
+type InitScriptTemplate struct {
+	Name      string `json:"name"`
+	Version   int    `json:"version"`
+	Current   bool   `json:"current"`
+	Template  string `json:"template"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Validate performs multiple validity checks, including parsing the
+// template, and returns a slice of all errors found
+func (t *InitScriptTemplate) Validate() []error {
+	errors := []error{}
+	if t.Name == "" {
+		errors = append(errors, errEmptyInitScriptTemplateName)
+	} else if !initScriptTemplateNameRegexp.MatchString(t.Name) {
+		errors = append(errors, errInvalidInitScriptTemplate)
+	}
+	if t.Template == "" {
+		errors = append(errors, errEmptyInitScriptTemplate)
+	} else if _, err := t.Parse(); err != nil {
+		errors = append(errors, err)
+	}
+
+	return errors
+}
+
+// Parse parses the template text into a *template.Template
+func (t *InitScriptTemplate) Parse() (*template.Template, error) {
+	return template.New(fmt.Sprintf("init-script-%s-%d", t.Name, t.Version)).Parse(t.Template)
+}
+
 // GetInitScriptTemplate attempts to get the init script template
 // from the `INIT_SCRIPT_TEMPLATE` and
 // `PUDDING_INIT_SCRIPT_TEMPLATE` compressed env vars
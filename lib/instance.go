@@ -1,6 +1,36 @@
 package lib
 
-// Instance is the internal representation of an EC2 instance
+import (
+	"time"
+
+	"github.com/mitchellh/goamz/ec2"
+)
+
+const (
+	// InstanceTagAttrPrefix prefixes the user tag keys in the flat
+	// attributes of an instance
+	InstanceTagAttrPrefix = "tag:"
+)
+
+var (
+	// InstanceStates are the non-terminated ec2 instance states
+	// tracked by the ec2 syncer
+	InstanceStates = []string{"pending", "running", "shutting-down", "stopping", "stopped"}
+
+	// InstanceActionStates are the states an instance passes through
+	// after each action, during which the reason given for the action
+	// applies
+	InstanceActionStates = map[string][]string{
+		"start": []string{"pending", "running"},
+		"stop":  []string{"stopping", "stopped"},
+	}
+)
+
+// Instance is the internal representation of an EC2 instance, where
+// Tags are any tags other than the ReservedTagKeys.  StateReason is
+// the reason given for the last start or stop requested through
+// pudding.  The termination attributes are only set on instances in
+// the instance history.
 type Instance struct {
 	Name         string `json:"name" redis:"name"`
 	InstanceID   string `json:"id" redis:"instance_id"`
@@ -13,4 +43,135 @@ type Instance struct {
 	Env          string `json:"env" redis:"env"`
 	Site         string `json:"site" redis:"site"`
 	Role         string `json:"role" redis:"role"`
+	PurchaseType string `json:"purchase_type,omitempty" redis:"purchase_type"`
+	Region       string `json:"region,omitempty" redis:"region"`
+	Account      string `json:"account,omitempty" redis:"account"`
+
+	SubnetID         string `json:"subnet_id,omitempty" redis:"subnet_id"`
+	AvailabilityZone string `json:"availability_zone,omitempty" redis:"availability_zone"`
+	State            string `json:"state,omitempty" redis:"state"`
+	StateReason      string `json:"state_reason,omitempty" redis:"state_reason"`
+
+	InstanceBuildID   string `json:"instance_build_id,omitempty" redis:"instance_build_id"`
+	Requester         string `json:"requester,omitempty" redis:"requester"`
+	InstanceBuildHREF string `json:"instance_build_href,omitempty" redis:"-"`
+
+	TerminatedAt    string `json:"terminated_at,omitempty" redis:"-"`
+	TerminatedBy    string `json:"terminated_by,omitempty" redis:"-"`
+	LifetimeSeconds int64  `json:"lifetime_seconds,omitempty" redis:"-"`
+
+	Tags map[string]string `json:"tags,omitempty" redis:"-"`
+}
+
+// Location returns the region and account in which the instance runs
+func (i *Instance) Location() *Location {
+	return &Location{Region: i.Region, Account: i.Account}
+}
+
+// MarkTerminated sets the state of the instance to terminated along
+// with when and by whom, and its lifetime since launch
+func (i *Instance) MarkTerminated(by string, at time.Time) {
+	i.State = "terminated"
+	i.TerminatedAt = at.UTC().Format(time.RFC3339)
+	i.TerminatedBy = by
+
+	launchTime, err := time.Parse(time.RFC3339, i.LaunchTime)
+	if err == nil {
+		i.LifetimeSeconds = int64(at.Sub(launchTime).Seconds())
+	}
+}
+
+// ApplyStateReason sets the state reason to the reason given for the
+// requested action if the instance is in a state resulting from it
+func (i *Instance) ApplyStateReason(action, reason string) {
+	if containsString(InstanceActionStates[action], i.State) {
+		i.StateReason = reason
+	}
+}
+
+// IsInstanceState checks if the given state is among the
+// InstanceStates tracked by the ec2 syncer
+func IsInstanceState(state string) bool {
+	return containsString(InstanceStates, state)
+}
+
+// NewInstanceFromEC2 builds an *Instance from the ec2 representation
+// and the location in which it runs, which may be nil
+func NewInstanceFromEC2(inst ec2.Instance, loc *Location) *Instance {
+	i := &Instance{
+		InstanceID:       inst.InstanceId,
+		InstanceType:     inst.InstanceType,
+		ImageID:          inst.ImageId,
+		IP:               inst.PublicIpAddress,
+		PrivateIP:        inst.PrivateIpAddress,
+		LaunchTime:       inst.LaunchTime.Format(time.RFC3339),
+		SubnetID:         inst.SubnetId,
+		AvailabilityZone: inst.AvailZone,
+		State:            inst.State.Name,
+		Tags:             map[string]string{},
+	}
+
+	if loc != nil {
+		i.Region = loc.Region
+		i.Account = loc.Account
+	}
+
+	for _, tag := range inst.Tags {
+		switch tag.Key {
+		case "Name":
+			i.Name = tag.Value
+		case "queue":
+			i.Queue = tag.Value
+		case "env":
+			i.Env = tag.Value
+		case "site":
+			i.Site = tag.Value
+		case "role":
+			i.Role = tag.Value
+		case "purchase_type":
+			i.PurchaseType = tag.Value
+		case "instance_build_id":
+			i.InstanceBuildID = tag.Value
+		case "requester":
+			i.Requester = tag.Value
+		default:
+			i.Tags[tag.Key] = tag.Value
+		}
+	}
+
+	return i
+}
+
+// Attributes returns the instance as a flat map of attribute names to
+// values, as stored in redis, with each user tag key prefixed by
+// InstanceTagAttrPrefix
+func (i *Instance) Attributes() map[string]string {
+	attrs := map[string]string{
+		"name":              i.Name,
+		"instance_id":       i.InstanceID,
+		"instance_type":     i.InstanceType,
+		"image_id":          i.ImageID,
+		"ip":                i.IP,
+		"private_ip":        i.PrivateIP,
+		"launch_time":       i.LaunchTime,
+		"queue":             i.Queue,
+		"env":               i.Env,
+		"site":              i.Site,
+		"role":              i.Role,
+		"purchase_type":     i.PurchaseType,
+		"region":            i.Region,
+		"account":           i.Account,
+		"subnet_id":         i.SubnetID,
+		"availability_zone": i.AvailabilityZone,
+		"state":             i.State,
+		"state_reason":      i.StateReason,
+		"instance_build_id": i.InstanceBuildID,
+		"requester":         i.Requester,
+	}
+
+	for key, value := range i.Tags {
+		attrs[InstanceTagAttrPrefix+key] = value
+	}
+
+	return attrs
 }
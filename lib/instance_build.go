@@ -5,17 +5,20 @@ import (
 	"strings"
 
 	"github.com/gorilla/feeds"
+	"github.com/mitchellh/goamz/ec2"
 )
 
 var (
 	errEmptySite            = fmt.Errorf("empty \"site\" param")
-	errInvalidSite          = fmt.Errorf("site must be either org or com")
 	errEmptyEnv             = fmt.Errorf("empty \"env\" param")
-	errInvalidEnv           = fmt.Errorf("env must be prod, staging, or test")
 	errInvalidInstanceCount = fmt.Errorf("count must be more than 0")
-	errInvalidState         = fmt.Errorf("state must be pending, started, or finished")
+	errInvalidState         = fmt.Errorf("state must be pending, started, finished, failed, or timed-out")
 	errEmptyQueue           = fmt.Errorf("empty \"queue\" param")
-	errEmptyInstanceType    = fmt.Errorf("empty \"instance_type\" param")
+	errEmptyInstanceType    = fmt.Errorf("empty \"instance_type\" and \"instance_types\" params")
+	errEmptySpotMaxPrice    = fmt.Errorf("\"spot\" requires \"spot_max_price\"")
+	errInvalidSpotTimeout   = fmt.Errorf("spot_timeout must not be negative")
+
+	errInitScriptTemplateVersionWithoutName = fmt.Errorf("\"init_script_template_version\" requires \"init_script_template\"")
 )
 
 // InstanceBuildsCollectionSingular is the singular representation
@@ -33,75 +36,154 @@ type InstanceBuildsCollection struct {
 // InstanceBuild contains everything needed by a background worker
 // to build the instance
 type InstanceBuild struct {
-	Role            string `json:"role,omitempty"`
-	Site            string `json:"site"`
-	Env             string `json:"env"`
-	AMI             string `json:"ami"`
-	InstanceID      string `json:"instance_id,omitempty"`
-	NameTemplate    string `json:"name_template,omitempty"`
-	InstanceType    string `json:"instance_type"`
-	SlackChannel    string `json:"slack_channel"`
-	Count           int    `json:"count"`
-	Queue           string `json:"queue"`
-	SubnetID        string `json:"subnet_id,omitempty"`
-	SecurityGroupID string `json:"security_group_id,omitempty"`
-	HREF            string `json:"href,omitempty"`
-	State           string `json:"state,omitempty"`
-	ID              string `json:"id,omitempty"`
+	Role                      string            `json:"role,omitempty" redis:"role"`
+	Site                      string            `json:"site" redis:"site"`
+	Env                       string            `json:"env" redis:"env"`
+	AMI                       string            `json:"ami" redis:"ami"`
+	InstanceID                string            `json:"instance_id,omitempty" redis:"instance_id"`
+	IP                        string            `json:"ip,omitempty" redis:"ip"`
+	PrivateIP                 string            `json:"private_ip,omitempty" redis:"private_ip"`
+	NameTemplate              string            `json:"name_template,omitempty" redis:"name_template"`
+	InstanceType              string            `json:"instance_type" redis:"instance_type"`
+	SlackChannel              string            `json:"slack_channel" redis:"slack_channel"`
+	Count                     int               `json:"count" redis:"count"`
+	Queue                     string            `json:"queue" redis:"queue"`
+	SubnetID                  string            `json:"subnet_id,omitempty" redis:"subnet_id"`
+	SecurityGroupID           string            `json:"security_group_id,omitempty" redis:"security_group_id"`
+	InitScriptTemplate        string            `json:"init_script_template,omitempty" redis:"init_script_template"`
+	InitScriptTemplateVersion int               `json:"init_script_template_version,omitempty" redis:"init_script_template_version"`
+	Spot                      bool              `json:"spot,omitempty" redis:"spot"`
+	SpotMaxPrice              string            `json:"spot_max_price,omitempty" redis:"spot_max_price"`
+	SpotTimeout               int               `json:"spot_timeout,omitempty" redis:"spot_timeout"`
+	PurchaseType              string            `json:"purchase_type,omitempty" redis:"purchase_type"`
+	RootVolumeSize            int64             `json:"root_volume_size,omitempty" redis:"root_volume_size"`
+	RootVolumeType            string            `json:"root_volume_type,omitempty" redis:"root_volume_type"`
+	RootVolumeIOPS            int64             `json:"root_volume_iops,omitempty" redis:"root_volume_iops"`
+	BlockDevices              []*BlockDevice    `json:"block_devices,omitempty" redis:"-"`
+	IAMInstanceProfile        string            `json:"iam_instance_profile,omitempty" redis:"iam_instance_profile"`
+	KeyName                   string            `json:"key_name,omitempty" redis:"key_name"`
+	EBSOptimized              bool              `json:"ebs_optimized,omitempty" redis:"ebs_optimized"`
+	PlacementGroup            string            `json:"placement_group,omitempty" redis:"placement_group"`
+	AvailabilityZone          string            `json:"availability_zone,omitempty" redis:"availability_zone"`
+	SubnetIDs                 []string          `json:"subnet_ids,omitempty" redis:"-"`
+	AvailabilityZones         []string          `json:"availability_zones,omitempty" redis:"-"`
+	InstanceTypes             []string          `json:"instance_types,omitempty" redis:"-"`
+	Region                    string            `json:"region,omitempty" redis:"region"`
+	Account                   string            `json:"account,omitempty" redis:"account"`
+	Tags                      map[string]string `json:"tags,omitempty" redis:"-"`
+	Requester                 string            `json:"requester,omitempty" redis:"requester"`
+	HREF                      string            `json:"href,omitempty" redis:"-"`
+	InstanceHREF              string            `json:"instance_href,omitempty" redis:"-"`
+	InstancesHREF             string            `json:"instances_href,omitempty" redis:"-"`
+	State                     string            `json:"state,omitempty" redis:"state"`
+	StartedAt                 string            `json:"started_at,omitempty" redis:"started_at"`
+	TimedOutAt                string            `json:"timed_out_at,omitempty" redis:"timed_out_at"`
+	ConsoleOutput             string            `json:"console_output,omitempty" redis:"console_output"`
+	ID                        string            `json:"id,omitempty" redis:"id"`
 }
 
 // NewInstanceBuild creates a new *InstanceBuild, along with
-// generating a unique ID and setting the State to "pending"
+// generating a unique ID and setting the State to "pending".  The
+// Role and NameTemplate are left empty to be filled in by
+// Topology.ApplyDefaults.
 func NewInstanceBuild() *InstanceBuild {
 	return &InstanceBuild{
 		ID:    feeds.NewUUID().String(),
 		State: "pending",
-
-		// FIXME: accept Role and NameTemplate as configuration
-		Role: "worker",
-		// XXX: formerly known as:
-		//   fmt.Sprintf("travis-%s-%s-%s-%s",
-		//     b.Site,
-		//     b.Env,
-		//     b.Queue,
-		//     strings.TrimPrefix(b.InstanceID, "i-"))
-		NameTemplate: "travis-{{.Site}}-{{.Env}}-{{.Queue}}-{{.InstanceIDWithoutPrefix}}",
 	}
 }
 
-// Validate performs multiple validity checks and returns a slice
-// of all errors found
-func (b *InstanceBuild) Validate() []error {
+// Validate performs multiple validity checks against the given
+// *Topology (or the default topology if nil) and returns a slice of
+// all errors found
+func (b *InstanceBuild) Validate(topo *Topology) []error {
+	if topo == nil {
+		topo = DefaultTopology()
+	}
+
 	errors := []error{}
 	if b.Site == "" {
 		errors = append(errors, errEmptySite)
 	}
-	if b.Site != "org" && b.Site != "com" {
-		errors = append(errors, errInvalidSite)
-	}
 	if b.Env == "" {
 		errors = append(errors, errEmptyEnv)
 	}
-	if b.Env != "prod" && b.Env != "staging" && b.Env != "test" {
-		errors = append(errors, errInvalidEnv)
-	}
+	errors = append(errors, topo.Validate(b.Site, b.Env, b.Role)...)
+	errors = append(errors, topo.ValidateLocation(b.Region, b.Account)...)
 	if b.Queue == "" {
 		errors = append(errors, errEmptyQueue)
 	}
-	if b.InstanceType == "" {
+	if b.InstanceType == "" && len(b.InstanceTypes) == 0 {
 		errors = append(errors, errEmptyInstanceType)
 	}
-	if b.State != "pending" && b.State != "started" && b.State != "finished" {
+	if len(b.SubnetIDs) > 0 && len(b.AvailabilityZones) > 0 {
+		errors = append(errors, errPlacementListConflict)
+	}
+	switch b.State {
+	case "pending", "started", "finished", "failed", "timed-out":
+	default:
 		errors = append(errors, errInvalidState)
 	}
 	if b.Count < 1 {
 		errors = append(errors, errInvalidInstanceCount)
 	}
+	if b.Spot && b.SpotMaxPrice == "" {
+		errors = append(errors, errEmptySpotMaxPrice)
+	}
+	if b.SpotTimeout < 0 {
+		errors = append(errors, errInvalidSpotTimeout)
+	}
+	if b.RootVolumeSize < 0 {
+		errors = append(errors, errInvalidRootVolume)
+	}
+	if b.RootVolumeSize == 0 && (b.RootVolumeType != "" || b.RootVolumeIOPS != 0) {
+		errors = append(errors, errRootVolumeTypeAlone)
+	}
+	errors = append(errors, validateVolumeType(b.RootVolumeType, b.RootVolumeIOPS)...)
+	for _, bd := range b.BlockDevices {
+		errors = append(errors, bd.Validate()...)
+	}
+	if b.InitScriptTemplateVersion != 0 && b.InitScriptTemplate == "" {
+		errors = append(errors, errInitScriptTemplateVersionWithoutName)
+	}
 
 	return errors
 }
 
+// Location returns the region and account in which the instance is
+// to be built, where empty values refer to the workers' own
+func (b *InstanceBuild) Location() *Location {
+	return &Location{Region: b.Region, Account: b.Account}
+}
+
+// Done checks whether the instance build has finished, failed, or
+// timed out, after which its state no longer changes
+func (b *InstanceBuild) Done() bool {
+	return b.State == "finished" || b.State == "failed" || b.State == "timed-out"
+}
+
 // InstanceIDWithoutPrefix returns the InstanceID without "i-"
 func (b *InstanceBuild) InstanceIDWithoutPrefix() string {
 	return strings.TrimPrefix(b.InstanceID, "i-")
 }
+
+// EC2BlockDeviceMappings returns the ec2 block device mappings for
+// the root volume, if sized, followed by any extra block devices
+func (b *InstanceBuild) EC2BlockDeviceMappings(rootDeviceName string) []ec2.BlockDeviceMapping {
+	mappings := []ec2.BlockDeviceMapping{}
+	if b.RootVolumeSize > 0 {
+		root := &BlockDevice{
+			DeviceName: rootDeviceName,
+			VolumeSize: b.RootVolumeSize,
+			VolumeType: b.RootVolumeType,
+			IOPS:       b.RootVolumeIOPS,
+		}
+		mappings = append(mappings, root.EC2BlockDeviceMapping())
+	}
+
+	for _, bd := range b.BlockDevices {
+		mappings = append(mappings, bd.EC2BlockDeviceMapping())
+	}
+
+	return mappings
+}
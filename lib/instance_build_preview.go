@@ -0,0 +1,11 @@
+package lib
+
+// InstanceBuildPreview is an init script rendered for an instance
+// build without launching anything, where the instance build records
+// the init script template name and version used
+type InstanceBuildPreview struct {
+	InstanceBuild *InstanceBuild `json:"instance_build"`
+	Redacted      bool           `json:"redacted"`
+	Script        string         `json:"script"`
+	InstanceYML   string         `json:"instance_yml"`
+}
@@ -0,0 +1,54 @@
+package lib
+
+import "testing"
+
+func TestInstanceBuildValidateState(t *testing.T) {
+	for _, c := range []struct {
+		state string
+		valid bool
+	}{
+		{"pending", true},
+		{"started", true},
+		{"finished", true},
+		{"failed", true},
+		{"timed-out", true},
+		{"", false},
+		{"booting", false},
+	} {
+		b := &InstanceBuild{
+			Site:         "org",
+			Env:          "prod",
+			Queue:        "docker",
+			InstanceType: "c3.2xlarge",
+			Count:        1,
+			State:        c.state,
+		}
+
+		errs := b.Validate(nil)
+		if c.valid && len(errs) != 0 {
+			t.Errorf("expected state %q to be valid, got %v", c.state, errs)
+		}
+
+		if !c.valid && (len(errs) != 1 || errs[0] != errInvalidState) {
+			t.Errorf("expected state %q to be invalid, got %v", c.state, errs)
+		}
+	}
+}
+
+func TestInstanceBuildDone(t *testing.T) {
+	for _, c := range []struct {
+		state string
+		done  bool
+	}{
+		{"", false},
+		{"pending", false},
+		{"started", false},
+		{"finished", true},
+		{"failed", true},
+		{"timed-out", true},
+	} {
+		if (&InstanceBuild{State: c.state}).Done() != c.done {
+			t.Errorf("expected done %v for state %q", c.done, c.state)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/hamfist/yaml"
+)
+
+var (
+	secretKeyRegexp = regexp.MustCompile(`(?i)(password|passwd|token|secret|access_key|api_key|private_key|credential)`)
+
+	errNoInstanceConfigLayers = fmt.Errorf("instance yml has none of the global, sites, envs, or queues keys")
+)
+
+// InstanceConfig is the layered configuration from which
+// instance-specific yml is generated.  Each layer is an arbitrary
+// tree of keys, and the layers that apply to an instance are deep
+// merged in order:
+//
+//	global
+//	sites[site]
+//	envs[env]
+//	envs[site.env]
+//	queues[queue]
+//	queues[site.env.queue]
+//
+// After parsing, every string value containing "{{" is executed as a
+// text/template with an InstanceConfigContext, so that values may
+// refer to e.g. the queue or instance count.  Values of keys that look
+// like they hold a credential are never executed.
+type InstanceConfig struct {
+	Global map[string]interface{}            `yaml:"global"`
+	Sites  map[string]map[string]interface{} `yaml:"sites"`
+	Envs   map[string]map[string]interface{} `yaml:"envs"`
+	Queues map[string]map[string]interface{} `yaml:"queues"`
+}
+
+// InstanceConfigContext is the data available when executing the raw
+// instance config yml as a template
+type InstanceConfigContext struct {
+	Site  string
+	Env   string
+	Queue string
+	Count int
+}
+
+// InstanceConfigLayer is a single named layer of an InstanceConfig
+type InstanceConfigLayer struct {
+	Name string
+	Data map[string]interface{}
+}
+
+// ParseInstanceConfig parses the raw yml into an *InstanceConfig and
+// renders its string values for the given context
+func ParseInstanceConfig(rawYML string, ctx *InstanceConfigContext) (*InstanceConfig, error) {
+	ic := &InstanceConfig{}
+	err := yaml.Unmarshal([]byte(rawYML), ic)
+	if err != nil {
+		return nil, err
+	}
+
+	if ic.Global == nil && ic.Sites == nil && ic.Envs == nil && ic.Queues == nil {
+		return nil, errNoInstanceConfigLayers
+	}
+
+	ic.Global, err = renderInstanceConfigLayer("global", ic.Global, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for section, layers := range map[string]map[string]map[string]interface{}{
+		"sites":  ic.Sites,
+		"envs":   ic.Envs,
+		"queues": ic.Queues,
+	} {
+		for name, data := range layers {
+			layers[name], err = renderInstanceConfigLayer(fmt.Sprintf("%s.%s", section, name), data, ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ic, nil
+}
+
+func renderInstanceConfigLayer(name string, data map[string]interface{}, ctx *InstanceConfigContext) (map[string]interface{}, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	rendered, err := renderInstanceConfigValue(name, data, ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return rendered.(map[string]interface{}), nil
+}
+
+// renderInstanceConfigValue returns a copy of v in which every string
+// containing "{{" is executed as a template with the context, unless
+// it is below a key that looks like it holds a credential.  A string
+// rendering to an integer, such as "{{.Count}}", becomes that integer.
+func renderInstanceConfigValue(path string, v interface{}, ctx *InstanceConfigContext, secret bool) (interface{}, error) {
+	if m, ok := toStringMap(v); ok {
+		rendered := map[string]interface{}{}
+		for key, value := range m {
+			r, err := renderInstanceConfigValue(fmt.Sprintf("%s.%s", path, key), value, ctx, secret || secretKeyRegexp.MatchString(key))
+			if err != nil {
+				return nil, err
+			}
+			rendered[key] = r
+		}
+		return rendered, nil
+	}
+
+	switch value := v.(type) {
+	case []interface{}:
+		rendered := []interface{}{}
+		for i, item := range value {
+			r, err := renderInstanceConfigValue(fmt.Sprintf("%s[%d]", path, i), item, ctx, secret)
+			if err != nil {
+				return nil, err
+			}
+			rendered = append(rendered, r)
+		}
+		return rendered, nil
+	case string:
+		if secret || !strings.Contains(value, "{{") {
+			return value, nil
+		}
+
+		t, err := template.New(path).Parse(value)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := &bytes.Buffer{}
+		err = t.Execute(buf, ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		out := buf.String()
+		if n, err := strconv.Atoi(out); err == nil && strconv.Itoa(n) == out {
+			return n, nil
+		}
+		return out, nil
+	}
+
+	return v, nil
+}
+
+// Layers returns the layers that apply to the given site, env, and
+// queue, in the order in which they are merged
+func (ic *InstanceConfig) Layers(site, env, queue string) []*InstanceConfigLayer {
+	layers := []*InstanceConfigLayer{}
+	add := func(name string, data map[string]interface{}) {
+		if data != nil {
+			layers = append(layers, &InstanceConfigLayer{Name: name, Data: data})
+		}
+	}
+
+	siteEnv := fmt.Sprintf("%s.%s", site, env)
+
+	add("global", ic.Global)
+	add(fmt.Sprintf("sites.%s", site), ic.Sites[site])
+	add(fmt.Sprintf("envs.%s", env), ic.Envs[env])
+	add(fmt.Sprintf("envs.%s", siteEnv), ic.Envs[siteEnv])
+	add(fmt.Sprintf("queues.%s", queue), ic.Queues[queue])
+	add(fmt.Sprintf("queues.%s.%s", siteEnv, queue), ic.Queues[fmt.Sprintf("%s.%s", siteEnv, queue)])
+
+	return layers
+}
+
+// Merge deep merges the layers that apply to the given site, env, and
+// queue, where maps are merged key by key and any other value in a
+// later layer replaces that of an earlier one
+func (ic *InstanceConfig) Merge(site, env, queue string) (map[string]interface{}, error) {
+	if _, ok := ic.Sites[site]; !ok {
+		return nil, fmt.Errorf("sites.%s missing", site)
+	}
+
+	_, envOK := ic.Envs[env]
+	_, siteEnvOK := ic.Envs[fmt.Sprintf("%s.%s", site, env)]
+	if !envOK && !siteEnvOK {
+		return nil, fmt.Errorf("envs.%s.%s missing", site, env)
+	}
+
+	merged := map[string]interface{}{}
+	for _, layer := range ic.Layers(site, env, queue) {
+		merged = deepMerge(merged, layer.Data)
+	}
+
+	return merged, nil
+}
+
+func deepMerge(dst, src map[string]interface{}) map[string]interface{} {
+	for key, srcValue := range src {
+		srcMap, srcIsMap := toStringMap(srcValue)
+		dstMap, dstIsMap := toStringMap(dst[key])
+
+		if srcIsMap && dstIsMap {
+			dst[key] = deepMerge(dstMap, srcMap)
+			continue
+		}
+
+		if srcIsMap {
+			dst[key] = deepMerge(map[string]interface{}{}, srcMap)
+			continue
+		}
+
+		dst[key] = srcValue
+	}
+
+	return dst
+}
+
+func toStringMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		sm := map[string]interface{}{}
+		for key, value := range m {
+			sm[fmt.Sprintf("%v", key)] = value
+		}
+		return sm, true
+	}
+
+	return nil, false
+}
+
+func collectSecrets(v interface{}, secrets []string) []string {
+	m, ok := toStringMap(v)
+	if !ok {
+		return secrets
+	}
+
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := m[key]
+		if s, ok := value.(string); ok && secretKeyRegexp.MatchString(key) {
+			secrets = append(secrets, s)
+			continue
+		}
+
+		secrets = collectSecrets(value, secrets)
+	}
+
+	return secrets
+}
+
+func redactValue(v interface{}, secret bool) interface{} {
+	if m, ok := toStringMap(v); ok {
+		redacted := map[string]interface{}{}
+		for key, value := range m {
+			redacted[key] = redactValue(value, secret || secretKeyRegexp.MatchString(key))
+		}
+		return redacted
+	}
+
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		redacted := []interface{}{}
+		for _, item := range value {
+			redacted = append(redacted, redactValue(item, secret))
+		}
+		return redacted
+	case string:
+		if secret {
+			return RedactedPlaceholder
+		}
+		return redactSecretContent(value)
+	}
+
+	if secret {
+		return RedactedPlaceholder
+	}
+
+	return v
+}
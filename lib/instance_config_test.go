@@ -0,0 +1,162 @@
+package lib
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+var testInstanceConfigYML = `global:
+  log_level: info
+  queue: "builds.{{.Queue}}"
+  vms:
+    count: "{{.Count}}"
+    name: "{{.Site}}-{{.Env}}-{{.Count}}x"
+  literal: '{{"{{"}} not a template }}'
+  amqp:
+    password: "p{{ss"
+    credentials:
+      token: "{{.Queue}}"
+sites:
+  org:
+    papertrail_site: logs.example.com:12345
+envs:
+  staging:
+    log_level: debug
+  org.prod:
+    amqp: {host: amqp.example.com}
+queues:
+  docker:
+    vms: {provider: docker}
+  org.prod.docker:
+    vms: {count: 9}
+`
+
+func TestBuildInstanceSpecificYML(t *testing.T) {
+	for _, c := range []struct {
+		desc     string
+		site     string
+		env      string
+		queue    string
+		count    int
+		expected map[string]interface{}
+	}{
+		{
+			"site env and queue layers",
+			"org", "prod", "docker", 3,
+			map[string]interface{}{
+				"log_level":       "info",
+				"queue":           "builds.docker",
+				"papertrail_site": "logs.example.com:12345",
+				"literal":         "{{ not a template }}",
+				"vms": map[string]interface{}{
+					"count":    9,
+					"name":     "org-prod-3x",
+					"provider": "docker",
+				},
+				"amqp": map[string]interface{}{
+					"host":     "amqp.example.com",
+					"password": "p{{ss",
+					"credentials": map[string]interface{}{
+						"token": "{{.Queue}}",
+					},
+				},
+			},
+		},
+		{
+			"env layer and rendered count",
+			"org", "staging", "x\nlog_level: injected", 2,
+			map[string]interface{}{
+				"log_level":       "debug",
+				"queue":           "builds.x\nlog_level: injected",
+				"papertrail_site": "logs.example.com:12345",
+				"literal":         "{{ not a template }}",
+				"vms": map[string]interface{}{
+					"count": 2,
+					"name":  "org-staging-2x",
+				},
+				"amqp": map[string]interface{}{
+					"password": "p{{ss",
+					"credentials": map[string]interface{}{
+						"token": "{{.Queue}}",
+					},
+				},
+			},
+		},
+	} {
+		yml, err := BuildInstanceSpecificYML(c.site, c.env, testInstanceConfigYML, c.queue, c.count)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.desc, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(yml.Data, c.expected) {
+			t.Errorf("%s: expected:\n%#v\ngot:\n%#v", c.desc, c.expected, yml.Data)
+		}
+
+		if yml.PapertrailSite != "logs.example.com:12345" {
+			t.Errorf("%s: expected papertrail site, got %q", c.desc, yml.PapertrailSite)
+		}
+	}
+}
+
+func TestParseInstanceConfigErrors(t *testing.T) {
+	for _, c := range []struct {
+		desc   string
+		rawYML string
+	}{
+		{"original meta yml layout", "amqp:\n  org:\n    prod:\n      host: amqp.example.com\n"},
+		{"empty", ""},
+		{"unparseable template", "global:\n  queue: \"builds.{{.Queue\"\n"},
+		{"unknown field", "global:\n  queue: \"{{.Nope}}\"\n"},
+		{"invalid yml", "global: [\n"},
+	} {
+		_, err := ParseInstanceConfig(c.rawYML, &InstanceConfigContext{Site: "org", Env: "prod", Queue: "docker", Count: 1})
+		if err == nil {
+			t.Errorf("%s: expected an error", c.desc)
+		}
+	}
+}
+
+func TestExampleInstanceConfig(t *testing.T) {
+	raw, err := ioutil.ReadFile("../example-instance-config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, site := range []string{"org", "com"} {
+		for _, env := range []string{"staging", "prod"} {
+			yml, err := BuildInstanceSpecificYML(site, env, string(raw), "docker", 4)
+			if err != nil {
+				t.Errorf("%s/%s: unexpected error %v", site, env, err)
+				continue
+			}
+
+			linux, _ := toStringMap(yml.Data["linux"])
+			vms, _ := toStringMap(linux["vms"])
+			timeouts, _ := toStringMap(linux["timeouts"])
+
+			if linux["queue"] != "builds.docker" {
+				t.Errorf("%s/%s: expected queue builds.docker, got %v", site, env, linux["queue"])
+			}
+
+			if vms["count"] != 4 {
+				t.Errorf("%s/%s: expected vms count 4, got %v", site, env, vms["count"])
+			}
+
+			if timeouts["hard_limit"] != 7200 {
+				t.Errorf("%s/%s: expected hard limit 7200, got %v", site, env, timeouts["hard_limit"])
+			}
+
+			for _, key := range []string{"amqp", "build", "cache_options", "librato"} {
+				if _, ok := linux[key]; !ok {
+					t.Errorf("%s/%s: expected linux.%s", site, env, key)
+				}
+			}
+
+			if yml.PapertrailSite == "" {
+				t.Errorf("%s/%s: expected a papertrail site", site, env)
+			}
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package lib
+
+// InstanceConsolePayload is the representation used when enqueueing
+// the fetch of an instance's console output to the background
+// workers, where the output is also attached to the instance build
+// with InstanceBuildID, if given.  The fetch is retried since the
+// console output is only available a few minutes after boot.
+type InstanceConsolePayload struct {
+	InstanceID      string `json:"instance_id"`
+	InstanceBuildID string `json:"instance_build_id,omitempty"`
+	Retry           bool   `json:"retry,omitempty"`
+}
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"sort"
+	"time"
+)
+
+// InstanceEventsCollection is the representation used in jsonapi
+// bodies
+type InstanceEventsCollection struct {
+	InstanceEvents []*InstanceEvent `json:"instance_events"`
+}
+
+// InstanceEvent is a change to an instance found by the ec2 syncer,
+// where Type is one of "added", "removed", or "changed"
+type InstanceEvent struct {
+	Time       string                              `json:"time"`
+	Type       string                              `json:"type"`
+	InstanceID string                              `json:"instance_id"`
+	Instance   *Instance                           `json:"instance,omitempty"`
+	Changes    map[string]*InstanceAttributeChange `json:"changes,omitempty"`
+}
+
+// InstanceAttributeChange is the old and new value of a single
+// instance attribute, where an empty value means the attribute was
+// absent
+type InstanceAttributeChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// EC2SyncHistoryCollection is the representation used in jsonapi
+// bodies
+type EC2SyncHistoryCollection struct {
+	EC2SyncHistory []*EC2SyncHistoryEntry `json:"ec2_sync_history"`
+}
+
+// EC2SyncHistoryEntry records the instance events of a single ec2
+// sync along with the locations that were synced
+type EC2SyncHistoryEntry struct {
+	Time      string           `json:"time"`
+	Locations []string         `json:"locations"`
+	Added     int              `json:"added"`
+	Removed   int              `json:"removed"`
+	Changed   int              `json:"changed"`
+	Events    []*InstanceEvent `json:"events"`
+}
+
+// DiffInstances compares the previous and current instances, keyed by
+// instance id, returning an event for each instance added, removed, or
+// with changed attributes, sorted by instance id
+func DiffInstances(previous, current map[string]*Instance, now time.Time) []*InstanceEvent {
+	eventTime := now.UTC().Format(time.RFC3339)
+	events := []*InstanceEvent{}
+
+	for ID, inst := range current {
+		prev, ok := previous[ID]
+		if !ok {
+			events = append(events, &InstanceEvent{
+				Time:       eventTime,
+				Type:       "added",
+				InstanceID: ID,
+				Instance:   inst,
+			})
+			continue
+		}
+
+		changes := diffAttributes(prev.Attributes(), inst.Attributes())
+		if len(changes) > 0 {
+			events = append(events, &InstanceEvent{
+				Time:       eventTime,
+				Type:       "changed",
+				InstanceID: ID,
+				Changes:    changes,
+			})
+		}
+	}
+
+	for ID, prev := range previous {
+		if _, ok := current[ID]; !ok {
+			events = append(events, &InstanceEvent{
+				Time:       eventTime,
+				Type:       "removed",
+				InstanceID: ID,
+				Instance:   prev,
+			})
+		}
+	}
+
+	sort.Sort(instanceEventsByID(events))
+	return events
+}
+
+func diffAttributes(previous, current map[string]string) map[string]*InstanceAttributeChange {
+	changes := map[string]*InstanceAttributeChange{}
+	for key, value := range current {
+		if previous[key] != value {
+			changes[key] = &InstanceAttributeChange{Old: previous[key], New: value}
+		}
+	}
+
+	for key, value := range previous {
+		if _, ok := current[key]; !ok && value != "" {
+			changes[key] = &InstanceAttributeChange{Old: value}
+		}
+	}
+
+	return changes
+}
+
+type instanceEventsByID []*InstanceEvent
+
+func (e instanceEventsByID) Len() int           { return len(e) }
+func (e instanceEventsByID) Less(i, j int) bool { return e[i].InstanceID < e[j].InstanceID }
+func (e instanceEventsByID) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffInstances(t *testing.T) {
+	now := time.Date(2015, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	a := &Instance{InstanceID: "i-a", ImageID: "ami-1", IP: "10.0.0.1"}
+	b := &Instance{InstanceID: "i-b", ImageID: "ami-1"}
+	bRunning := &Instance{InstanceID: "i-b", ImageID: "ami-2", IP: "10.0.0.2"}
+	tagged := &Instance{InstanceID: "i-c", ImageID: "ami-1", Tags: map[string]string{"team": "blue"}}
+	retagged := &Instance{InstanceID: "i-c", ImageID: "ami-1", Tags: map[string]string{"owner": "ops"}}
+
+	for _, c := range []struct {
+		desc     string
+		previous map[string]*Instance
+		current  map[string]*Instance
+		expected []*InstanceEvent
+	}{
+		{
+			"empty",
+			map[string]*Instance{},
+			map[string]*Instance{},
+			[]*InstanceEvent{},
+		},
+		{
+			"unchanged",
+			map[string]*Instance{"i-a": a},
+			map[string]*Instance{"i-a": {InstanceID: "i-a", ImageID: "ami-1", IP: "10.0.0.1"}},
+			[]*InstanceEvent{},
+		},
+		{
+			"added and removed",
+			map[string]*Instance{"i-b": b},
+			map[string]*Instance{"i-a": a},
+			[]*InstanceEvent{
+				{Time: "2015-03-04T05:06:07Z", Type: "added", InstanceID: "i-a", Instance: a},
+				{Time: "2015-03-04T05:06:07Z", Type: "removed", InstanceID: "i-b", Instance: b},
+			},
+		},
+		{
+			"changed attributes",
+			map[string]*Instance{"i-a": a, "i-b": b},
+			map[string]*Instance{"i-a": a, "i-b": bRunning},
+			[]*InstanceEvent{
+				{
+					Time:       "2015-03-04T05:06:07Z",
+					Type:       "changed",
+					InstanceID: "i-b",
+					Changes: map[string]*InstanceAttributeChange{
+						"image_id": {Old: "ami-1", New: "ami-2"},
+						"ip":       {Old: "", New: "10.0.0.2"},
+					},
+				},
+			},
+		},
+		{
+			"changed tags",
+			map[string]*Instance{"i-c": tagged},
+			map[string]*Instance{"i-c": retagged},
+			[]*InstanceEvent{
+				{
+					Time:       "2015-03-04T05:06:07Z",
+					Type:       "changed",
+					InstanceID: "i-c",
+					Changes: map[string]*InstanceAttributeChange{
+						"tag:team":  {Old: "blue", New: ""},
+						"tag:owner": {Old: "", New: "ops"},
+					},
+				},
+			},
+		},
+		{
+			"sorted by instance id",
+			map[string]*Instance{"i-c": tagged},
+			map[string]*Instance{"i-b": b, "i-a": a},
+			[]*InstanceEvent{
+				{Time: "2015-03-04T05:06:07Z", Type: "added", InstanceID: "i-a", Instance: a},
+				{Time: "2015-03-04T05:06:07Z", Type: "added", InstanceID: "i-b", Instance: b},
+				{Time: "2015-03-04T05:06:07Z", Type: "removed", InstanceID: "i-c", Instance: tagged},
+			},
+		},
+	} {
+		actual := DiffInstances(c.previous, c.current, now)
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%s: expected %s, got %s", c.desc, describeInstanceEvents(c.expected), describeInstanceEvents(actual))
+		}
+	}
+}
+
+func describeInstanceEvents(events []*InstanceEvent) string {
+	s := "["
+	for _, e := range events {
+		s += " " + e.Type + ":" + e.InstanceID
+		for key, change := range e.Changes {
+			s += " " + key + "=" + change.Old + "->" + change.New
+		}
+	}
+	return s + " ]"
+}
@@ -0,0 +1,11 @@
+package lib
+
+// InstanceStateChangePayload is the representation used when
+// enqueueing an instance start or stop to the background workers,
+// where Action is one of "start" or "stop"
+type InstanceStateChangePayload struct {
+	InstanceID   string `json:"instance_id"`
+	Action       string `json:"action"`
+	SlackChannel string `json:"slack_channel"`
+	Requester    string `json:"requester,omitempty"`
+}
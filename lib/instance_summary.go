@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// InstanceSummaryGroupKeys are the instance attributes by which
+	// an instance summary may be grouped
+	InstanceSummaryGroupKeys = []string{"site", "env", "queue", "role", "instance_type", "image_id", "state"}
+
+	// InstanceAgeBuckets are the upper bounds of the age buckets in
+	// an instance summary, where older instances are counted as
+	// "older" and those without a valid launch time as "unknown"
+	InstanceAgeBuckets = []*InstanceAgeBucket{
+		&InstanceAgeBucket{Name: "1h", Max: time.Hour},
+		&InstanceAgeBucket{Name: "6h", Max: 6 * time.Hour},
+		&InstanceAgeBucket{Name: "1d", Max: 24 * time.Hour},
+		&InstanceAgeBucket{Name: "7d", Max: 7 * 24 * time.Hour},
+		&InstanceAgeBucket{Name: "30d", Max: 30 * 24 * time.Hour},
+	}
+)
+
+// InstanceAgeBucket is a named upper bound on instance age
+type InstanceAgeBucket struct {
+	Name string
+	Max  time.Duration
+}
+
+// InstanceSummaryCollectionSingular is the singular representation
+// used in jsonapi bodies
+type InstanceSummaryCollectionSingular struct {
+	InstanceSummary *InstanceSummary `json:"instance_summary"`
+}
+
+// InstanceSummary is the count and age distribution of instances,
+// overall and per group of the GroupBy keys
+type InstanceSummary struct {
+	GroupBy []string                `json:"group_by"`
+	Count   int                     `json:"count"`
+	Ages    map[string]int          `json:"ages,omitempty"`
+	Groups  []*InstanceSummaryGroup `json:"groups"`
+}
+
+// InstanceSummaryGroup is the count and age distribution of the
+// instances sharing the same values for each of the group keys
+type InstanceSummaryGroup struct {
+	Keys  map[string]string `json:"keys"`
+	Count int               `json:"count"`
+	Ages  map[string]int    `json:"ages,omitempty"`
+}
+
+// CheckInstanceSummaryGroupBy checks that all of the given keys are
+// among the InstanceSummaryGroupKeys
+func CheckInstanceSummaryGroupBy(groupBy []string) error {
+	for _, key := range groupBy {
+		if !containsString(InstanceSummaryGroupKeys, key) {
+			return fmt.Errorf("group_by must be among %s", strings.Join(InstanceSummaryGroupKeys, ", "))
+		}
+	}
+
+	return nil
+}
+
+// SummarizeInstances counts the instances grouped by the given keys,
+// which must be among the InstanceSummaryGroupKeys, and if withAges
+// is set, buckets each by its age as of now
+func SummarizeInstances(instances []*Instance, groupBy []string, withAges bool, now time.Time) (*InstanceSummary, error) {
+	err := CheckInstanceSummaryGroupBy(groupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &InstanceSummary{
+		GroupBy: groupBy,
+		Groups:  []*InstanceSummaryGroup{},
+	}
+	if withAges {
+		summary.Ages = map[string]int{}
+	}
+
+	groups := map[string]*InstanceSummaryGroup{}
+	for _, inst := range instances {
+		keys := map[string]string{}
+		values := []string{}
+		for _, key := range groupBy {
+			value := inst.summaryValue(key)
+			keys[key] = value
+			values = append(values, value)
+		}
+
+		groupKey := strings.Join(values, "\x00")
+		group, ok := groups[groupKey]
+		if !ok {
+			group = &InstanceSummaryGroup{Keys: keys}
+			if withAges {
+				group.Ages = map[string]int{}
+			}
+			groups[groupKey] = group
+		}
+
+		group.Count++
+		summary.Count++
+
+		if withAges {
+			age := inst.ageBucket(now)
+			group.Ages[age]++
+			summary.Ages[age]++
+		}
+	}
+
+	groupKeys := []string{}
+	for groupKey := range groups {
+		groupKeys = append(groupKeys, groupKey)
+	}
+	sort.Strings(groupKeys)
+
+	for _, groupKey := range groupKeys {
+		summary.Groups = append(summary.Groups, groups[groupKey])
+	}
+
+	return summary, nil
+}
+
+func (i *Instance) summaryValue(key string) string {
+	switch key {
+	case "site":
+		return i.Site
+	case "env":
+		return i.Env
+	case "queue":
+		return i.Queue
+	case "role":
+		return i.Role
+	case "instance_type":
+		return i.InstanceType
+	case "image_id":
+		return i.ImageID
+	case "state":
+		return i.State
+	}
+
+	return ""
+}
+
+func (i *Instance) ageBucket(now time.Time) string {
+	launchTime, err := time.Parse(time.RFC3339, i.LaunchTime)
+	if err != nil {
+		return "unknown"
+	}
+
+	age := now.Sub(launchTime)
+	for _, bucket := range InstanceAgeBuckets {
+		if age <= bucket.Max {
+			return bucket.Name
+		}
+	}
+
+	return "older"
+}
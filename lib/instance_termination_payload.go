@@ -5,4 +5,5 @@ package lib
 type InstanceTerminationPayload struct {
 	InstanceID   string `json:"instance_id"`
 	SlackChannel string `json:"slack_channel"`
+	Requester    string `json:"requester,omitempty"`
 }
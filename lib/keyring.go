@@ -0,0 +1,189 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	sealedPrefix  = "pudding-sealed:v1:"
+	dataKeyLength = 32
+)
+
+var (
+	errInvalidKeyring      = fmt.Errorf("keyring must be of the form id=base64key, where key is 16, 24, or 32 bytes")
+	errDuplicateKeyringKey = fmt.Errorf("keyring key ids must be unique")
+	errEmptyKeyring        = fmt.Errorf("keyring has no keys")
+	errMalformedSealed     = fmt.Errorf("malformed sealed value")
+)
+
+// Keyring holds the master keys used for envelope encryption of
+// secrets at rest.  The first key is the primary key with which new
+// values are sealed, and every key may be used to open values, which
+// allows for rotating in a new primary key while values sealed with
+// the old one are still around.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseKeyring parses a semicolon-delimited string of id=base64key
+// entries into a *Keyring, e.g. "2015-06=...;2015-01=..."
+func ParseKeyring(s string) (*Keyring, error) {
+	kr := &Keyring{keys: map[string]cipher.AEAD{}}
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.Contains(parts[0], ":") {
+			return nil, errInvalidKeyring
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, errInvalidKeyring
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, errInvalidKeyring
+		}
+
+		if _, ok := kr.keys[parts[0]]; ok {
+			return nil, errDuplicateKeyringKey
+		}
+
+		if kr.primary == "" {
+			kr.primary = parts[0]
+		}
+
+		kr.keys[parts[0]] = aead
+	}
+
+	return kr, nil
+}
+
+// Enabled reports whether the keyring has any keys with which to
+// seal values
+func (kr *Keyring) Enabled() bool {
+	return kr != nil && kr.primary != ""
+}
+
+// Seal encrypts the plaintext with a freshly generated data key,
+// which is itself encrypted with the primary key and stored
+// alongside the ciphertext
+func (kr *Keyring) Seal(plaintext []byte) (string, error) {
+	if !kr.Enabled() {
+		return "", errEmptyKeyring
+	}
+
+	dataKey := make([]byte, dataKeyLength)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := seal(kr.keys[kr.primary], dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := seal(dataAEAD, plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%s:%s:%s", sealedPrefix, kr.primary,
+		base64.StdEncoding.EncodeToString(wrappedKey),
+		base64.StdEncoding.EncodeToString(ciphertext)), nil
+}
+
+// Open decrypts a value produced by Seal with any key in the keyring
+func (kr *Keyring) Open(sealed string) ([]byte, error) {
+	if !IsSealed(sealed) {
+		return nil, errMalformedSealed
+	}
+
+	parts := strings.Split(strings.TrimPrefix(sealed, sealedPrefix), ":")
+	if len(parts) != 3 {
+		return nil, errMalformedSealed
+	}
+
+	var (
+		keyAEAD cipher.AEAD
+		ok      bool
+	)
+	if kr != nil {
+		keyAEAD, ok = kr.keys[parts[0]]
+	}
+	if !ok {
+		return nil, fmt.Errorf("no key with id %q in keyring", parts[0])
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errMalformedSealed
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedSealed
+	}
+
+	dataKey, err := open(keyAEAD, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(dataAEAD, ciphertext)
+}
+
+// IsSealed reports whether the given value was produced by Seal
+func IsSealed(s string) bool {
+	return strings.HasPrefix(s, sealedPrefix)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errMalformedSealed
+	}
+
+	nonceSize := aead.NonceSize()
+	return aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+}
@@ -0,0 +1,180 @@
+package lib
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+var (
+	testKeyA = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	testKeyB = base64.StdEncoding.EncodeToString([]byte("fedcba9876543210"))
+)
+
+func mustParseKeyring(t *testing.T, s string) *Keyring {
+	kr, err := ParseKeyring(s)
+	if err != nil {
+		t.Fatalf("failed to parse keyring %q: %v", s, err)
+	}
+
+	return kr
+}
+
+func TestParseKeyring(t *testing.T) {
+	for _, c := range []struct {
+		desc    string
+		s       string
+		enabled bool
+		err     error
+	}{
+		{"empty", "", false, nil},
+		{"single key", "a=" + testKeyA, true, nil},
+		{"two keys", "a=" + testKeyA + "; b=" + testKeyB, true, nil},
+		{"missing key", "a=", false, errInvalidKeyring},
+		{"missing id", "=" + testKeyA, false, errInvalidKeyring},
+		{"colon in id", "a:b=" + testKeyA, false, errInvalidKeyring},
+		{"bad base64", "a=not-base64!", false, errInvalidKeyring},
+		{"bad key length", "a=" + base64.StdEncoding.EncodeToString([]byte("short")), false, errInvalidKeyring},
+		{"duplicate id", "a=" + testKeyA + ";a=" + testKeyB, false, errDuplicateKeyringKey},
+	} {
+		kr, err := ParseKeyring(c.s)
+		if err != c.err {
+			t.Errorf("%s: expected error %v, got %v", c.desc, c.err, err)
+			continue
+		}
+
+		if err == nil && kr.Enabled() != c.enabled {
+			t.Errorf("%s: expected enabled %v, got %v", c.desc, c.enabled, kr.Enabled())
+		}
+	}
+}
+
+func TestKeyringSealOpen(t *testing.T) {
+	kr := mustParseKeyring(t, "a="+testKeyA+";b="+testKeyB)
+
+	for _, plaintext := range []string{"", "hello", strings.Repeat("#!/bin/bash\n", 1000)} {
+		sealed, err := kr.Seal([]byte(plaintext))
+		if err != nil {
+			t.Fatalf("failed to seal: %v", err)
+		}
+
+		if !IsSealed(sealed) {
+			t.Errorf("expected %q to be sealed", sealed)
+		}
+
+		if !strings.HasPrefix(sealed, sealedPrefix+"a:") {
+			t.Errorf("expected %q to be sealed with the primary key", sealed)
+		}
+
+		if plaintext != "" && strings.Contains(sealed, plaintext) {
+			t.Errorf("expected sealed value not to contain the plaintext")
+		}
+
+		opened, err := kr.Open(sealed)
+		if err != nil {
+			t.Fatalf("failed to open: %v", err)
+		}
+
+		if string(opened) != plaintext {
+			t.Errorf("expected %q, got %q", plaintext, string(opened))
+		}
+	}
+}
+
+func TestKeyringSealIsRandomized(t *testing.T) {
+	kr := mustParseKeyring(t, "a="+testKeyA)
+
+	first, err := kr.Seal([]byte("same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := kr.Seal([]byte("same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second {
+		t.Errorf("expected sealing the same plaintext twice to differ")
+	}
+}
+
+func TestKeyringSealWithoutKeys(t *testing.T) {
+	kr := mustParseKeyring(t, "")
+
+	_, err := kr.Seal([]byte("hello"))
+	if err != errEmptyKeyring {
+		t.Errorf("expected %v, got %v", errEmptyKeyring, err)
+	}
+}
+
+func TestKeyringOpenTampered(t *testing.T) {
+	kr := mustParseKeyring(t, "a="+testKeyA)
+
+	sealed, err := kr.Seal([]byte("secret init script"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(sealed, sealedPrefix), ":")
+
+	flip := func(b64 string) string {
+		b, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[len(b)-1] ^= 0x01
+		return base64.StdEncoding.EncodeToString(b)
+	}
+
+	for _, c := range []struct {
+		desc   string
+		sealed string
+	}{
+		{"tampered ciphertext", sealedPrefix + strings.Join([]string{parts[0], parts[1], flip(parts[2])}, ":")},
+		{"tampered wrapped key", sealedPrefix + strings.Join([]string{parts[0], flip(parts[1]), parts[2]}, ":")},
+		{"truncated ciphertext", sealedPrefix + strings.Join([]string{parts[0], parts[1], parts[2][:8]}, ":")},
+		{"unknown key id", sealedPrefix + strings.Join([]string{"z", parts[1], parts[2]}, ":")},
+		{"missing part", sealedPrefix + strings.Join([]string{parts[0], parts[1]}, ":")},
+		{"bad base64", sealedPrefix + strings.Join([]string{parts[0], "!!!", parts[2]}, ":")},
+		{"not sealed", "plain"},
+	} {
+		opened, err := kr.Open(c.sealed)
+		if err == nil {
+			t.Errorf("%s: expected an error, got %q", c.desc, string(opened))
+		}
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old := mustParseKeyring(t, "old="+testKeyB)
+	sealed, err := old.Seal([]byte("sealed before rotation"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := mustParseKeyring(t, "new="+testKeyA+";old="+testKeyB)
+
+	opened, err := rotated.Open(sealed)
+	if err != nil {
+		t.Fatalf("failed to open with non-primary key: %v", err)
+	}
+
+	if string(opened) != "sealed before rotation" {
+		t.Errorf("expected %q, got %q", "sealed before rotation", string(opened))
+	}
+
+	resealed, err := rotated.Seal(opened)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(resealed, sealedPrefix+"new:") {
+		t.Errorf("expected %q to be sealed with the new primary key", resealed)
+	}
+
+	_, err = old.Open(resealed)
+	if err == nil {
+		t.Errorf("expected the old keyring not to open values sealed with the new key")
+	}
+}
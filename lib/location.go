@@ -0,0 +1,18 @@
+package lib
+
+import "fmt"
+
+// Location is an aws region within either the default account or a
+// named account that is accessed by assuming an iam role
+type Location struct {
+	Region  string `json:"region"`
+	Account string `json:"account,omitempty"`
+}
+
+func (l *Location) String() string {
+	if l.Account == "" {
+		return l.Region
+	}
+
+	return fmt.Sprintf("%s/%s", l.Account, l.Region)
+}
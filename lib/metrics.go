@@ -0,0 +1,259 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	metricKindCounter   = "counter"
+	metricKindGauge     = "gauge"
+	metricKindHistogram = "histogram"
+)
+
+var (
+	// DefaultMetricBuckets are the histogram buckets, in seconds, used
+	// for all durations, ranging from a quick http request to a slow
+	// spot request
+	DefaultMetricBuckets = []float64{
+		0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5,
+		1, 2.5, 5, 10, 30, 60, 120, 300, 600,
+	}
+
+	metricHelp = map[string]string{
+		"pudding_http_requests_total":                  "Count of http requests by route name, method, and status code.",
+		"pudding_http_request_duration_seconds":        "Duration of http requests by route name.",
+		"pudding_instance_builds_total":                "Count of instance builds by outcome.",
+		"pudding_instance_build_failures_total":        "Count of failed instance builds by the step that failed.",
+		"pudding_instance_build_duration_seconds":      "Duration of instance builds by outcome.",
+		"pudding_instance_build_step_duration_seconds": "Duration of each instance build step.",
+		"pudding_instance_boot_timeouts_total":         "Count of instance builds whose instance did not finish booting within the boot deadline.",
+		"pudding_instance_terminations_total":          "Count of instance terminations by outcome.",
+		"pudding_instance_state_changes_total":         "Count of instance starts and stops by action and outcome.",
+		"pudding_ec2_sync_duration_seconds":            "Duration of the ec2 sync.",
+		"pudding_instance_events_total":                "Count of instances added, removed, or changed as found by the ec2 sync.",
+		"pudding_instances":                            "Number of instances by site, env, queue, role, and state as of the last ec2 sync.",
+		"pudding_images":                               "Number of images by role and active state as of the last ec2 sync.",
+		"pudding_queue_depth":                          "Number of jobs waiting in each queue.",
+	}
+
+	metricValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// Metrics is a registry of counters, gauges, and histograms keyed by
+// name and labels, which may be rendered in the prometheus text
+// exposition format
+type Metrics struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels  string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+// NewMetrics creates a *Metrics with help text for all metrics
+// recorded by the server and workers
+func NewMetrics() *Metrics {
+	m := &Metrics{families: map[string]*metricFamily{}}
+	for name, help := range metricHelp {
+		m.Describe(name, help)
+	}
+
+	return m
+}
+
+// Describe sets the help text shown for the named metric
+func (m *Metrics) Describe(name, help string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if fam, ok := m.families[name]; ok {
+		fam.help = help
+		return
+	}
+
+	m.families[name] = &metricFamily{name: name, help: help, series: map[string]*metricSeries{}}
+}
+
+// Inc adds one to the named counter
+func (m *Metrics) Inc(name string, labels map[string]string) {
+	m.Add(name, labels, 1)
+}
+
+// Add adds the value to the named counter
+func (m *Metrics) Add(name string, labels map[string]string, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.series(name, metricKindCounter, labels).value += value
+}
+
+// Set sets the named gauge to the value
+func (m *Metrics) Set(name string, labels map[string]string, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.series(name, metricKindGauge, labels).value = value
+}
+
+// Reset removes all series of the named metric, such as before
+// setting a gauge for every label combination seen in a sync
+func (m *Metrics) Reset(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if fam, ok := m.families[name]; ok {
+		fam.series = map[string]*metricSeries{}
+	}
+}
+
+// Observe records the value in the named histogram
+func (m *Metrics) Observe(name string, labels map[string]string, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s := m.series(name, metricKindHistogram, labels)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(DefaultMetricBuckets))
+	}
+
+	for i, le := range DefaultMetricBuckets {
+		if value <= le {
+			s.buckets[i]++
+		}
+	}
+
+	s.value += value
+	s.count++
+}
+
+// WriteTo writes all metrics, sorted by name and labels, in the
+// prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	names := []string{}
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fam := m.families[name]
+		if fam.kind == "" {
+			continue
+		}
+
+		if fam.help != "" {
+			fmt.Fprintf(&buf, "# HELP %s %s\n", name, fam.help)
+		}
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, fam.kind)
+
+		keys := []string{}
+		for key := range fam.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := fam.series[key]
+			if fam.kind != metricKindHistogram {
+				fmt.Fprintf(&buf, "%s%s %s\n", name, braceLabels(s.labels), formatMetricValue(s.value))
+				continue
+			}
+
+			for i, le := range DefaultMetricBuckets {
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", name,
+					braceLabels(joinLabels(s.labels, fmt.Sprintf(`le="%s"`, formatMetricValue(le)))), s.buckets[i])
+			}
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", name, braceLabels(joinLabels(s.labels, `le="+Inf"`)), s.count)
+			fmt.Fprintf(&buf, "%s_sum%s %s\n", name, braceLabels(s.labels), formatMetricValue(s.value))
+			fmt.Fprintf(&buf, "%s_count%s %d\n", name, braceLabels(s.labels), s.count)
+		}
+	}
+
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP responds with all metrics in the prometheus text
+// exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	m.WriteTo(w)
+}
+
+func (m *Metrics) series(name, kind string, labels map[string]string) *metricSeries {
+	fam, ok := m.families[name]
+	if !ok {
+		fam = &metricFamily{name: name, series: map[string]*metricSeries{}}
+		m.families[name] = fam
+	}
+
+	if fam.kind == "" {
+		fam.kind = kind
+	}
+
+	key := formatLabels(labels)
+	s, ok := fam.series[key]
+	if !ok {
+		s = &metricSeries{labels: key}
+		fam.series[key] = s
+	}
+
+	return s
+}
+
+func formatLabels(labels map[string]string) string {
+	keys := []string{}
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, key, metricValueEscaper.Replace(labels[key])))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+
+	return labels + "," + extra
+}
+
+func braceLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+
+	return "{" + labels + "}"
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
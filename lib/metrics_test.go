@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := NewMetrics()
+
+	m.Inc("pudding_instance_builds_total", map[string]string{"outcome": "finished"})
+	m.Add("pudding_instance_builds_total", map[string]string{"outcome": "finished"}, 2)
+	m.Inc("pudding_instance_builds_total", map[string]string{"outcome": "failed"})
+	m.Set("pudding_queue_depth", map[string]string{"queue": "instance-builds"}, 4)
+	m.Set("pudding_queue_depth", map[string]string{"queue": "instance-builds"}, 1.5)
+	m.Set("pudding_instances", map[string]string{"site": "org", "role": "work\"er\\\n", "env": "prod"}, 2)
+	m.Observe("pudding_ec2_sync_duration_seconds", nil, 0.25)
+	m.Observe("pudding_ec2_sync_duration_seconds", nil, 7)
+	m.Inc("undescribed_total", nil)
+
+	expected := `# HELP pudding_ec2_sync_duration_seconds Duration of the ec2 sync.
+# TYPE pudding_ec2_sync_duration_seconds histogram
+pudding_ec2_sync_duration_seconds_bucket{le="0.005"} 0
+pudding_ec2_sync_duration_seconds_bucket{le="0.01"} 0
+pudding_ec2_sync_duration_seconds_bucket{le="0.025"} 0
+pudding_ec2_sync_duration_seconds_bucket{le="0.05"} 0
+pudding_ec2_sync_duration_seconds_bucket{le="0.1"} 0
+pudding_ec2_sync_duration_seconds_bucket{le="0.25"} 1
+pudding_ec2_sync_duration_seconds_bucket{le="0.5"} 1
+pudding_ec2_sync_duration_seconds_bucket{le="1"} 1
+pudding_ec2_sync_duration_seconds_bucket{le="2.5"} 1
+pudding_ec2_sync_duration_seconds_bucket{le="5"} 1
+pudding_ec2_sync_duration_seconds_bucket{le="10"} 2
+pudding_ec2_sync_duration_seconds_bucket{le="30"} 2
+pudding_ec2_sync_duration_seconds_bucket{le="60"} 2
+pudding_ec2_sync_duration_seconds_bucket{le="120"} 2
+pudding_ec2_sync_duration_seconds_bucket{le="300"} 2
+pudding_ec2_sync_duration_seconds_bucket{le="600"} 2
+pudding_ec2_sync_duration_seconds_bucket{le="+Inf"} 2
+pudding_ec2_sync_duration_seconds_sum 7.25
+pudding_ec2_sync_duration_seconds_count 2
+# HELP pudding_instance_builds_total Count of instance builds by outcome.
+# TYPE pudding_instance_builds_total counter
+pudding_instance_builds_total{outcome="failed"} 1
+pudding_instance_builds_total{outcome="finished"} 3
+# HELP pudding_instances Number of instances by site, env, queue, role, and state as of the last ec2 sync.
+# TYPE pudding_instances gauge
+pudding_instances{env="prod",role="work\"er\\\n",site="org"} 2
+# HELP pudding_queue_depth Number of jobs waiting in each queue.
+# TYPE pudding_queue_depth gauge
+pudding_queue_depth{queue="instance-builds"} 1.5
+# TYPE undescribed_total counter
+undescribed_total 1
+`
+
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	if n != int64(len(expected)) {
+		t.Errorf("expected %d bytes written, got %d", len(expected), n)
+	}
+}
+
+func TestMetricsReset(t *testing.T) {
+	m := NewMetrics()
+	m.Set("pudding_images", map[string]string{"role": "worker", "active": "true"}, 3)
+	m.Reset("pudding_images")
+	m.Set("pudding_images", map[string]string{"role": "web", "active": "false"}, 1)
+
+	expected := `# HELP pudding_images Number of images by role and active state as of the last ec2 sync.
+# TYPE pudding_images gauge
+pudding_images{active="false",role="web"} 1
+`
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
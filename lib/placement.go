@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+)
+
+var (
+	errPlacementListConflict = fmt.Errorf("\"subnet_ids\" and \"availability_zones\" may not both be given")
+)
+
+// Placement is a subnet or availability zone in which an instance
+// may be launched
+type Placement struct {
+	SubnetID         string `json:"subnet_id,omitempty"`
+	AvailabilityZone string `json:"availability_zone,omitempty"`
+}
+
+func (p *Placement) String() string {
+	if p.SubnetID != "" {
+		return p.SubnetID
+	}
+	if p.AvailabilityZone != "" {
+		return p.AvailabilityZone
+	}
+	return "default"
+}
+
+// Placements returns the placements to try in priority order, which
+// are the SubnetID followed by the SubnetIDs, or else the
+// AvailabilityZone followed by the AvailabilityZones, or else the
+// single placement given by SubnetID and AvailabilityZone
+func (b *InstanceBuild) Placements() []*Placement {
+	placements := []*Placement{}
+	switch {
+	case len(b.SubnetIDs) > 0:
+		for _, subnetID := range prependUnique(b.SubnetID, b.SubnetIDs) {
+			placements = append(placements, &Placement{SubnetID: subnetID})
+		}
+	case len(b.AvailabilityZones) > 0:
+		for _, az := range prependUnique(b.AvailabilityZone, b.AvailabilityZones) {
+			placements = append(placements, &Placement{AvailabilityZone: az})
+		}
+	default:
+		placements = append(placements, &Placement{
+			SubnetID:         b.SubnetID,
+			AvailabilityZone: b.AvailabilityZone,
+		})
+	}
+
+	return placements
+}
+
+// InstanceTypeCandidates returns the instance types to try in
+// priority order, which are the InstanceType followed by the
+// InstanceTypes
+func (b *InstanceBuild) InstanceTypeCandidates() []string {
+	return prependUnique(b.InstanceType, b.InstanceTypes)
+}
+
+// SpreadPlacements orders the placements by the number of instances
+// already running in each, given as counts by subnet id and by
+// availability zone, keeping the priority order among placements with
+// equal counts
+func SpreadPlacements(placements []*Placement, subnetCounts, azCounts map[string]int) []*Placement {
+	spread := placementsByCount{p: append([]*Placement{}, placements...), c: []int{}}
+	for _, p := range spread.p {
+		if p.SubnetID != "" {
+			spread.c = append(spread.c, subnetCounts[p.SubnetID])
+			continue
+		}
+		spread.c = append(spread.c, azCounts[p.AvailabilityZone])
+	}
+
+	sort.Stable(spread)
+	return spread.p
+}
+
+type placementsByCount struct {
+	p []*Placement
+	c []int
+}
+
+func (s placementsByCount) Len() int           { return len(s.p) }
+func (s placementsByCount) Less(i, j int) bool { return s.c[i] < s.c[j] }
+func (s placementsByCount) Swap(i, j int) {
+	s.p[i], s.p[j] = s.p[j], s.p[i]
+	s.c[i], s.c[j] = s.c[j], s.c[i]
+}
+
+func prependUnique(first string, rest []string) []string {
+	values := []string{}
+	seen := map[string]bool{}
+	for _, value := range append([]string{first}, rest...) {
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		values = append(values, value)
+	}
+
+	return values
+}
@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"fmt"
+
+	"github.com/gorilla/feeds"
+)
+
+var (
+	errInvalidBatchSize    = fmt.Errorf("batch_size must be more than 0")
+	errInvalidBootTimeout  = fmt.Errorf("boot_timeout must not be negative")
+	errInvalidRolloutState = fmt.Errorf("state must be pending, running, paused, finished, or cancelled")
+)
+
+// RolloutsCollectionSingular is the singular representation used
+// in jsonapi bodies
+type RolloutsCollectionSingular struct {
+	Rollouts *Rollout `json:"rollouts"`
+}
+
+// RolloutsCollection is the collection representation used in
+// jsonapi bodies
+type RolloutsCollection struct {
+	Rollouts []*Rollout `json:"rollouts"`
+}
+
+// Rollout describes the replacement of all instances for a given
+// site, env, and queue that are not running the target AMI, done in
+// batches of BatchSize instances at a time
+type Rollout struct {
+	ID             string `json:"id,omitempty" redis:"id"`
+	Site           string `json:"site" redis:"site"`
+	Env            string `json:"env" redis:"env"`
+	Queue          string `json:"queue" redis:"queue"`
+	Role           string `json:"role,omitempty" redis:"role"`
+	AMI            string `json:"ami,omitempty" redis:"ami"`
+	InstanceType   string `json:"instance_type,omitempty" redis:"instance_type"`
+	Region         string `json:"region,omitempty" redis:"region"`
+	Account        string `json:"account,omitempty" redis:"account"`
+	BatchSize      int    `json:"batch_size" redis:"batch_size"`
+	BootTimeout    int    `json:"boot_timeout,omitempty" redis:"boot_timeout"`
+	SlackChannel   string `json:"slack_channel" redis:"slack_channel"`
+	State          string `json:"state,omitempty" redis:"state"`
+	Reason         string `json:"reason,omitempty" redis:"reason"`
+	Total          int    `json:"total" redis:"total"`
+	Replaced       int    `json:"replaced" redis:"replaced"`
+	InFlight       int    `json:"in_flight" redis:"in_flight"`
+	CreatedAt      string `json:"created_at,omitempty" redis:"created_at"`
+	BatchStartedAt string `json:"batch_started_at,omitempty" redis:"batch_started_at"`
+	HREF           string `json:"href,omitempty" redis:"-"`
+}
+
+// NewRollout creates a new *Rollout, along with generating a unique
+// ID and setting the State to "pending"
+func NewRollout() *Rollout {
+	return &Rollout{
+		ID:          feeds.NewUUID().String(),
+		State:       "pending",
+		BatchSize:   1,
+		BootTimeout: 1200,
+	}
+}
+
+// Validate performs multiple validity checks against the given
+// *Topology (or the default topology if nil) and returns a slice of
+// all errors found
+func (r *Rollout) Validate(topo *Topology) []error {
+	if topo == nil {
+		topo = DefaultTopology()
+	}
+
+	errors := []error{}
+	if r.Site == "" {
+		errors = append(errors, errEmptySite)
+	}
+	if r.Env == "" {
+		errors = append(errors, errEmptyEnv)
+	}
+	errors = append(errors, topo.Validate(r.Site, r.Env, r.Role)...)
+	errors = append(errors, topo.ValidateLocation(r.Region, r.Account)...)
+	if r.Queue == "" {
+		errors = append(errors, errEmptyQueue)
+	}
+	if r.BatchSize < 1 {
+		errors = append(errors, errInvalidBatchSize)
+	}
+	if r.BootTimeout < 0 {
+		errors = append(errors, errInvalidBootTimeout)
+	}
+	if !r.HasValidState() {
+		errors = append(errors, errInvalidRolloutState)
+	}
+
+	return errors
+}
+
+// HasValidState checks if the State is one of the known rollout
+// states
+func (r *Rollout) HasValidState() bool {
+	switch r.State {
+	case "pending", "running", "paused", "finished", "cancelled":
+		return true
+	}
+	return false
+}
+
+// IsActive is true when the rollout still needs to be advanced by
+// the background workers
+func (r *Rollout) IsActive() bool {
+	return r.State == "pending" || r.State == "running"
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/feeds"
 	"github.com/gorilla/mux"
+	"github.com/travis-ci/pudding/lib"
 	"github.com/travis-ci/pudding/lib/db"
 )
 
@@ -29,7 +30,7 @@ type serverAuther struct {
 	rt       string
 }
 
-func newServerAuther(token, redisURL string, log *logrus.Logger) (*serverAuther, error) {
+func newServerAuther(token, redisURL string, kr *lib.Keyring, log *logrus.Logger) (*serverAuther, error) {
 	sa := &serverAuther{
 		Token:    token,
 		redisURL: redisURL,
@@ -37,7 +38,7 @@ func newServerAuther(token, redisURL string, log *logrus.Logger) (*serverAuther,
 		rt:       feeds.NewUUID().String(),
 	}
 
-	is, err := db.NewInitScripts(redisURL, log)
+	is, err := db.NewInitScripts(redisURL, kr, log)
 	if err != nil {
 		return nil, err
 	}
@@ -63,7 +64,6 @@ func (sa *serverAuther) Authenticate(w http.ResponseWriter, req *http.Request) b
 	}
 
 	authHeader := req.Header.Get("Authorization")
-	sa.log.WithField("authorization", authHeader).Debug("raw authorization header")
 
 	if authHeader != "" && (sa.hasValidTokenAuth(authHeader) || sa.hasValidInstanceBuildBasicAuth(authHeader, instanceBuildID)) {
 		req.Header.Set(internalAuthHeader, sa.rt)
@@ -115,9 +115,6 @@ func (sa *serverAuther) hasValidInstanceBuildBasicAuth(authHeader, instanceBuild
 		return false
 	}
 
-	sa.log.WithFields(logrus.Fields{
-		"basic_auth":        authParts[1],
-		"instance_build_id": instanceBuildID,
-	}).Debug("checking basic auth against database")
+	sa.log.WithField("instance_build_id", instanceBuildID).Debug("checking basic auth against database")
 	return sa.is.HasValidAuth(instanceBuildID, authParts[1])
 }
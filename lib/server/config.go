@@ -6,7 +6,8 @@ type Config struct {
 	AuthToken string
 	Debug     bool
 
-	RedisURL string
+	RedisURL  string
+	AWSRegion string
 
 	SlackHookPath       string
 	SlackUsername       string
@@ -15,8 +16,23 @@ type Config struct {
 
 	SentryDSN string
 
-	InstanceExpiry int
-	ImageExpiry    int
+	InstanceExpiry      int
+	ImageExpiry         int
+	InstanceBuildExpiry int
+	HistoryExpiry       int
+
+	ImageSelectors string
+	InitScriptKeys string
+	Topology       string
+	TagPolicy      string
+
+	InitScriptSourceBinding bool
+	TrustedProxies          string
+	PreviewUnredactToken    string
+
+	InstanceRSA        string
+	InstanceYML        string
+	InitScriptTemplate string
 
 	QueueNames map[string]string
 }
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding/lib/db"
+)
+
+type imageUpdater struct {
+	QueueName string
+	r         *redis.Pool
+}
+
+func newImageUpdater(redisURL, queueName string) (*imageUpdater, error) {
+	r, err := db.BuildRedisPool(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &imageUpdater{
+		QueueName: queueName,
+
+		r: r,
+	}, nil
+}
+
+func (iu *imageUpdater) Update(imageID string, active bool, slackChannel string) error {
+	conn := iu.r.Get()
+	defer conn.Close()
+
+	return db.EnqueueImageUpdate(conn, iu.QueueName, imageID, active, slackChannel)
+}
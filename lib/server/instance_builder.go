@@ -1,9 +1,6 @@
 package server
 
 import (
-	"encoding/json"
-	"time"
-
 	"github.com/garyburd/redigo/redis"
 	"github.com/travis-ci/pudding/lib"
 	"github.com/travis-ci/pudding/lib/db"
@@ -11,10 +8,11 @@ import (
 
 type instanceBuilder struct {
 	QueueName string
+	Expiry    int
 	r         *redis.Pool
 }
 
-func newInstanceBuilder(redisURL, queueName string) (*instanceBuilder, error) {
+func newInstanceBuilder(redisURL, queueName string, expiry int) (*instanceBuilder, error) {
 	r, err := db.BuildRedisPool(redisURL)
 	if err != nil {
 		return nil, err
@@ -22,6 +20,7 @@ func newInstanceBuilder(redisURL, queueName string) (*instanceBuilder, error) {
 
 	return &instanceBuilder{
 		QueueName: queueName,
+		Expiry:    expiry,
 
 		r: r,
 	}, nil
@@ -31,20 +30,12 @@ func (ib *instanceBuilder) Build(b *lib.InstanceBuild) (*lib.InstanceBuild, erro
 	conn := ib.r.Get()
 	defer conn.Close()
 
-	buildPayload := &lib.InstanceBuildPayload{
-		Args:       []*lib.InstanceBuild{b},
-		Queue:      ib.QueueName,
-		JID:        b.ID,
-		Retry:      true,
-		EnqueuedAt: float64(time.Now().UTC().Unix()),
-	}
-
-	buildPayloadJSON, err := json.Marshal(buildPayload)
+	err := db.StoreInstanceBuild(conn, b, ib.Expiry)
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.EnqueueJob(conn, ib.QueueName, string(buildPayloadJSON))
+	err = db.EnqueueInstanceBuild(conn, ib.QueueName, b)
 	return b, err
 }
 
@@ -70,5 +61,6 @@ func (ib *instanceBuilder) Wipe(ID string) error {
 		return err
 	}
 
-	return nil
+	_, err = conn.Do("EXEC")
+	return err
 }
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding/lib/db"
+)
+
+type instanceConsoleFetcher struct {
+	QueueName string
+	r         *redis.Pool
+}
+
+func newInstanceConsoleFetcher(redisURL, queueName string) (*instanceConsoleFetcher, error) {
+	r, err := db.BuildRedisPool(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &instanceConsoleFetcher{
+		QueueName: queueName,
+
+		r: r,
+	}, nil
+}
+
+func (icf *instanceConsoleFetcher) Fetch(instanceID, instanceBuildID string) error {
+	conn := icf.r.Get()
+	defer conn.Close()
+
+	return db.EnqueueInstanceConsole(conn, icf.QueueName, instanceID, instanceBuildID)
+}
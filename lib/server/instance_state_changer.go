@@ -0,0 +1,31 @@
+package server
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding/lib/db"
+)
+
+type instanceStateChanger struct {
+	QueueName string
+	r         *redis.Pool
+}
+
+func newInstanceStateChanger(redisURL, queueName string) (*instanceStateChanger, error) {
+	r, err := db.BuildRedisPool(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &instanceStateChanger{
+		QueueName: queueName,
+
+		r: r,
+	}, nil
+}
+
+func (isc *instanceStateChanger) Change(instanceID, action, slackChannel, requester string) error {
+	conn := isc.r.Get()
+	defer conn.Close()
+
+	return db.EnqueueInstanceStateChange(conn, isc.QueueName, instanceID, action, slackChannel, requester)
+}
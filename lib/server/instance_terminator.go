@@ -1,10 +1,7 @@
 package server
 
 import (
-	"encoding/json"
-
 	"github.com/garyburd/redigo/redis"
-	"github.com/travis-ci/pudding/lib"
 	"github.com/travis-ci/pudding/lib/db"
 )
 
@@ -26,19 +23,9 @@ func newInstanceTerminator(redisURL, queueName string) (*instanceTerminator, err
 	}, nil
 }
 
-func (it *instanceTerminator) Terminate(instanceID, slackChannel string) error {
+func (it *instanceTerminator) Terminate(instanceID, slackChannel, requester string) error {
 	conn := it.r.Get()
 	defer conn.Close()
 
-	buildPayload := &lib.InstanceTerminationPayload{
-		InstanceID:   instanceID,
-		SlackChannel: slackChannel,
-	}
-
-	buildPayloadJSON, err := json.Marshal(buildPayload)
-	if err != nil {
-		return err
-	}
-
-	return db.EnqueueJob(conn, it.QueueName, string(buildPayloadJSON))
+	return db.EnqueueInstanceTermination(conn, it.QueueName, instanceID, slackChannel, requester)
 }
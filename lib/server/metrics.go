@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+	"github.com/travis-ci/pudding/lib/db"
+)
+
+// measureRequest records the count and duration of each request by
+// the name of the matching route
+func (srv *server) measureRequest(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	route := "unmatched"
+	match := &mux.RouteMatch{}
+	if srv.r.Match(req, match) && match.Route.GetName() != "" {
+		route = match.Route.GetName()
+	}
+
+	start := time.Now()
+
+	defer func() {
+		code := "500"
+		p := recover()
+		if nw, ok := w.(negroni.ResponseWriter); ok && p == nil && nw.Status() != 0 {
+			code = strconv.Itoa(nw.Status())
+		}
+
+		srv.metrics.Inc("pudding_http_requests_total", map[string]string{
+			"route":  route,
+			"method": req.Method,
+			"code":   code,
+		})
+		srv.metrics.Observe("pudding_http_request_duration_seconds", map[string]string{
+			"route": route,
+		}, time.Since(start).Seconds())
+
+		if p != nil {
+			panic(p)
+		}
+	}()
+
+	next(w, req)
+}
+
+func (srv *server) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	conn := srv.rp.Get()
+	defer conn.Close()
+
+	depths, err := db.FetchQueueDepths(conn, srv.queueNames)
+	if err != nil {
+		srv.log.WithField("err", err).Error("failed to fetch queue depths")
+	}
+
+	for queueName, depth := range depths {
+		srv.metrics.Set("pudding_queue_depth", map[string]string{"queue": queueName}, float64(depth))
+	}
+
+	srv.metrics.ServeHTTP(w, req)
+}
@@ -1,13 +1,22 @@
 package server
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/braintree/manners"
 	"github.com/codegangsta/negroni"
+	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/feeds"
 	"github.com/gorilla/mux"
 	"github.com/meatballhat/expvarplus"
@@ -22,6 +31,25 @@ import (
 var (
 	errMissingInstanceBuildID = fmt.Errorf("missing instance build id")
 	errMissingInstanceID      = fmt.Errorf("missing instance id")
+	errInstanceBuildNotFound  = fmt.Errorf("instance build not found")
+	errUnknownInstance        = fmt.Errorf("unknown instance")
+	errInstanceNotStopped     = fmt.Errorf("instance must be stopped to start")
+	errInstanceNotRunning     = fmt.Errorf("instance must be running to stop")
+	errInvalidInstanceState   = fmt.Errorf("state must be one of %s, or terminated", strings.Join(lib.InstanceStates, ", "))
+	errMissingImageID         = fmt.Errorf("missing image id")
+	errInvalidImageActive     = fmt.Errorf("active must be true or false")
+	errUnknownImage           = fmt.Errorf("unknown image")
+	errMissingRolloutID       = fmt.Errorf("missing rollout id")
+	errRolloutNotFound        = fmt.Errorf("rollout not found")
+	errRolloutBusy            = fmt.Errorf("rollout is being advanced, try again")
+	errInvalidRolloutUpdate   = fmt.Errorf("state may only be changed to running, paused, or cancelled")
+	errRolloutNotUpdatable    = fmt.Errorf("rollout is already finished or cancelled")
+	errInitScriptSource       = fmt.Errorf("init script may only be fetched by the instance it was built for")
+	errUnredactedPreview      = fmt.Errorf("redact=false requires a valid X-Pudding-Unredact-Token header")
+	errMissingTemplateName    = fmt.Errorf("missing init script template name")
+	errTemplateNotFound       = fmt.Errorf("init script template not found")
+	errInvalidTemplateVersion = fmt.Errorf("version must be a positive integer")
+	errInvalidLimit           = fmt.Errorf("limit must be a positive integer")
 	errKaboom                 = fmt.Errorf("simulated kaboom ʕノ•ᴥ•ʔノ ︵ ┻━┻")
 )
 
@@ -36,33 +64,73 @@ func init() {
 		"REVISION",
 		"VERSION",
 
+		"PUDDING_BOOT_DEADLINE",
+		"PUDDING_BOOT_DEADLINE_TERMINATE",
 		"PUDDING_DEFAULT_SLACK_CHANNEL",
+		"PUDDING_HISTORY_EXPIRY",
+		"PUDDING_IMAGE_CLEANUP_DRY_RUN",
+		"PUDDING_IMAGE_CLEANUP_INTERVAL",
+		"PUDDING_IMAGE_RETENTION",
+		"PUDDING_IMAGE_SELECTORS",
+		"PUDDING_IMAGE_UPDATES_QUEUE_NAME",
+		"PUDDING_INIT_SCRIPT_SOURCE_BINDING",
 		"PUDDING_INIT_SCRIPT_TEMPLATE",
+		"PUDDING_INSTANCE_BUILD_EXPIRY",
 		"PUDDING_INSTANCE_BUILDS_QUEUE_NAME",
+		"PUDDING_INSTANCE_CONSOLES_QUEUE_NAME",
 		"PUDDING_INSTANCE_EXPIRY",
 		"PUDDING_INSTANCE_RSA",
+		"PUDDING_INSTANCE_STATE_CHANGES_QUEUE_NAME",
 		"PUDDING_INSTANCE_TERMINATIONS_QUEUE_NAME",
 		"PUDDING_INSTANCE_YML",
+		"PUDDING_METRICS_ADDR",
 		"PUDDING_MINI_WORKER_INTERVAL",
 		"PUDDING_PROCESS_ID",
 		"PUDDING_REDIS_POOL_SIZE",
 		"PUDDING_REDIS_URL",
 		"PUDDING_SENTRY_DSN",
+		"PUDDING_SPOT_FULFILLMENT_TIMEOUT",
+		"PUDDING_SPOT_INTERRUPTION_REPLACEMENT",
 		"PUDDING_SLACK_TEAM",
+		"PUDDING_TAG_POLICY",
 		"PUDDING_TEMPORARY_INIT_EXPIRY",
+		"PUDDING_TOPOLOGY",
+		"PUDDING_TRUSTED_PROXIES",
 		"PUDDING_WEB_HOSTNAME")
 }
 
 type server struct {
 	addr, authToken, slackHookPath, slackUsername, slackIcon, slackChannel, sentryDSN string
 
+	imageSelectors map[string]*lib.ImageSelector
+	topology       *lib.Topology
+	tagPolicy      *lib.TagPolicy
+	metrics        *lib.Metrics
+	queueNames     []string
+
+	initScriptSourceBinding bool
+	trustedProxies          []*net.IPNet
+	previewUnredactToken    string
+
+	instanceRSA, instanceYML string
+	initScriptTemplate       *template.Template
+
 	log        *logrus.Logger
 	builder    *instanceBuilder
 	terminator *instanceTerminator
+	changer    *instanceStateChanger
+	consoles   *instanceConsoleFetcher
+	updater    *imageUpdater
 	auther     *serverAuther
 	is         db.InitScriptGetterAuther
 	i          db.InstanceFetcherStorer
 	img        db.ImageFetcherStorer
+	ip         db.ImagePinFetcherStorer
+	ib         db.InstanceBuildGetterStorer
+	h          db.HistoryFetcherStorer
+	ist        db.InitScriptTemplateFetcherStorer
+	ro         *db.Rollouts
+	rp         *redis.Pool
 
 	n *negroni.Negroni
 	r *mux.Router
@@ -75,7 +143,7 @@ func newServer(cfg *Config) (*server, error) {
 		log.Level = logrus.DebugLevel
 	}
 
-	builder, err := newInstanceBuilder(cfg.RedisURL, cfg.QueueNames["instance-builds"])
+	builder, err := newInstanceBuilder(cfg.RedisURL, cfg.QueueNames["instance-builds"], cfg.InstanceBuildExpiry)
 	if err != nil {
 		return nil, err
 	}
@@ -85,6 +153,21 @@ func newServer(cfg *Config) (*server, error) {
 		return nil, err
 	}
 
+	changer, err := newInstanceStateChanger(cfg.RedisURL, cfg.QueueNames["instance-state-changes"])
+	if err != nil {
+		return nil, err
+	}
+
+	consoles, err := newInstanceConsoleFetcher(cfg.RedisURL, cfg.QueueNames["instance-consoles"])
+	if err != nil {
+		return nil, err
+	}
+
+	updater, err := newImageUpdater(cfg.RedisURL, cfg.QueueNames["image-updates"])
+	if err != nil {
+		return nil, err
+	}
+
 	i, err := db.NewInstances(cfg.RedisURL, log, cfg.InstanceExpiry)
 	if err != nil {
 		return nil, err
@@ -95,16 +178,84 @@ func newServer(cfg *Config) (*server, error) {
 		return nil, err
 	}
 
-	is, err := db.NewInitScripts(cfg.RedisURL, log)
+	ip, err := db.NewImagePins(cfg.RedisURL, log)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring, err := lib.ParseKeyring(cfg.InitScriptKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	is, err := db.NewInitScripts(cfg.RedisURL, keyring, log)
+	if err != nil {
+		return nil, err
+	}
+
+	ib, err := db.NewInstanceBuilds(cfg.RedisURL, log, cfg.InstanceBuildExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := db.NewHistory(cfg.RedisURL, log, cfg.HistoryExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	ro, err := db.NewRollouts(cfg.RedisURL, log)
+	if err != nil {
+		return nil, err
+	}
+
+	ist, err := db.NewInitScriptTemplates(cfg.RedisURL, log)
+	if err != nil {
+		return nil, err
+	}
+
+	auther, err := newServerAuther(cfg.AuthToken, cfg.RedisURL, keyring, log)
+	if err != nil {
+		return nil, err
+	}
+
+	imageSelectors, err := lib.ParseImageSelectors(cfg.ImageSelectors)
+	if err != nil {
+		return nil, err
+	}
+
+	topology, err := lib.ParseTopology(cfg.Topology)
+	if err != nil {
+		return nil, err
+	}
+
+	topology.DefaultRegion = cfg.AWSRegion
+
+	tagPolicy, err := lib.ParseTagPolicy(cfg.TagPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	initScriptTemplate, err := template.New("init-script").Parse(cfg.InitScriptTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	trustedProxies, err := parseTrustedProxies(cfg.TrustedProxies)
 	if err != nil {
 		return nil, err
 	}
 
-	auther, err := newServerAuther(cfg.AuthToken, cfg.RedisURL, log)
+	rp, err := db.BuildRedisPool(cfg.RedisURL)
 	if err != nil {
 		return nil, err
 	}
 
+	queueNames := []string{}
+	for _, queueName := range cfg.QueueNames {
+		queueNames = append(queueNames, queueName)
+	}
+	sort.Strings(queueNames)
+
 	srv := &server{
 		addr:      cfg.Addr,
 		authToken: cfg.AuthToken,
@@ -117,11 +268,34 @@ func newServer(cfg *Config) (*server, error) {
 
 		sentryDSN: cfg.SentryDSN,
 
+		imageSelectors: imageSelectors,
+		topology:       topology,
+		tagPolicy:      tagPolicy,
+		metrics:        lib.NewMetrics(),
+		queueNames:     queueNames,
+
+		initScriptSourceBinding: cfg.InitScriptSourceBinding,
+		trustedProxies:          trustedProxies,
+		previewUnredactToken:    cfg.PreviewUnredactToken,
+
+		instanceRSA:        cfg.InstanceRSA,
+		instanceYML:        cfg.InstanceYML,
+		initScriptTemplate: initScriptTemplate,
+
 		builder:    builder,
 		terminator: terminator,
+		changer:    changer,
+		consoles:   consoles,
+		updater:    updater,
 		is:         is,
 		i:          i,
 		img:        img,
+		ip:         ip,
+		ib:         ib,
+		h:          h,
+		ist:        ist,
+		ro:         ro,
+		rp:         rp,
 		log:        log,
 
 		n: negroni.New(),
@@ -146,19 +320,45 @@ func (srv *server) setupRoutes() {
 	srv.r.HandleFunc(`/`, srv.handleGetRoot).Methods("GET").Name("ohai")
 	srv.r.HandleFunc(`/`, srv.ifAuth(srv.handleDeleteRoot)).Methods("DELETE").Name("shutdown")
 	srv.r.HandleFunc(`/debug/vars`, srv.ifAuth(expvarplus.HandleExpvars)).Methods("GET").Name("expvars")
+	srv.r.HandleFunc(`/metrics`, srv.ifAuth(srv.handleMetrics)).Methods("GET").Name("metrics")
+	srv.r.HandleFunc(`/config/topology`, srv.ifAuth(srv.handleTopology)).Methods("GET").Name("config-topology")
 	srv.r.HandleFunc(`/kaboom`, srv.ifAuth(srv.handleKaboom)).Methods("POST").Name("kaboom")
 	srv.r.HandleFunc(`/instances`, srv.ifAuth(srv.handleInstances)).Methods("GET").Name("instances")
+	srv.r.HandleFunc(`/instances/summary`, srv.ifAuth(srv.handleInstanceSummary)).Methods("GET").Name("instances-summary")
 	srv.r.HandleFunc(`/instances/{instance_id}`, srv.ifAuth(srv.handleInstanceByIDFetch)).Methods("GET").Name("instances-by-id")
 	srv.r.HandleFunc(`/instances/{instance_id}`, srv.ifAuth(srv.handleInstanceByIDTerminate)).Methods("DELETE").Name("delete-instances-by-id")
+	srv.r.HandleFunc(`/instances/{instance_id}/start`, srv.ifAuth(srv.handleInstanceByIDStart)).Methods("POST").Name("instances-start-by-id")
+	srv.r.HandleFunc(`/instances/{instance_id}/stop`, srv.ifAuth(srv.handleInstanceByIDStop)).Methods("POST").Name("instances-stop-by-id")
+	srv.r.HandleFunc(`/instances/{instance_id}/console`, srv.ifAuth(srv.handleInstanceConsole)).Methods("GET").Name("instances-console")
+	srv.r.HandleFunc(`/instances/{instance_id}/events`, srv.ifAuth(srv.handleInstanceEvents)).Methods("GET").Name("instances-events")
+	srv.r.HandleFunc(`/ec2-sync-history`, srv.ifAuth(srv.handleEC2SyncHistory)).Methods("GET").Name("ec2-sync-history")
 	srv.r.HandleFunc(`/instance-builds`, srv.ifAuth(srv.handleInstanceBuildsCreate)).Methods("POST").Name("instance-builds-create")
+	srv.r.HandleFunc(`/instance-builds/preview`, srv.ifAuth(srv.handleInstanceBuildsPreview)).Methods("POST").Name("instance-builds-preview")
+	srv.r.HandleFunc(`/instance-builds/{instance_build_id}`, srv.ifAuth(srv.handleInstanceBuildByIDFetch)).Methods("GET").Name("instance-builds-by-id")
 	srv.r.HandleFunc(`/instance-builds/{instance_build_id}`, srv.ifAuth(srv.handleInstanceBuildUpdateByID)).Methods("PATCH").Name("instance-builds-update-by-id")
-	srv.r.HandleFunc(`/init-scripts/{instance_build_id}`, srv.ifAuth(srv.handleInitScripts)).Methods("GET").Name("init-scripts")
+	srv.r.HandleFunc(`/instance-builds/{instance_build_id}/init-script-fetches`, srv.ifAuth(srv.handleInitScriptFetches)).Methods("GET").Name("instance-builds-init-script-fetches")
+	srv.r.HandleFunc(`/init-scripts/{instance_build_id}`, srv.ifInitScriptAuth(srv.handleInitScripts)).Methods("GET").Name("init-scripts")
+	srv.r.HandleFunc(`/init-script-templates`, srv.ifAuth(srv.handleInitScriptTemplates)).Methods("GET").Name("init-script-templates")
+	srv.r.HandleFunc(`/init-script-templates/{name}`, srv.ifAuth(srv.handleInitScriptTemplateByNameFetch)).Methods("GET").Name("init-script-templates-by-name")
+	srv.r.HandleFunc(`/init-script-templates/{name}`, srv.ifAuth(srv.handleInitScriptTemplateByNameUpdate)).Methods("PUT").Name("init-script-templates-update-by-name")
+	srv.r.HandleFunc(`/init-script-templates/{name}/versions`, srv.ifAuth(srv.handleInitScriptTemplateVersions)).Methods("GET").Name("init-script-templates-versions")
 	srv.r.HandleFunc(`/images`, srv.ifAuth(srv.handleImages)).Methods("GET").Name("images")
+	srv.r.HandleFunc(`/images/cleanup-reports`, srv.ifAuth(srv.handleImageCleanupReports)).Methods("GET").Name("images-cleanup-reports")
+	srv.r.HandleFunc(`/images/selection`, srv.ifAuth(srv.handleImageSelection)).Methods("GET").Name("images-selection")
+	srv.r.HandleFunc(`/images/{image_id}`, srv.ifAuth(srv.handleImageUpdateByID)).Methods("PATCH").Name("images-update-by-id")
+	srv.r.HandleFunc(`/image-pins`, srv.ifAuth(srv.handleImagePins)).Methods("GET").Name("image-pins")
+	srv.r.HandleFunc(`/image-pins/{role}/{site}/{env}`, srv.ifAuth(srv.handleImagePinUpdate)).Methods("PUT").Name("image-pins-update")
+	srv.r.HandleFunc(`/image-pins/{role}/{site}/{env}`, srv.ifAuth(srv.handleImagePinDelete)).Methods("DELETE").Name("image-pins-delete")
+	srv.r.HandleFunc(`/rollouts`, srv.ifAuth(srv.handleRollouts)).Methods("GET").Name("rollouts")
+	srv.r.HandleFunc(`/rollouts`, srv.ifAuth(srv.handleRolloutsCreate)).Methods("POST").Name("rollouts-create")
+	srv.r.HandleFunc(`/rollouts/{rollout_id}`, srv.ifAuth(srv.handleRolloutByIDFetch)).Methods("GET").Name("rollouts-by-id")
+	srv.r.HandleFunc(`/rollouts/{rollout_id}`, srv.ifAuth(srv.handleRolloutUpdateByID)).Methods("PATCH").Name("rollouts-update-by-id")
 }
 
 func (srv *server) setupMiddleware() {
 	srv.n.Use(negroni.NewRecovery())
 	srv.n.Use(negronilogrus.NewMiddleware())
+	srv.n.Use(negroni.HandlerFunc(srv.measureRequest))
 	srv.n.Use(gzip.Gzip(gzip.DefaultCompression))
 	nr, err := negroniraven.NewMiddleware(srv.sentryDSN)
 	if err != nil {
@@ -177,6 +377,23 @@ func (srv *server) ifAuth(f func(http.ResponseWriter, *http.Request)) func(http.
 		f(w, req)
 	}
 }
+
+func (srv *server) ifInitScriptAuth(f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !srv.auther.Authenticate(w, req) {
+			result := "forbidden"
+			if req.Header.Get("Authorization") == "" {
+				result = "unauthorized"
+			}
+
+			srv.recordInitScriptFetch(mux.Vars(req)["instance_build_id"], req, result)
+			return
+		}
+
+		f(w, req)
+	}
+}
+
 func (srv *server) handleGetRoot(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "text-plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
@@ -192,40 +409,156 @@ func (srv *server) handleKaboom(w http.ResponseWriter, req *http.Request) {
 	panic(errKaboom)
 }
 
+func (srv *server) handleTopology(w http.ResponseWriter, req *http.Request) {
+	jsonapi.Respond(w, &lib.TopologyCollectionSingular{
+		Topology: srv.topology,
+	}, http.StatusOK)
+}
+
 func (srv *server) handleInstances(w http.ResponseWriter, req *http.Request) {
+	fetch := srv.i.Fetch
+	switch state := req.FormValue("state"); {
+	case state == "terminated":
+		fetch = srv.h.FetchInstances
+	case state != "" && !lib.IsInstanceState(state):
+		jsonapi.Error(w, errInvalidInstanceState, http.StatusBadRequest)
+		return
+	}
+
+	instances, err := fetch(instanceFilterFromRequest(req))
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	setInstanceLinks(instances)
+
+	jsonapi.Respond(w, map[string][]*lib.Instance{
+		"instances": instances,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleInstanceSummary(w http.ResponseWriter, req *http.Request) {
+	groupBy := []string{}
+	for _, key := range strings.Split(req.FormValue("group_by"), ",") {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			groupBy = append(groupBy, key)
+		}
+	}
+
+	err := lib.CheckInstanceSummaryGroupBy(groupBy)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusBadRequest)
+		return
+	}
+
+	withAges := req.FormValue("ages") != "false"
+	fields := append([]string{}, groupBy...)
+	if withAges {
+		fields = append(fields, "launch_time")
+	}
+
+	instances, err := srv.i.FetchFields(instanceFilterFromRequest(req), fields)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	summary, err := lib.SummarizeInstances(instances, groupBy, withAges, time.Now().UTC())
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusBadRequest)
+		return
+	}
+
+	jsonapi.Respond(w, &lib.InstanceSummaryCollectionSingular{
+		InstanceSummary: summary,
+	}, http.StatusOK)
+}
+
+// instanceFilterFromRequest builds an instance filter from the env,
+// site, role, queue, region, account, state, instance_build_id, and
+// "tag:"-prefixed query params
+func instanceFilterFromRequest(req *http.Request) map[string]string {
 	f := map[string]string{}
-	for _, qv := range []string{"env", "site", "role", "queue"} {
+	for _, qv := range []string{"env", "site", "role", "queue", "region", "account", "state", "instance_build_id"} {
 		v := req.FormValue(qv)
 		if v != "" {
 			f[qv] = v
 		}
 	}
 
+	for qv := range req.Form {
+		if strings.HasPrefix(qv, "tag:") {
+			f[qv] = req.Form.Get(qv)
+		}
+	}
+
+	return f
+}
+
+// setInstanceLinks sets the href of the instance build that launched
+// each instance, if known
+func setInstanceLinks(instances []*lib.Instance) {
+	for _, inst := range instances {
+		if inst.InstanceBuildID != "" {
+			inst.InstanceBuildHREF = fmt.Sprintf("/instance-builds/%s", inst.InstanceBuildID)
+		}
+	}
+}
+
+func (srv *server) handleInstanceByIDFetch(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	f := map[string]string{"instance_id": vars["instance_id"]}
 	instances, err := srv.i.Fetch(f)
 	if err != nil {
 		jsonapi.Error(w, err, http.StatusInternalServerError)
 		return
 	}
 
+	if len(instances) == 0 {
+		instances, err = srv.h.FetchInstances(f)
+		if err != nil {
+			jsonapi.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	setInstanceLinks(instances)
+
 	jsonapi.Respond(w, map[string][]*lib.Instance{
 		"instances": instances,
 	}, http.StatusOK)
 }
 
-func (srv *server) handleInstanceByIDFetch(w http.ResponseWriter, req *http.Request) {
+func (srv *server) handleInstanceByIDTerminate(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
-	instances, err := srv.i.Fetch(map[string]string{"instance_id": vars["instance_id"]})
+	instanceID, ok := vars["instance_id"]
+	if !ok {
+		jsonapi.Error(w, errMissingInstanceID, http.StatusBadRequest)
+		return
+	}
+
+	err := srv.terminator.Terminate(instanceID, req.FormValue("slack-channel"), req.FormValue("requester"))
 	if err != nil {
 		jsonapi.Error(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	jsonapi.Respond(w, map[string][]*lib.Instance{
-		"instances": instances,
-	}, http.StatusOK)
+	jsonapi.Respond(w, map[string]string{"ok": "working on that"}, http.StatusAccepted)
 }
 
-func (srv *server) handleInstanceByIDTerminate(w http.ResponseWriter, req *http.Request) {
+func (srv *server) handleInstanceByIDStart(w http.ResponseWriter, req *http.Request) {
+	srv.changeInstanceState(w, req, "start", "stopped", errInstanceNotStopped)
+}
+
+func (srv *server) handleInstanceByIDStop(w http.ResponseWriter, req *http.Request) {
+	srv.changeInstanceState(w, req, "stop", "running", errInstanceNotRunning)
+}
+
+// changeInstanceState enqueues the start or stop action for the
+// instance in the request if it is currently in the required state
+func (srv *server) changeInstanceState(w http.ResponseWriter, req *http.Request, action, requiredState string, stateErr error) {
 	vars := mux.Vars(req)
 	instanceID, ok := vars["instance_id"]
 	if !ok {
@@ -233,7 +566,23 @@ func (srv *server) handleInstanceByIDTerminate(w http.ResponseWriter, req *http.
 		return
 	}
 
-	err := srv.terminator.Terminate(instanceID, req.FormValue("slack-channel"))
+	instances, err := srv.i.Fetch(map[string]string{"instance_id": instanceID})
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if len(instances) == 0 {
+		jsonapi.Error(w, errUnknownInstance, http.StatusNotFound)
+		return
+	}
+
+	if instances[0].State != requiredState {
+		jsonapi.Error(w, stateErr, http.StatusConflict)
+		return
+	}
+
+	err = srv.changer.Change(instanceID, action, req.FormValue("slack-channel"), req.FormValue("requester"))
 	if err != nil {
 		jsonapi.Error(w, err, http.StatusInternalServerError)
 		return
@@ -242,6 +591,80 @@ func (srv *server) handleInstanceByIDTerminate(w http.ResponseWriter, req *http.
 	jsonapi.Respond(w, map[string]string{"ok": "working on that"}, http.StatusAccepted)
 }
 
+// handleInstanceConsole responds with the cached console output of
+// the instance, or enqueues fetching it from ec2 if none is cached or
+// a refresh is requested
+func (srv *server) handleInstanceConsole(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	instanceID, ok := vars["instance_id"]
+	if !ok {
+		jsonapi.Error(w, errMissingInstanceID, http.StatusBadRequest)
+		return
+	}
+
+	co, err := srv.i.FetchConsoleOutput(instanceID)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if co == nil || req.FormValue("refresh") == "true" {
+		err = srv.consoles.Fetch(instanceID, "")
+		if err != nil {
+			jsonapi.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		jsonapi.Respond(w, map[string]string{"ok": "working on that"}, http.StatusAccepted)
+		return
+	}
+
+	if req.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, co.Output)
+		return
+	}
+
+	jsonapi.Respond(w, &lib.ConsoleOutputsCollection{
+		ConsoleOutputs: []*lib.ConsoleOutput{co},
+	}, http.StatusOK)
+}
+
+func (srv *server) handleInstanceEvents(w http.ResponseWriter, req *http.Request) {
+	events, err := srv.i.FetchEvents(mux.Vars(req)["instance_id"])
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, &lib.InstanceEventsCollection{
+		InstanceEvents: events,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleEC2SyncHistory(w http.ResponseWriter, req *http.Request) {
+	limit := 20
+	if req.FormValue("limit") != "" {
+		parsed, err := strconv.Atoi(req.FormValue("limit"))
+		if err != nil || parsed < 1 {
+			jsonapi.Error(w, errInvalidLimit, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	history, err := srv.i.FetchSyncHistory(limit)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, &lib.EC2SyncHistoryCollection{
+		EC2SyncHistory: history,
+	}, http.StatusOK)
+}
+
 func (srv *server) handleInstanceBuildsCreate(w http.ResponseWriter, req *http.Request) {
 	payload := &lib.InstanceBuildsCollectionSingular{}
 	err := json.NewDecoder(req.Body).Decode(payload)
@@ -267,7 +690,13 @@ func (srv *server) handleInstanceBuildsCreate(w http.ResponseWriter, req *http.R
 		build.SlackChannel = srv.slackChannel
 	}
 
-	validationErrors := build.Validate()
+	if v := req.FormValue("requester"); v != "" {
+		build.Requester = v
+	}
+
+	srv.topology.ApplyDefaults(build)
+
+	validationErrors := append(build.Validate(srv.topology), srv.tagPolicy.Validate(build.Tags)...)
 	if len(validationErrors) > 0 {
 		jsonapi.Errors(w, validationErrors, http.StatusBadRequest)
 		return
@@ -279,58 +708,268 @@ func (srv *server) handleInstanceBuildsCreate(w http.ResponseWriter, req *http.R
 		return
 	}
 
+	setInstanceBuildLinks(build)
+
 	jsonapi.Respond(w, &lib.InstanceBuildsCollection{
 		InstanceBuilds: []*lib.InstanceBuild{build},
 	}, http.StatusAccepted)
 }
 
-func (srv *server) handleInstanceBuildUpdateByID(w http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	instanceBuildID, ok := vars["instance_build_id"]
-	if !ok {
-		jsonapi.Error(w, errMissingInstanceBuildID, http.StatusBadRequest)
+// handleInstanceBuildsPreview renders the init script for an instance
+// build payload the same way the instance-builds worker would, but
+// without resolving an ami, launching anything, or storing anything
+func (srv *server) handleInstanceBuildsPreview(w http.ResponseWriter, req *http.Request) {
+	payload := &lib.InstanceBuildsCollectionSingular{
+		InstanceBuilds: lib.NewInstanceBuild(),
+	}
+	err := json.NewDecoder(req.Body).Decode(payload)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusBadRequest)
 		return
 	}
 
-	state := req.FormValue("state")
-	if state != "finished" {
-		srv.log.WithField("state", state).Debug("no-op state")
-		jsonapi.Respond(w, map[string]string{"no": "op"}, http.StatusOK)
+	redacted := req.FormValue("redact") != "false"
+	if !redacted && !srv.canUnredactPreview(req) {
+		jsonapi.Error(w, errUnredactedPreview, http.StatusForbidden)
 		return
 	}
 
-	slackChannel := req.FormValue("slack-channel")
-	if slackChannel == "" {
-		slackChannel = srv.slackChannel
+	build := payload.InstanceBuilds
+	if build.SlackChannel == "" {
+		build.SlackChannel = srv.slackChannel
 	}
 
-	// FIXME: extract this bit for other notification types?
-	if srv.slackHookPath != "" && slackChannel != "" {
-		instanceID := req.FormValue("instance-id")
-		if instanceID == "" {
-			instanceID = "?wat?"
-		}
+	srv.topology.ApplyDefaults(build)
 
-		srv.log.Debug("sending slack notification!")
-		notifier := lib.NewSlackNotifier(srv.slackHookPath, srv.slackUsername, srv.slackIcon)
-		err := notifier.Notify(slackChannel,
-			fmt.Sprintf("Finished starting instance `%s` for instance build *%s*", instanceID, instanceBuildID))
-		if err != nil {
-			srv.log.WithField("err", err).Error("failed to send slack notification")
-		}
-	} else {
-		srv.log.WithFields(logrus.Fields{
-			"slack_hook_path": srv.slackHookPath,
-		}).Debug("slack fields empty?")
+	validationErrors := append(build.Validate(srv.topology), srv.tagPolicy.Validate(build.Tags)...)
+	if len(validationErrors) > 0 {
+		jsonapi.Errors(w, validationErrors, http.StatusBadRequest)
+		return
 	}
 
-	err := srv.builder.Wipe(instanceBuildID)
+	t, err := srv.ist.Resolve(build, srv.initScriptTemplate)
 	if err != nil {
-		jsonapi.Error(w, err, http.StatusInternalServerError)
+		jsonapi.Error(w, err, http.StatusBadRequest)
 		return
 	}
 
-	jsonapi.Respond(w, map[string]string{"sure": "why not"}, http.StatusOK)
+	scheme := "http"
+	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	instanceBuildURL := &url.URL{
+		Scheme: scheme,
+		Host:   req.Host,
+		User:   url.UserPassword("x", lib.RedactedPlaceholder),
+		Path:   fmt.Sprintf("/instance-builds/%s", build.ID),
+	}
+
+	rendered, err := lib.RenderInitScript(t, build, srv.instanceYML, srv.instanceRSA, instanceBuildURL.String())
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if redacted {
+		rendered = rendered.Redact()
+	} else {
+		srv.log.WithFields(logrus.Fields{
+			"request_id": req.Header.Get("X-Request-ID"),
+			"site":       build.Site,
+			"env":        build.Env,
+			"queue":      build.Queue,
+			"role":       build.Role,
+		}).Warn("serving unredacted init script preview")
+	}
+
+	jsonapi.Respond(w, map[string]*lib.InstanceBuildPreview{
+		"instance_build_previews": &lib.InstanceBuildPreview{
+			InstanceBuild: build,
+			Redacted:      redacted,
+			Script:        rendered.Script,
+			InstanceYML:   rendered.InstanceYML,
+		},
+	}, http.StatusOK)
+}
+
+// canUnredactPreview reports whether the request carries the preview
+// unredact token, which is required in addition to the normal auth for
+// previews with redact=false.  Without a configured token, previews are
+// always redacted.
+func (srv *server) canUnredactPreview(req *http.Request) bool {
+	if srv.previewUnredactToken == "" {
+		return false
+	}
+
+	token := req.Header.Get("X-Pudding-Unredact-Token")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(srv.previewUnredactToken)) == 1
+}
+
+func (srv *server) handleInstanceBuildByIDFetch(w http.ResponseWriter, req *http.Request) {
+	build, err := srv.ib.Get(mux.Vars(req)["instance_build_id"])
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if build == nil {
+		jsonapi.Error(w, errInstanceBuildNotFound, http.StatusNotFound)
+		return
+	}
+
+	setInstanceBuildLinks(build)
+
+	jsonapi.Respond(w, &lib.InstanceBuildsCollection{
+		InstanceBuilds: []*lib.InstanceBuild{build},
+	}, http.StatusOK)
+}
+
+// setInstanceBuildLinks sets the hrefs of the instance build itself,
+// of all instances launched for it, and of its instance, if known
+func setInstanceBuildLinks(b *lib.InstanceBuild) {
+	b.HREF = fmt.Sprintf("/instance-builds/%s", b.ID)
+	b.InstancesHREF = fmt.Sprintf("/instances?instance_build_id=%s", url.QueryEscape(b.ID))
+	if b.InstanceID != "" {
+		b.InstanceHREF = fmt.Sprintf("/instances/%s", b.InstanceID)
+	}
+}
+
+func (srv *server) handleInstanceBuildUpdateByID(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	instanceBuildID, ok := vars["instance_build_id"]
+	if !ok {
+		jsonapi.Error(w, errMissingInstanceBuildID, http.StatusBadRequest)
+		return
+	}
+
+	state := req.FormValue("state")
+	if state == "failed" {
+		srv.handleInstanceBuildFailed(w, req, instanceBuildID)
+		return
+	}
+
+	if state != "finished" {
+		srv.log.WithField("state", state).Debug("no-op state")
+		jsonapi.Respond(w, map[string]string{"no": "op"}, http.StatusOK)
+		return
+	}
+
+	slackChannel := req.FormValue("slack-channel")
+	if slackChannel == "" {
+		slackChannel = srv.slackChannel
+	}
+
+	// FIXME: extract this bit for other notification types?
+	if srv.slackHookPath != "" && slackChannel != "" {
+		instanceID := req.FormValue("instance-id")
+		if instanceID == "" {
+			instanceID = "?wat?"
+		}
+
+		srv.log.Debug("sending slack notification!")
+		notifier := lib.NewSlackNotifier(srv.slackHookPath, srv.slackUsername, srv.slackIcon)
+		err := notifier.Notify(slackChannel,
+			fmt.Sprintf("Finished starting instance `%s` for instance build *%s*", instanceID, instanceBuildID))
+		if err != nil {
+			srv.log.WithField("err", err).Error("failed to send slack notification")
+		}
+	} else {
+		srv.log.WithFields(logrus.Fields{
+			"slack_hook_path": srv.slackHookPath,
+		}).Debug("slack fields empty?")
+	}
+
+	_, err := srv.markInstanceBuild(instanceBuildID, req.FormValue("instance-id"), "finished")
+	if err != nil {
+		srv.log.WithFields(logrus.Fields{
+			"err": err,
+			"id":  instanceBuildID,
+		}).Error("failed to mark instance build finished")
+	}
+
+	err = srv.builder.Wipe(instanceBuildID)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, map[string]string{"sure": "why not"}, http.StatusOK)
+}
+
+// handleInstanceBuildFailed marks the instance build failed, as
+// reported by an instance whose init script did not finish, and
+// enqueues capturing the instance's console output into the build
+func (srv *server) handleInstanceBuildFailed(w http.ResponseWriter, req *http.Request, ID string) {
+	instanceID, err := srv.markInstanceBuild(ID, req.FormValue("instance-id"), "failed")
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if instanceID != "" {
+		err = srv.consoles.Fetch(instanceID, ID)
+		if err != nil {
+			jsonapi.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	slackChannel := req.FormValue("slack-channel")
+	if slackChannel == "" {
+		slackChannel = srv.slackChannel
+	}
+
+	if srv.slackHookPath != "" && slackChannel != "" {
+		if instanceID == "" {
+			instanceID = "?wat?"
+		}
+
+		notifier := lib.NewSlackNotifier(srv.slackHookPath, srv.slackUsername, srv.slackIcon)
+		err = notifier.Notify(slackChannel,
+			fmt.Sprintf("Failed starting instance `%s` for instance build *%s* :skull:", instanceID, ID))
+		if err != nil {
+			srv.log.WithField("err", err).Error("failed to send slack notification")
+		}
+	}
+
+	err = srv.builder.Wipe(ID)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, map[string]string{"ok": "working on that"}, http.StatusAccepted)
+}
+
+// markInstanceBuild sets the state of the stored instance build, if
+// any, and removes it from the booting builds, returning the id of
+// the build's instance
+func (srv *server) markInstanceBuild(ID, instanceID, state string) (string, error) {
+	build, err := srv.ib.Get(ID)
+	if err != nil {
+		return instanceID, err
+	}
+
+	if build == nil {
+		srv.log.WithFields(logrus.Fields{
+			"id":    ID,
+			"state": state,
+		}).Debug("no stored instance build to mark")
+		return instanceID, nil
+	}
+
+	_, err = srv.ib.ClaimBooting(ID)
+	if err != nil {
+		return instanceID, err
+	}
+
+	build.State = state
+	if build.InstanceID == "" && instanceID != "" {
+		build.InstanceID = instanceID
+	}
+
+	return build.InstanceID, srv.ib.Store(build)
 }
 
 func (srv *server) handleInitScripts(w http.ResponseWriter, req *http.Request) {
@@ -341,35 +980,265 @@ func (srv *server) handleInitScripts(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	srv.sendInitScript(w, instanceBuildID)
+	srv.sendInitScript(w, req, instanceBuildID)
 }
 
-func (srv *server) sendInitScript(w http.ResponseWriter, ID string) {
-	script, err := srv.is.Get(ID)
+func (srv *server) sendInitScript(w http.ResponseWriter, req *http.Request, ID string) {
+	if srv.initScriptSourceBinding {
+		allowed, err := srv.isAllowedInitScriptSource(ID, srv.remoteIP(req))
+		if err != nil {
+			srv.recordInitScriptFetch(ID, req, "error")
+			jsonapi.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if !allowed {
+			srv.recordInitScriptFetch(ID, req, "source-mismatch")
+			jsonapi.Error(w, errInitScriptSource, http.StatusForbidden)
+			return
+		}
+	}
+
+	script, err := srv.is.Consume(ID)
+	if err == db.ErrInitScriptNotFound {
+		srv.recordInitScriptFetch(ID, req, "not-found")
+		jsonapi.Error(w, err, http.StatusNotFound)
+		return
+	}
+
 	if err != nil {
 		srv.log.WithFields(logrus.Fields{
 			"err": err,
 			"id":  ID,
 		}).Error("failed to get init script")
+		srv.recordInitScriptFetch(ID, req, "error")
 		jsonapi.Error(w, err, http.StatusInternalServerError)
 		return
 	}
 
+	srv.recordInitScriptFetch(ID, req, "fetched")
+
 	w.Header().Set("Content-Type", "text/x-shellscript; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, script)
 }
 
+// isAllowedInitScriptSource checks the given remote ip against the
+// ips recorded for the instance build when the instance was launched
+// and those of the instance as most recently synced.  The fetch is
+// denied when no ips are known.
+func (srv *server) isAllowedInitScriptSource(ID, ip string) (bool, error) {
+	build, err := srv.ib.Get(ID)
+	if err != nil {
+		return false, err
+	}
+
+	if build == nil {
+		return false, nil
+	}
+
+	knownIPs := []string{build.IP, build.PrivateIP}
+
+	if build.InstanceID != "" {
+		instances, err := srv.i.Fetch(map[string]string{"instance_id": build.InstanceID})
+		if err != nil {
+			return false, err
+		}
+
+		for _, inst := range instances {
+			knownIPs = append(knownIPs, inst.IP, inst.PrivateIP)
+		}
+	}
+
+	for _, knownIP := range knownIPs {
+		if knownIP != "" && knownIP == ip {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (srv *server) recordInitScriptFetch(ID string, req *http.Request, result string) {
+	if ID == "" {
+		return
+	}
+
+	err := srv.ib.RecordInitScriptFetch(ID, &lib.InitScriptFetch{
+		RemoteIP: srv.remoteIP(req),
+		Result:   result,
+		Time:     time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		srv.log.WithFields(logrus.Fields{
+			"err": err,
+			"id":  ID,
+		}).Error("failed to record init script fetch")
+	}
+}
+
+func (srv *server) handleInitScriptFetches(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	instanceBuildID, ok := vars["instance_build_id"]
+	if !ok {
+		jsonapi.Error(w, errMissingInstanceBuildID, http.StatusBadRequest)
+		return
+	}
+
+	fetches, err := srv.ib.InitScriptFetches(instanceBuildID)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, map[string][]*lib.InitScriptFetch{
+		"init_script_fetches": fetches,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleInitScriptTemplates(w http.ResponseWriter, req *http.Request) {
+	templates, err := srv.ist.Fetch()
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, &lib.InitScriptTemplatesCollection{
+		InitScriptTemplates: templates,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleInitScriptTemplateByNameFetch(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	name, ok := vars["name"]
+	if !ok {
+		jsonapi.Error(w, errMissingTemplateName, http.StatusBadRequest)
+		return
+	}
+
+	version := 0
+	if v := req.FormValue("version"); v != "" {
+		parsed, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || parsed == 0 {
+			jsonapi.Error(w, errInvalidTemplateVersion, http.StatusBadRequest)
+			return
+		}
+		version = int(parsed)
+	}
+
+	t, err := srv.ist.Get(name, version)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if t == nil {
+		jsonapi.Error(w, errTemplateNotFound, http.StatusNotFound)
+		return
+	}
+
+	jsonapi.Respond(w, &lib.InitScriptTemplatesCollection{
+		InitScriptTemplates: []*lib.InitScriptTemplate{t},
+	}, http.StatusOK)
+}
+
+func (srv *server) handleInitScriptTemplateVersions(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	name, ok := vars["name"]
+	if !ok {
+		jsonapi.Error(w, errMissingTemplateName, http.StatusBadRequest)
+		return
+	}
+
+	templates, err := srv.ist.Versions(name)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, &lib.InitScriptTemplatesCollection{
+		InitScriptTemplates: templates,
+	}, http.StatusOK)
+}
+
+// handleInitScriptTemplateByNameUpdate either stores a new version of
+// the named template given a "template", or makes an existing version
+// current given only a "version", which allows rolling back
+func (srv *server) handleInitScriptTemplateByNameUpdate(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	name, ok := vars["name"]
+	if !ok {
+		jsonapi.Error(w, errMissingTemplateName, http.StatusBadRequest)
+		return
+	}
+
+	payload := &lib.InitScriptTemplatesCollectionSingular{}
+	err := json.NewDecoder(req.Body).Decode(payload)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusBadRequest)
+		return
+	}
+
+	t := payload.InitScriptTemplates
+	if t == nil {
+		t = &lib.InitScriptTemplate{}
+	}
+
+	t.Name = name
+
+	if t.Template == "" && t.Version > 0 {
+		t, err = srv.ist.SetCurrent(name, t.Version)
+		if err != nil {
+			jsonapi.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if t == nil {
+			jsonapi.Error(w, errTemplateNotFound, http.StatusNotFound)
+			return
+		}
+
+		jsonapi.Respond(w, &lib.InitScriptTemplatesCollection{
+			InitScriptTemplates: []*lib.InitScriptTemplate{t},
+		}, http.StatusOK)
+		return
+	}
+
+	t.Version = 0
+	t.CreatedAt = ""
+
+	validationErrors := t.Validate()
+	if len(validationErrors) > 0 {
+		jsonapi.Errors(w, validationErrors, http.StatusBadRequest)
+		return
+	}
+
+	err = srv.ist.Store(t)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, &lib.InitScriptTemplatesCollection{
+		InitScriptTemplates: []*lib.InitScriptTemplate{t},
+	}, http.StatusCreated)
+}
+
 func (srv *server) handleImages(w http.ResponseWriter, req *http.Request) {
 	f := map[string]string{}
-	for _, qv := range []string{"active", "role"} {
+	for _, qv := range []string{"active", "role", "region", "account"} {
 		v := req.FormValue(qv)
 		if v != "" {
 			f[qv] = v
 		}
 	}
 
-	images, err := srv.img.Fetch(f)
+	fetch := srv.img.Fetch
+	if req.FormValue("state") == "deregistered" {
+		fetch = srv.h.FetchImages
+	}
+
+	images, err := fetch(f)
 	if err != nil {
 		jsonapi.Error(w, err, http.StatusInternalServerError)
 		return
@@ -379,3 +1248,425 @@ func (srv *server) handleImages(w http.ResponseWriter, req *http.Request) {
 		"images": images,
 	}, http.StatusOK)
 }
+
+func (srv *server) handleImageSelection(w http.ResponseWriter, req *http.Request) {
+	role := req.FormValue("role")
+	if role == "" {
+		role = srv.topology.DefaultRole
+	}
+
+	sel := lib.ImageSelectorForRole(srv.imageSelectors, role)
+	if strategy := req.FormValue("strategy"); strategy != "" {
+		var err error
+		sel, err = lib.NewImageSelector(strategy, req.FormValue("pattern"))
+		if err != nil {
+			jsonapi.Error(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	region := req.FormValue("region")
+	if region == "" {
+		region = srv.topology.DefaultRegion
+	}
+
+	f := map[string]string{"role": role, "active": "true", "region": region, "account": req.FormValue("account")}
+	if v := req.FormValue("active"); v != "" {
+		f["active"] = v
+	}
+
+	images, err := srv.img.Fetch(f)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	selection, _ := sel.Select(images)
+
+	site, env := req.FormValue("site"), req.FormValue("env")
+	if site != "" && env != "" {
+		pinnedID, err := srv.ip.Get(role, site, env)
+		if err != nil {
+			jsonapi.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		pinned := []*lib.Image{}
+		if pinnedID != "" {
+			pinned, err = srv.img.Fetch(map[string]string{"image_id": pinnedID})
+			if err != nil {
+				jsonapi.Error(w, err, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if pinnedID != "" && imagesInLocation(pinned, region, f["account"]) {
+			selection.Chosen = &lib.Image{ImageID: pinnedID, Role: role}
+			for _, img := range pinned {
+				if img.ImageID == pinnedID {
+					selection.Chosen = img
+				}
+			}
+			selection.Reason = fmt.Sprintf("pinned for role %q, site %q, and env %q", role, site, env)
+		}
+	}
+
+	jsonapi.Respond(w, map[string]*lib.ImageSelection{
+		"image_selection": selection,
+	}, http.StatusOK)
+}
+
+// imagesInLocation checks that every image is in the given region and
+// account
+func imagesInLocation(images []*lib.Image, region, account string) bool {
+	for _, img := range images {
+		if img.Region != region || img.Account != account {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (srv *server) handleImageCleanupReports(w http.ResponseWriter, req *http.Request) {
+	reports, err := srv.img.CleanupReports()
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, map[string][]*lib.ImageCleanupReport{
+		"image_cleanup_reports": reports,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleImageUpdateByID(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	imageID, ok := vars["image_id"]
+	if !ok {
+		jsonapi.Error(w, errMissingImageID, http.StatusBadRequest)
+		return
+	}
+
+	active := req.FormValue("active")
+	if active != "true" && active != "false" {
+		jsonapi.Error(w, errInvalidImageActive, http.StatusBadRequest)
+		return
+	}
+
+	slackChannel := req.FormValue("slack-channel")
+	if slackChannel == "" {
+		slackChannel = srv.slackChannel
+	}
+
+	err := srv.updater.Update(imageID, active == "true", slackChannel)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, map[string]string{"ok": "working on that"}, http.StatusAccepted)
+}
+
+func (srv *server) handleImagePins(w http.ResponseWriter, req *http.Request) {
+	pins, err := srv.ip.Fetch()
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, map[string][]*lib.ImagePin{
+		"image_pins": pins,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleImagePinUpdate(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	pin := &lib.ImagePin{
+		Role:    vars["role"],
+		Site:    vars["site"],
+		Env:     vars["env"],
+		ImageID: req.FormValue("image_id"),
+	}
+
+	validationErrors := pin.Validate()
+	if len(validationErrors) > 0 {
+		jsonapi.Errors(w, validationErrors, http.StatusBadRequest)
+		return
+	}
+
+	images, err := srv.img.Fetch(map[string]string{"image_id": pin.ImageID})
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if len(images) == 0 || images[0].ImageID == "" {
+		jsonapi.Error(w, errUnknownImage, http.StatusBadRequest)
+		return
+	}
+
+	err = srv.ip.Store(pin)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonapi.Respond(w, map[string][]*lib.ImagePin{
+		"image_pins": []*lib.ImagePin{pin},
+	}, http.StatusOK)
+}
+
+func (srv *server) handleImagePinDelete(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	err := srv.ip.Remove(vars["role"], vars["site"], vars["env"])
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *server) handleRollouts(w http.ResponseWriter, req *http.Request) {
+	f := map[string]string{}
+	for _, qv := range []string{"state", "site", "env", "queue"} {
+		v := req.FormValue(qv)
+		if v != "" {
+			f[qv] = v
+		}
+	}
+
+	rollouts, err := srv.ro.Fetch(f)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	for _, ro := range rollouts {
+		ro.HREF = fmt.Sprintf("/rollouts/%s", ro.ID)
+	}
+
+	jsonapi.Respond(w, &lib.RolloutsCollection{
+		Rollouts: rollouts,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleRolloutsCreate(w http.ResponseWriter, req *http.Request) {
+	payload := &lib.RolloutsCollectionSingular{
+		Rollouts: lib.NewRollout(),
+	}
+	err := json.NewDecoder(req.Body).Decode(payload)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusBadRequest)
+		return
+	}
+
+	ro := payload.Rollouts
+	if ro.ID == "" {
+		ro.ID = feeds.NewUUID().String()
+	}
+
+	ro.State = "pending"
+	ro.Total, ro.Replaced, ro.InFlight = 0, 0, 0
+	ro.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	ro.BatchStartedAt = ""
+	ro.Reason = ""
+
+	if v := req.FormValue("slack-channel"); v != "" {
+		ro.SlackChannel = v
+	}
+
+	if ro.SlackChannel == "" {
+		ro.SlackChannel = srv.slackChannel
+	}
+
+	if ro.Role == "" {
+		ro.Role = srv.topology.DefaultRole
+	}
+
+	validationErrors := ro.Validate(srv.topology)
+	if len(validationErrors) > 0 {
+		jsonapi.Errors(w, validationErrors, http.StatusBadRequest)
+		return
+	}
+
+	err = srv.ro.Store(ro)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	ro.HREF = fmt.Sprintf("/rollouts/%s", ro.ID)
+
+	jsonapi.Respond(w, &lib.RolloutsCollection{
+		Rollouts: []*lib.Rollout{ro},
+	}, http.StatusAccepted)
+}
+
+func (srv *server) handleRolloutByIDFetch(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	rollouts, err := srv.ro.Fetch(map[string]string{"rollout_id": vars["rollout_id"]})
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	for _, ro := range rollouts {
+		ro.HREF = fmt.Sprintf("/rollouts/%s", ro.ID)
+	}
+
+	jsonapi.Respond(w, &lib.RolloutsCollection{
+		Rollouts: rollouts,
+	}, http.StatusOK)
+}
+
+func (srv *server) handleRolloutUpdateByID(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	rolloutID, ok := vars["rollout_id"]
+	if !ok {
+		jsonapi.Error(w, errMissingRolloutID, http.StatusBadRequest)
+		return
+	}
+
+	state := req.FormValue("state")
+	if state != "running" && state != "paused" && state != "cancelled" {
+		jsonapi.Error(w, errInvalidRolloutUpdate, http.StatusBadRequest)
+		return
+	}
+
+	lockOwner := fmt.Sprintf("server:%s", feeds.NewUUID())
+	locked, err := srv.ro.Lock(rolloutID, lockOwner, 30)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if !locked {
+		jsonapi.Error(w, errRolloutBusy, http.StatusConflict)
+		return
+	}
+
+	defer srv.ro.Unlock(rolloutID, lockOwner)
+
+	rollouts, err := srv.ro.Fetch(map[string]string{"rollout_id": rolloutID})
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if len(rollouts) == 0 {
+		jsonapi.Error(w, errRolloutNotFound, http.StatusNotFound)
+		return
+	}
+
+	ro := rollouts[0]
+	if ro.State == "finished" || ro.State == "cancelled" {
+		jsonapi.Error(w, errRolloutNotUpdatable, http.StatusConflict)
+		return
+	}
+
+	switch state {
+	case "running":
+		if ro.State != "paused" {
+			break
+		}
+
+		ro.Reason = ""
+		ro.State = "running"
+		if ro.AMI == "" {
+			// paused before the workers ever picked it up
+			ro.State = "pending"
+		}
+
+		// restart the boot timeout for whatever is still in flight
+		ro.BatchStartedAt = time.Now().UTC().Format(time.RFC3339)
+	default:
+		ro.State = state
+	}
+
+	err = srv.ro.Store(ro)
+	if err != nil {
+		jsonapi.Error(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	ro.HREF = fmt.Sprintf("/rollouts/%s", ro.ID)
+
+	jsonapi.Respond(w, &lib.RolloutsCollection{
+		Rollouts: []*lib.Rollout{ro},
+	}, http.StatusOK)
+}
+
+// remoteIP returns the ip of the client.  X-Forwarded-For is only
+// honored when the request comes from a trusted proxy, in which case
+// the client is its last entry that is not itself a trusted proxy.
+func (srv *server) remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	if !srv.isTrustedProxy(host) {
+		return host
+	}
+
+	xff := req.Header.Get("X-Forwarded-For")
+	if xff == "" {
+		return host
+	}
+
+	parts := strings.Split(xff, ",")
+	for i := len(parts) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(parts[i])
+		if i == 0 || !srv.isTrustedProxy(ip) {
+			return ip
+		}
+	}
+
+	return host
+}
+
+func (srv *server) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, proxy := range srv.trustedProxies {
+		if proxy.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseTrustedProxies parses comma-delimited ips or cidrs, where a
+// lone ip matches only itself
+func parseTrustedProxies(raw string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if !strings.Contains(part, "/") {
+			if ip := net.ParseIP(part); ip != nil && ip.To4() != nil {
+				part += "/32"
+			} else {
+				part += "/128"
+			}
+		}
+
+		_, proxy, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", part)
+		}
+
+		proxies = append(proxies, proxy)
+	}
+
+	return proxies, nil
+}
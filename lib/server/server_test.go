@@ -1,9 +1,276 @@
 package server
 
-import "testing"
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/travis-ci/pudding/lib"
+	"github.com/travis-ci/pudding/lib/db"
+)
 
 func TestNothing(t *testing.T) {
 	if 1 != 1 {
 		t.Fail()
 	}
 }
+
+type testInitScripts struct {
+	auths   map[string]string
+	scripts map[string]string
+}
+
+func (tis *testInitScripts) HasValidAuth(ID, auth string) bool {
+	return auth != "" && tis.auths[ID] == auth
+}
+
+func (tis *testInitScripts) Get(ID string) (string, error) {
+	script, ok := tis.scripts[ID]
+	if !ok {
+		return "", db.ErrInitScriptNotFound
+	}
+	return script, nil
+}
+
+func (tis *testInitScripts) Consume(ID string) (string, error) {
+	script, err := tis.Get(ID)
+	delete(tis.scripts, ID)
+	return script, err
+}
+
+type testInstanceBuilds struct {
+	builds  map[string]*lib.InstanceBuild
+	fetches map[string][]*lib.InitScriptFetch
+}
+
+func (tib *testInstanceBuilds) Get(ID string) (*lib.InstanceBuild, error) {
+	return tib.builds[ID], nil
+}
+
+func (tib *testInstanceBuilds) Store(b *lib.InstanceBuild) error {
+	tib.builds[b.ID] = b
+	return nil
+}
+
+func (tib *testInstanceBuilds) InitScriptFetches(ID string) ([]*lib.InitScriptFetch, error) {
+	return tib.fetches[ID], nil
+}
+
+func (tib *testInstanceBuilds) RecordInitScriptFetch(ID string, f *lib.InitScriptFetch) error {
+	tib.fetches[ID] = append(tib.fetches[ID], f)
+	return nil
+}
+
+func (tib *testInstanceBuilds) ClaimBooting(string) (bool, error) { return true, nil }
+
+type testInstances struct {
+	instances []*lib.Instance
+}
+
+func (ti *testInstances) Fetch(f map[string]string) ([]*lib.Instance, error) {
+	instances := []*lib.Instance{}
+	for _, inst := range ti.instances {
+		if inst.InstanceID == f["instance_id"] {
+			instances = append(instances, inst)
+		}
+	}
+	return instances, nil
+}
+
+func (ti *testInstances) FetchFields(map[string]string, []string) ([]*lib.Instance, error) {
+	return ti.instances, nil
+}
+
+func (ti *testInstances) Sync(map[string]*lib.Instance, []*lib.Location) ([]*lib.InstanceEvent, error) {
+	return nil, nil
+}
+
+func (ti *testInstances) FetchEvents(string) ([]*lib.InstanceEvent, error) { return nil, nil }
+
+func (ti *testInstances) FetchSyncHistory(int) ([]*lib.EC2SyncHistoryEntry, error) {
+	return nil, nil
+}
+
+func (ti *testInstances) FetchConsoleOutput(string) (*lib.ConsoleOutput, error) { return nil, nil }
+
+func newTestInitScriptServer(binding bool) (*server, *testInstanceBuilds, *testInitScripts) {
+	log := logrus.New()
+	log.Level = logrus.PanicLevel
+
+	tis := &testInitScripts{
+		auths:   map[string]string{"b-1": "secret"},
+		scripts: map[string]string{"b-1": "#!/bin/bash\necho hai\n"},
+	}
+
+	tib := &testInstanceBuilds{
+		builds: map[string]*lib.InstanceBuild{
+			"b-1":      {ID: "b-1", InstanceID: "i-1", PrivateIP: "10.0.0.1"},
+			"b-no-ips": {ID: "b-no-ips"},
+		},
+		fetches: map[string][]*lib.InitScriptFetch{},
+	}
+
+	srv := &server{
+		initScriptSourceBinding: binding,
+		log:                     log,
+		auther:                  &serverAuther{Token: "token", is: tis, log: log},
+		is:                      tis,
+		ib:                      tib,
+		i: &testInstances{instances: []*lib.Instance{
+			{InstanceID: "i-1", IP: "203.0.113.1", PrivateIP: "10.0.0.1"},
+		}},
+	}
+
+	return srv, tib, tis
+}
+
+func TestIsAllowedInitScriptSource(t *testing.T) {
+	srv, tib, _ := newTestInitScriptServer(true)
+	tib.builds["b-public"] = &lib.InstanceBuild{ID: "b-public", IP: "198.51.100.1"}
+	tib.builds["b-synced"] = &lib.InstanceBuild{ID: "b-synced", InstanceID: "i-1"}
+
+	for _, c := range []struct {
+		desc    string
+		ID      string
+		ip      string
+		allowed bool
+	}{
+		{"private ip recorded at launch", "b-1", "10.0.0.1", true},
+		{"public ip recorded at launch", "b-public", "198.51.100.1", true},
+		{"public ip of the synced instance", "b-synced", "203.0.113.1", true},
+		{"private ip of the synced instance", "b-synced", "10.0.0.1", true},
+		{"other ip", "b-1", "10.0.0.2", false},
+		{"no ips known", "b-no-ips", "10.0.0.1", false},
+		{"no ips known and no client ip", "b-no-ips", "", false},
+		{"missing instance build", "b-missing", "10.0.0.1", false},
+	} {
+		allowed, err := srv.isAllowedInitScriptSource(c.ID, c.ip)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.desc, err)
+			continue
+		}
+
+		if allowed != c.allowed {
+			t.Errorf("%s: expected allowed %v, got %v", c.desc, c.allowed, allowed)
+		}
+	}
+}
+
+func TestInitScriptFetchesAreRecorded(t *testing.T) {
+	basicAuth := func(user, pass string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	}
+
+	for _, c := range []struct {
+		desc       string
+		binding    bool
+		ID         string
+		auth       string
+		remoteAddr string
+		status     int
+		result     string
+	}{
+		{"no auth", true, "b-1", "", "10.0.0.1:1234", http.StatusUnauthorized, "unauthorized"},
+		{"invalid auth", true, "b-1", basicAuth("x", "wrong"), "10.0.0.1:1234", http.StatusForbidden, "forbidden"},
+		{"other source", true, "b-1", basicAuth("x", "secret"), "10.0.0.2:1234", http.StatusForbidden, "source-mismatch"},
+		{"no ips known", true, "b-no-ips", "token token", "10.0.0.1:1234", http.StatusForbidden, "source-mismatch"},
+		{"fetched", true, "b-1", basicAuth("x", "secret"), "10.0.0.1:1234", http.StatusOK, "fetched"},
+		{"fetched without binding", false, "b-1", basicAuth("x", "secret"), "10.0.0.2:1234", http.StatusOK, "fetched"},
+		{"not found", false, "b-no-ips", "token token", "10.0.0.1:1234", http.StatusNotFound, "not-found"},
+	} {
+		srv, tib, _ := newTestInitScriptServer(c.binding)
+
+		router := mux.NewRouter()
+		router.HandleFunc(`/init-scripts/{instance_build_id}`, srv.ifInitScriptAuth(srv.handleInitScripts)).Methods("GET")
+
+		req, err := http.NewRequest("GET", "http://pudding.example.com/init-scripts/"+c.ID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = c.remoteAddr
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.desc, c.status, w.Code)
+		}
+
+		fetches := tib.fetches[c.ID]
+		if len(fetches) != 1 {
+			t.Errorf("%s: expected 1 recorded fetch, got %d", c.desc, len(fetches))
+			continue
+		}
+
+		if fetches[0].Result != c.result {
+			t.Errorf("%s: expected result %q, got %q", c.desc, c.result, fetches[0].Result)
+		}
+
+		if fetches[0].RemoteIP != strings.Split(c.remoteAddr, ":")[0] {
+			t.Errorf("%s: expected remote ip of %q, got %q", c.desc, c.remoteAddr, fetches[0].RemoteIP)
+		}
+
+		if c.result == "fetched" && !strings.Contains(w.Body.String(), "echo hai") {
+			t.Errorf("%s: expected the init script, got %q", c.desc, w.Body.String())
+		}
+	}
+}
+
+func TestCanUnredactPreview(t *testing.T) {
+	for _, c := range []struct {
+		desc       string
+		configured string
+		header     string
+		allowed    bool
+	}{
+		{"no token configured", "", "", false},
+		{"no token configured but one given", "", "anything", false},
+		{"token missing", "unredact", "", false},
+		{"wrong token", "unredact", "nope", false},
+		{"auth token instead", "unredact", "token", false},
+		{"matching token", "unredact", "unredact", true},
+	} {
+		srv := &server{authToken: "token", previewUnredactToken: c.configured}
+
+		req, err := http.NewRequest("POST", "http://pudding.example.com/instance-builds/preview?redact=false", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "token token")
+		if c.header != "" {
+			req.Header.Set("X-Pudding-Unredact-Token", c.header)
+		}
+
+		if srv.canUnredactPreview(req) != c.allowed {
+			t.Errorf("%s: expected %v", c.desc, c.allowed)
+		}
+	}
+}
+
+func TestImagesInLocation(t *testing.T) {
+	for _, c := range []struct {
+		desc     string
+		images   []*lib.Image
+		region   string
+		account  string
+		expected bool
+	}{
+		{"no images", []*lib.Image{}, "us-east-1", "", true},
+		{"same region", []*lib.Image{{Region: "us-east-1"}}, "us-east-1", "", true},
+		{"other region", []*lib.Image{{Region: "us-west-2"}}, "us-east-1", "", false},
+		{"same region and account", []*lib.Image{{Region: "us-east-1", Account: "dev"}}, "us-east-1", "dev", true},
+		{"other account", []*lib.Image{{Region: "us-east-1", Account: "dev"}}, "us-east-1", "", false},
+		{"one image elsewhere", []*lib.Image{{Region: "us-east-1"}, {Region: "us-west-2"}}, "us-east-1", "", false},
+	} {
+		if imagesInLocation(c.images, c.region, c.account) != c.expected {
+			t.Errorf("%s: expected %v", c.desc, c.expected)
+		}
+	}
+}
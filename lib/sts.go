@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+const (
+	stsEndpoint = "https://sts.amazonaws.com/"
+	stsRegion   = "us-east-1"
+	stsService  = "sts"
+)
+
+// AssumedRole is the temporary auth obtained by assuming an iam role
+type AssumedRole struct {
+	Auth       aws.Auth
+	Expiration time.Time
+}
+
+type stsCredentials struct {
+	AccessKeyID     string `xml:"AssumeRoleResult>Credentials>AccessKeyId"`
+	SecretAccessKey string `xml:"AssumeRoleResult>Credentials>SecretAccessKey"`
+	SessionToken    string `xml:"AssumeRoleResult>Credentials>SessionToken"`
+	Expiration      string `xml:"AssumeRoleResult>Credentials>Expiration"`
+}
+
+type stsError struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// AssumeRole requests temporary auth for the given role arn from sts,
+// signing the request with the given auth, since goamz does not
+// provide an sts client
+func AssumeRole(auth aws.Auth, roleARN, sessionName string) (*AssumedRole, error) {
+	params := url.Values{
+		"Action":          []string{"AssumeRole"},
+		"Version":         []string{"2011-06-15"},
+		"RoleArn":         []string{roleARN},
+		"RoleSessionName": []string{sessionName},
+	}
+
+	req, err := http.NewRequest("GET", stsEndpoint+"?"+awsCanonicalQuery(params), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	signAWSRequest(req, auth, stsRegion, stsService, time.Now().UTC())
+
+	resp, err := awsHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		stsErr := &stsError{}
+		if xml.Unmarshal(body, stsErr) == nil && stsErr.Code != "" {
+			return nil, fmt.Errorf("sts: %s: %s", stsErr.Code, stsErr.Message)
+		}
+		return nil, fmt.Errorf("sts: unexpected status %d", resp.StatusCode)
+	}
+
+	creds := &stsCredentials{}
+	err = xml.Unmarshal(body, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	expiration, err := time.Parse(time.RFC3339, creds.Expiration)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AssumedRole{
+		Auth: aws.Auth{
+			AccessKey: creds.AccessKeyID,
+			SecretKey: creds.SecretAccessKey,
+			Token:     creds.SessionToken,
+		},
+		Expiration: expiration,
+	}, nil
+}
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hamfist/yaml"
+)
+
+var (
+	// ReservedTagKeys are the tag keys set on every instance by the
+	// instance builder, which may not be given as user tags
+	ReservedTagKeys = []string{"Name", "role", "site", "env", "queue", "purchase_type", "instance_build_id", "requester"}
+)
+
+// TagPolicy describes which user tags must be given with an instance
+// build and which values are allowed per tag key
+type TagPolicy struct {
+	Required []string            `json:"required" yaml:"required"`
+	Allowed  map[string][]string `json:"allowed" yaml:"allowed"`
+}
+
+// ParseTagPolicy parses a yml (or json) tag policy, returning an
+// empty policy that allows any tags when given an empty string
+func ParseTagPolicy(raw string) (*TagPolicy, error) {
+	tp := &TagPolicy{
+		Required: []string{},
+		Allowed:  map[string][]string{},
+	}
+
+	if strings.TrimSpace(raw) == "" {
+		return tp, nil
+	}
+
+	err := yaml.Unmarshal([]byte(raw), tp)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range tp.Required {
+		if containsString(ReservedTagKeys, key) {
+			return nil, fmt.Errorf("required tag %q is reserved", key)
+		}
+	}
+
+	return tp, nil
+}
+
+// Validate checks the given user tags against the policy, returning
+// a slice of all errors found
+func (tp *TagPolicy) Validate(tags map[string]string) []error {
+	errors := []error{}
+
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := tags[key]
+		if key == "" {
+			errors = append(errors, fmt.Errorf("tag keys must not be empty"))
+			continue
+		}
+		if containsString(ReservedTagKeys, key) {
+			errors = append(errors, fmt.Errorf("tag %q is reserved", key))
+			continue
+		}
+		if isAWSTagKey(key) {
+			errors = append(errors, fmt.Errorf("tag %q must not begin with \"aws:\"", key))
+			continue
+		}
+
+		allowed, ok := tp.Allowed[key]
+		if ok && !containsString(allowed, value) {
+			errors = append(errors, fmt.Errorf("tag %q must be one of %s", key, strings.Join(allowed, ", ")))
+		}
+	}
+
+	for _, key := range tp.Required {
+		if tags[key] == "" {
+			errors = append(errors, fmt.Errorf("tag %q is required", key))
+		}
+	}
+
+	return errors
+}
+
+// UserTags returns those of the given tags, such as all tags found on
+// an existing instance, that may be given as user tags, leaving out
+// the reserved and "aws:" tags and any values the policy does not
+// allow.  Required tags that are missing are left for Validate.
+func (tp *TagPolicy) UserTags(tags map[string]string) map[string]string {
+	userTags := map[string]string{}
+	for key, value := range tags {
+		if key == "" || containsString(ReservedTagKeys, key) || isAWSTagKey(key) {
+			continue
+		}
+
+		allowed, ok := tp.Allowed[key]
+		if ok && !containsString(allowed, value) {
+			continue
+		}
+
+		userTags[key] = value
+	}
+
+	return userTags
+}
+
+func isAWSTagKey(key string) bool {
+	return strings.HasPrefix(strings.ToLower(key), "aws:")
+}
@@ -0,0 +1,314 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/hamfist/yaml"
+	"github.com/mitchellh/goamz/ec2"
+)
+
+const (
+	// DefaultInstanceNameTemplate is the name template used for roles
+	// without a configured name template
+	DefaultInstanceNameTemplate = "travis-{{.Site}}-{{.Env}}-{{.Queue}}-{{.InstanceIDWithoutPrefix}}"
+)
+
+var (
+	errEmptyTopologySites = fmt.Errorf("topology must have at least one site")
+	errEmptyTopologyEnvs  = fmt.Errorf("topology must have at least one env")
+	errEmptyTopologyRoles = fmt.Errorf("topology must have at least one role")
+	errAmbiguousRole      = fmt.Errorf("topology with more than one role must have a default_role")
+)
+
+// TopologyCollectionSingular is the singular representation used in
+// jsonapi bodies
+type TopologyCollectionSingular struct {
+	Topology *Topology `json:"topology"`
+}
+
+// Topology is the set of sites, envs, and roles that instances may be
+// built for, along with the defaults applied to instance builds for
+// each role.  Instances may also be built in any of the Regions, in
+// addition to the workers' own region, and in any of the Accounts,
+// which map account names to the arn of the iam role assumed by the
+// workers.  The DefaultRegion is the workers' own region, which is
+// set from the aws region given to the process rather than parsed.
+type Topology struct {
+	Sites         []string                 `json:"sites" yaml:"sites"`
+	Envs          []string                 `json:"envs" yaml:"envs"`
+	Roles         map[string]*RoleDefaults `json:"roles" yaml:"roles"`
+	DefaultRole   string                   `json:"default_role" yaml:"default_role"`
+	Regions       []string                 `json:"regions,omitempty" yaml:"regions"`
+	Accounts      map[string]string        `json:"accounts,omitempty" yaml:"accounts"`
+	DefaultRegion string                   `json:"default_region,omitempty" yaml:"-"`
+}
+
+// RoleDefaults are the values applied to an instance build for a
+// given role when not provided with the build itself, as well as the
+// filter used when looking up images for the role
+type RoleDefaults struct {
+	NameTemplate    string            `json:"name_template,omitempty" yaml:"name_template"`
+	InstanceType    string            `json:"instance_type,omitempty" yaml:"instance_type"`
+	SubnetID        string            `json:"subnet_id,omitempty" yaml:"subnet_id"`
+	SecurityGroupID string            `json:"security_group_id,omitempty" yaml:"security_group_id"`
+	AMIFilter       map[string]string `json:"ami_filter,omitempty" yaml:"ami_filter"`
+
+	RootVolumeSize     int64          `json:"root_volume_size,omitempty" yaml:"root_volume_size"`
+	RootVolumeType     string         `json:"root_volume_type,omitempty" yaml:"root_volume_type"`
+	RootVolumeIOPS     int64          `json:"root_volume_iops,omitempty" yaml:"root_volume_iops"`
+	BlockDevices       []*BlockDevice `json:"block_devices,omitempty" yaml:"block_devices"`
+	IAMInstanceProfile string         `json:"iam_instance_profile,omitempty" yaml:"iam_instance_profile"`
+	KeyName            string         `json:"key_name,omitempty" yaml:"key_name"`
+	EBSOptimized       bool           `json:"ebs_optimized,omitempty" yaml:"ebs_optimized"`
+	PlacementGroup     string         `json:"placement_group,omitempty" yaml:"placement_group"`
+	AvailabilityZone   string         `json:"availability_zone,omitempty" yaml:"availability_zone"`
+	SubnetIDs          []string       `json:"subnet_ids,omitempty" yaml:"subnet_ids"`
+	AvailabilityZones  []string       `json:"availability_zones,omitempty" yaml:"availability_zones"`
+	InstanceTypes      []string       `json:"instance_types,omitempty" yaml:"instance_types"`
+	Region             string         `json:"region,omitempty" yaml:"region"`
+	Account            string         `json:"account,omitempty" yaml:"account"`
+}
+
+// DefaultTopology returns the *Topology used when none is configured,
+// which matches the sites, envs, and role historically hard-coded
+func DefaultTopology() *Topology {
+	return &Topology{
+		Sites: []string{"org", "com"},
+		Envs:  []string{"prod", "staging", "test"},
+		Roles: map[string]*RoleDefaults{
+			"worker": &RoleDefaults{
+				NameTemplate: DefaultInstanceNameTemplate,
+				AMIFilter:    map[string]string{"tag:role": "worker"},
+			},
+		},
+		DefaultRole: "worker",
+	}
+}
+
+// ParseTopology parses a yml (or json) topology, returning the
+// default topology when given an empty string
+func ParseTopology(raw string) (*Topology, error) {
+	if strings.TrimSpace(raw) == "" {
+		return DefaultTopology(), nil
+	}
+
+	topo := &Topology{}
+	err := yaml.Unmarshal([]byte(raw), topo)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(topo.Sites) == 0 {
+		return nil, errEmptyTopologySites
+	}
+
+	if len(topo.Envs) == 0 {
+		return nil, errEmptyTopologyEnvs
+	}
+
+	if len(topo.Roles) == 0 {
+		return nil, errEmptyTopologyRoles
+	}
+
+	for role, rd := range topo.Roles {
+		if rd == nil {
+			rd = &RoleDefaults{}
+			topo.Roles[role] = rd
+		}
+
+		if rd.NameTemplate == "" {
+			rd.NameTemplate = DefaultInstanceNameTemplate
+		}
+
+		_, err = template.New(fmt.Sprintf("name-template-%s", role)).Parse(rd.NameTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("roles.%s.name_template: %v", role, err)
+		}
+
+		for _, bd := range rd.BlockDevices {
+			for _, err := range bd.Validate() {
+				return nil, fmt.Errorf("roles.%s.block_devices: %v", role, err)
+			}
+		}
+	}
+
+	if topo.DefaultRole == "" {
+		if len(topo.Roles) > 1 {
+			return nil, errAmbiguousRole
+		}
+
+		for role := range topo.Roles {
+			topo.DefaultRole = role
+		}
+	}
+
+	if _, ok := topo.Roles[topo.DefaultRole]; !ok {
+		return nil, fmt.Errorf("default_role %q is not one of the roles", topo.DefaultRole)
+	}
+
+	return topo, nil
+}
+
+// Validate checks that the site, env, and role are all part of the
+// topology, returning a slice of all errors found.  An empty role is
+// considered valid, as it is replaced by the default role.
+func (topo *Topology) Validate(site, env, role string) []error {
+	errors := []error{}
+	if site != "" && !topo.HasSite(site) {
+		errors = append(errors, fmt.Errorf("site must be one of %s", strings.Join(topo.Sites, ", ")))
+	}
+	if env != "" && !topo.HasEnv(env) {
+		errors = append(errors, fmt.Errorf("env must be one of %s", strings.Join(topo.Envs, ", ")))
+	}
+	if role != "" && !topo.HasRole(role) {
+		errors = append(errors, fmt.Errorf("role must be one of %s", strings.Join(topo.RoleNames(), ", ")))
+	}
+
+	return errors
+}
+
+// ValidateLocation checks that the region, when the topology lists
+// regions, and the account are part of the topology, returning a
+// slice of all errors found.  Empty values are considered valid, as
+// they refer to the workers' own region and account, and so is the
+// workers' own region itself.
+func (topo *Topology) ValidateLocation(region, account string) []error {
+	errors := []error{}
+	if region != "" && region != topo.DefaultRegion && len(topo.Regions) > 0 && !containsString(topo.Regions, region) {
+		regions := topo.Regions
+		if topo.DefaultRegion != "" {
+			regions = append([]string{topo.DefaultRegion}, regions...)
+		}
+		errors = append(errors, fmt.Errorf("region must be one of %s", strings.Join(regions, ", ")))
+	}
+	if _, ok := topo.Accounts[account]; account != "" && !ok {
+		errors = append(errors, fmt.Errorf("account %q is not configured", account))
+	}
+
+	return errors
+}
+
+// HasSite checks if the site is part of the topology
+func (topo *Topology) HasSite(site string) bool {
+	return containsString(topo.Sites, site)
+}
+
+// HasEnv checks if the env is part of the topology
+func (topo *Topology) HasEnv(env string) bool {
+	return containsString(topo.Envs, env)
+}
+
+// HasRole checks if the role is part of the topology
+func (topo *Topology) HasRole(role string) bool {
+	_, ok := topo.Roles[role]
+	return ok
+}
+
+// RoleNames returns the sorted names of all roles
+func (topo *Topology) RoleNames() []string {
+	names := []string{}
+	for role := range topo.Roles {
+		names = append(names, role)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// ApplyDefaults fills in the role of the instance build when empty,
+// along with any of the launch settings, such as name template,
+// instance type, subnet id, or block devices, configured for that role
+func (topo *Topology) ApplyDefaults(b *InstanceBuild) {
+	if b.Role == "" {
+		b.Role = topo.DefaultRole
+	}
+
+	rd, ok := topo.Roles[b.Role]
+	if !ok {
+		rd = &RoleDefaults{}
+	}
+
+	if b.NameTemplate == "" {
+		b.NameTemplate = rd.NameTemplate
+	}
+	if b.NameTemplate == "" {
+		b.NameTemplate = DefaultInstanceNameTemplate
+	}
+	if b.InstanceType == "" && len(b.InstanceTypes) == 0 {
+		b.InstanceType = rd.InstanceType
+		b.InstanceTypes = rd.InstanceTypes
+	}
+	if b.SubnetID == "" && b.AvailabilityZone == "" && len(b.SubnetIDs) == 0 && len(b.AvailabilityZones) == 0 {
+		b.SubnetID = rd.SubnetID
+		b.AvailabilityZone = rd.AvailabilityZone
+		b.SubnetIDs = rd.SubnetIDs
+		b.AvailabilityZones = rd.AvailabilityZones
+	}
+	if b.SecurityGroupID == "" {
+		b.SecurityGroupID = rd.SecurityGroupID
+	}
+	if b.RootVolumeSize == 0 {
+		b.RootVolumeSize = rd.RootVolumeSize
+	}
+	if b.RootVolumeType == "" {
+		b.RootVolumeType = rd.RootVolumeType
+	}
+	if b.RootVolumeIOPS == 0 {
+		b.RootVolumeIOPS = rd.RootVolumeIOPS
+	}
+	if b.BlockDevices == nil {
+		b.BlockDevices = rd.BlockDevices
+	}
+	if b.IAMInstanceProfile == "" {
+		b.IAMInstanceProfile = rd.IAMInstanceProfile
+	}
+	if b.KeyName == "" {
+		b.KeyName = rd.KeyName
+	}
+	if !b.EBSOptimized {
+		b.EBSOptimized = rd.EBSOptimized
+	}
+	if b.PlacementGroup == "" {
+		b.PlacementGroup = rd.PlacementGroup
+	}
+	if b.Region == "" {
+		b.Region = rd.Region
+	}
+	if b.Account == "" {
+		b.Account = rd.Account
+	}
+}
+
+// ImageFilter returns the *ec2.Filter used when looking up images
+// for the role, which defaults to matching the "role" tag
+func (topo *Topology) ImageFilter(role string) *ec2.Filter {
+	f := ec2.NewFilter()
+	if role == "" {
+		return f
+	}
+
+	rd, ok := topo.Roles[role]
+	if !ok || len(rd.AMIFilter) == 0 {
+		f.Add("tag:role", role)
+		return f
+	}
+
+	for key, value := range rd.AMIFilter {
+		f.Add(key, value)
+	}
+
+	return f
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestTopologyValidateLocation(t *testing.T) {
+	topo := &Topology{
+		Regions:       []string{"eu-west-1", "us-west-2"},
+		Accounts:      map[string]string{"enterprise": "arn:aws:iam::123456789012:role/pudding"},
+		DefaultRegion: "us-east-1",
+	}
+
+	for _, c := range []struct {
+		desc     string
+		topo     *Topology
+		region   string
+		account  string
+		expected []string
+	}{
+		{"empty region and account", topo, "", "", []string{}},
+		{"workers' own region", topo, "us-east-1", "", []string{}},
+		{"listed region", topo, "eu-west-1", "", []string{}},
+		{"listed account", topo, "", "enterprise", []string{}},
+		{
+			"unlisted region",
+			topo, "ap-southeast-1", "",
+			[]string{"region must be one of us-east-1, eu-west-1, us-west-2"},
+		},
+		{
+			"unknown account",
+			topo, "", "other",
+			[]string{`account "other" is not configured`},
+		},
+		{"no regions listed", &Topology{DefaultRegion: "us-east-1"}, "ap-southeast-1", "", []string{}},
+		{
+			"no default region known",
+			&Topology{Regions: []string{"eu-west-1"}}, "us-east-1", "",
+			[]string{"region must be one of eu-west-1"},
+		},
+	} {
+		actual := []string{}
+		for _, err := range c.topo.ValidateLocation(c.region, c.account) {
+			actual = append(actual, fmt.Sprintf("%v", err))
+		}
+
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%s: expected errors %q, got %q", c.desc, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package workers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding/lib"
+	"github.com/travis-ci/pudding/lib/db"
+)
+
+const (
+	bootDeadlineConsoleLines = 30
+)
+
+type bootDeadlineChecker struct {
+	cfg *internalConfig
+	log *logrus.Logger
+	n   []lib.Notifier
+	r   *redis.Pool
+}
+
+func newBootDeadlineChecker(cfg *internalConfig, log *logrus.Logger) (*bootDeadlineChecker, error) {
+	r, err := db.BuildRedisPool(cfg.RedisURL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &bootDeadlineChecker{
+		cfg: cfg,
+		log: log,
+		n:   []lib.Notifier{lib.NewSlackNotifier(cfg.SlackHookPath, cfg.SlackUsername, cfg.SlackIcon)},
+		r:   r,
+	}, nil
+}
+
+// Check marks every instance build whose instance was launched but
+// has not reported finished or failed within the boot deadline as
+// timed out, whether or not the build got as far as being started
+func (bdc *bootDeadlineChecker) Check() error {
+	if bdc.cfg.BootDeadline == 0 {
+		return nil
+	}
+
+	conn := bdc.r.Get()
+	defer conn.Close()
+
+	deadline := time.Duration(bdc.cfg.BootDeadline) * time.Second
+	IDs, err := db.FetchBootingInstanceBuildIDs(conn, time.Now().Add(-deadline))
+	if err != nil {
+		return err
+	}
+
+	for _, ID := range IDs {
+		claimed, err := db.ClaimBootingInstanceBuild(conn, ID)
+		if err != nil {
+			return err
+		}
+
+		if !claimed {
+			continue
+		}
+
+		b, err := db.FetchInstanceBuild(conn, ID)
+		if err != nil {
+			return err
+		}
+
+		if b == nil || b.Done() {
+			continue
+		}
+
+		err = bdc.timeOut(conn, b, deadline)
+		if err != nil {
+			bdc.log.WithFields(logrus.Fields{
+				"err":               err,
+				"instance_build_id": ID,
+			}).Error("failed to time out instance build")
+		}
+	}
+
+	return nil
+}
+
+func (bdc *bootDeadlineChecker) timeOut(conn redis.Conn, b *lib.InstanceBuild, deadline time.Duration) error {
+	bdc.log.WithFields(logrus.Fields{
+		"instance_build_id": b.ID,
+		"instance_id":       b.InstanceID,
+		"started_at":        b.StartedAt,
+	}).Warn("instance build missed boot deadline")
+
+	b.State = "timed-out"
+	b.TimedOutAt = time.Now().UTC().Format(time.RFC3339)
+
+	co, coErr := bdc.consoleOutput(conn, b)
+	if coErr == nil {
+		b.ConsoleOutput = co.Output
+	}
+
+	err := db.StoreInstanceBuild(conn, b, bdc.cfg.InstanceBuildStoreExpiry)
+	if err != nil {
+		return err
+	}
+
+	bdc.cfg.Metrics.Inc("pudding_instance_boot_timeouts_total", nil)
+
+	msg := fmt.Sprintf("Instance `%s` for instance build *%s* did not finish booting within %v",
+		b.InstanceID, b.ID, deadline)
+
+	if bdc.cfg.BootDeadlineTerminate && b.InstanceID != "" {
+		err = db.EnqueueInstanceTermination(conn, "instance-terminations", b.InstanceID, b.SlackChannel, "boot-deadline")
+		if err != nil {
+			return err
+		}
+
+		msg = fmt.Sprintf("%s, terminating", msg)
+	}
+
+	if coErr != nil {
+		msg = fmt.Sprintf("%s :skull: _(console output unavailable: %s)_", msg, coErr)
+	} else {
+		msg = fmt.Sprintf("%s :skull:\n```\n%s\n```", msg, co.Tail(bootDeadlineConsoleLines))
+	}
+
+	for _, notifier := range bdc.n {
+		notifier.Notify(b.SlackChannel, msg)
+	}
+
+	return nil
+}
+
+func (bdc *bootDeadlineChecker) consoleOutput(conn redis.Conn, b *lib.InstanceBuild) (*lib.ConsoleOutput, error) {
+	if b.InstanceID == "" {
+		return nil, fmt.Errorf("no instance id")
+	}
+
+	return fetchConsoleOutput(bdc.cfg, conn, b.InstanceID, bdc.cfg.EC2Fleet.Resolve(b.Location()))
+}
@@ -18,11 +18,29 @@ type Config struct {
 	InstanceYML        string
 	InstanceTagRetries int
 
-	InitScriptTemplate string
-	MiniWorkerInterval int
-	InstanceExpiry     int
-	ImageExpiry        int
-	TmpInitExpiry      int
+	InitScriptTemplate  string
+	MiniWorkerInterval  int
+	InstanceExpiry      int
+	ImageExpiry         int
+	InstanceBuildExpiry int
+	TmpInitExpiry       int
+	HistoryExpiry       int
+	InitScriptKeys      string
+	Topology            string
+	TagPolicy           string
+
+	SpotFulfillmentTimeout      int
+	SpotInterruptionReplacement bool
+
+	BootDeadline          int
+	BootDeadlineTerminate bool
+
+	MetricsAddr string
+
+	ImageSelectors       string
+	ImageRetention       string
+	ImageCleanupInterval int
+	ImageCleanupDryRun   bool
 
 	SlackHookPath string
 	SlackUsername string
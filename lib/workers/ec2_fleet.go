@@ -0,0 +1,159 @@
+package workers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/ec2"
+	"github.com/travis-ci/pudding/lib"
+)
+
+const (
+	assumedRoleRefreshMargin = 5 * time.Minute
+)
+
+// ec2Fleet provides ec2 clients for every region and account that
+// instances may be built in, assuming the iam role of each named
+// account as needed
+type ec2Fleet struct {
+	auth          aws.Auth
+	defaultRegion aws.Region
+	regions       []aws.Region
+	accounts      map[string]string
+	sessionName   string
+
+	assumedMutex sync.Mutex
+	assumed      map[string]*lib.AssumedRole
+}
+
+func newEC2Fleet(auth aws.Auth, defaultRegion aws.Region, topo *lib.Topology, sessionName string) (*ec2Fleet, error) {
+	regions := []aws.Region{defaultRegion}
+	for _, name := range topo.Regions {
+		if name == defaultRegion.Name {
+			continue
+		}
+
+		region, ok := aws.Regions[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid region %q", name)
+		}
+
+		regions = append(regions, region)
+	}
+
+	accounts := map[string]string{}
+	for name, roleARN := range topo.Accounts {
+		accounts[name] = roleARN
+	}
+
+	return &ec2Fleet{
+		auth:          auth,
+		defaultRegion: defaultRegion,
+		regions:       regions,
+		accounts:      accounts,
+		sessionName:   sessionName,
+		assumed:       map[string]*lib.AssumedRole{},
+	}, nil
+}
+
+// DefaultLocation is the workers' own region and account
+func (f *ec2Fleet) DefaultLocation() *lib.Location {
+	return &lib.Location{Region: f.defaultRegion.Name}
+}
+
+// Locations returns every region in the default account followed by
+// every region in each named account
+func (f *ec2Fleet) Locations() []*lib.Location {
+	accounts := []string{""}
+	names := []string{}
+	for name := range f.accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	accounts = append(accounts, names...)
+
+	locations := []*lib.Location{}
+	for _, account := range accounts {
+		for _, region := range f.regions {
+			locations = append(locations, &lib.Location{Region: region.Name, Account: account})
+		}
+	}
+
+	return locations
+}
+
+// Resolve fills in the default region for a location without one
+func (f *ec2Fleet) Resolve(loc *lib.Location) *lib.Location {
+	if loc == nil {
+		return f.DefaultLocation()
+	}
+
+	resolved := &lib.Location{Region: loc.Region, Account: loc.Account}
+	if resolved.Region == "" {
+		resolved.Region = f.defaultRegion.Name
+	}
+
+	return resolved
+}
+
+// DefaultClient returns an ec2 client for the workers' own region and
+// account
+func (f *ec2Fleet) DefaultClient() *ec2.EC2 {
+	return ec2.New(f.auth, f.defaultRegion)
+}
+
+// Client returns an ec2 client for the given location, where empty
+// values refer to the workers' own region and account
+func (f *ec2Fleet) Client(loc *lib.Location) (*ec2.EC2, error) {
+	loc = f.Resolve(loc)
+
+	var region aws.Region
+	found := false
+	for _, r := range f.regions {
+		if r.Name == loc.Region {
+			region, found = r, true
+			break
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("region %q is not configured", loc.Region)
+	}
+
+	if loc.Account == "" {
+		return ec2.New(f.auth, region), nil
+	}
+
+	auth, err := f.accountAuth(loc.Account)
+	if err != nil {
+		return nil, err
+	}
+
+	return ec2.New(auth, region), nil
+}
+
+func (f *ec2Fleet) accountAuth(account string) (aws.Auth, error) {
+	roleARN, ok := f.accounts[account]
+	if !ok {
+		return aws.Auth{}, fmt.Errorf("account %q is not configured", account)
+	}
+
+	f.assumedMutex.Lock()
+	defer f.assumedMutex.Unlock()
+
+	assumed, ok := f.assumed[account]
+	if ok && time.Now().Add(assumedRoleRefreshMargin).Before(assumed.Expiration) {
+		return assumed.Auth, nil
+	}
+
+	assumed, err := lib.AssumeRole(f.auth, roleARN, f.sessionName)
+	if err != nil {
+		return aws.Auth{}, err
+	}
+
+	f.assumed[account] = assumed
+	return assumed.Auth, nil
+}
@@ -1,21 +1,44 @@
 package workers
 
 import (
+	"fmt"
 	"net"
 	"net/url"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/feeds"
 	"github.com/mitchellh/goamz/ec2"
 	"github.com/travis-ci/pudding/lib"
 	"github.com/travis-ci/pudding/lib/db"
 )
 
+var (
+	// spotInterruptionStatusCodes are the spot request status codes
+	// set when ec2 terminates a spot instance, as opposed to it being
+	// terminated by us
+	spotInterruptionStatusCodes = []string{
+		"instance-terminated-by-price",
+		"instance-terminated-no-capacity",
+		"instance-terminated-capacity-oversubscribed",
+		"instance-terminated-launch-group-constraint",
+	}
+)
+
 type ec2Syncer struct {
 	cfg *internalConfig
-	ec2 *ec2.EC2
 	log *logrus.Logger
+	n   []lib.Notifier
+	r   *redis.Pool
 	i   db.InstanceFetcherStorer
 	img db.ImageFetcherStorer
+	sib db.SpotInstanceBuildFetcherStorer
+	h   db.HistoryFetcherStorer
+
+	// missing are the ids of the stored instances not found by the
+	// previous sync that ec2 did not confirm terminated
+	missing map[string]bool
 }
 
 func newEC2Syncer(cfg *internalConfig, log *logrus.Logger) (*ec2Syncer, error) {
@@ -29,59 +52,123 @@ func newEC2Syncer(cfg *internalConfig, log *logrus.Logger) (*ec2Syncer, error) {
 		return nil, err
 	}
 
+	sib, err := db.NewSpotInstanceBuilds(cfg.RedisURL.String(), log)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := db.NewHistory(cfg.RedisURL.String(), log, cfg.HistoryStoreExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := db.BuildRedisPool(cfg.RedisURL.String())
+	if err != nil {
+		return nil, err
+	}
+
 	return &ec2Syncer{
 		cfg: cfg,
 		log: log,
+		n:   []lib.Notifier{lib.NewSlackNotifier(cfg.SlackHookPath, cfg.SlackUsername, cfg.SlackIcon)},
+		r:   r,
 		i:   i,
 		img: img,
-		ec2: ec2.New(cfg.AWSAuth, cfg.AWSRegion),
+		sib: sib,
+		h:   h,
+
+		missing: map[string]bool{},
 	}, nil
 }
 
 func (es *ec2Syncer) Sync() error {
 	var (
 		instances map[string]ec2.Instance
-		images    map[string]ec2.Image
 		err       error
 	)
 
-	es.log.Debug("ec2 syncer fetching instances")
-	for i := 3; i > 0; i-- {
-		instances, err = es.fetchInstances()
-		if err == nil {
-			break
+	start := time.Now()
+	current := map[string]*lib.Instance{}
+	synced := []*lib.Location{}
+
+	for _, loc := range es.cfg.EC2Fleet.Locations() {
+		client, err := es.cfg.EC2Fleet.Client(loc)
+		if err != nil {
+			es.log.WithFields(logrus.Fields{
+				"location": loc.String(),
+				"err":      err,
+			}).Error("ec2 syncer failed to get ec2 client; leaving stored instances in place")
+			continue
+		}
+
+		es.log.WithField("location", loc.String()).Debug("ec2 syncer fetching instances")
+		for i := 3; i > 0; i-- {
+			instances, err = es.fetchInstances(client)
+			if err == nil {
+				break
+			}
+		}
+
+		if err != nil {
+			es.log.WithFields(logrus.Fields{
+				"location": loc.String(),
+				"err":      err,
+			}).Error("ec2 syncer failed to fetch instances; leaving stored instances in place")
+			continue
+		}
+
+		if instances == nil {
+			es.log.WithField("location", loc.String()).Debug("ec2 syncer failed to get any instances; assuming temporary network error")
+			continue
 		}
+
+		for ID, inst := range instances {
+			current[ID] = lib.NewInstanceFromEC2(inst, loc)
+		}
+
+		synced = append(synced, loc)
 	}
 
-	if err != nil {
-		panic(err)
+	if len(synced) == 0 {
+		es.log.Debug("ec2 syncer failed to fetch instances in any location")
+		return nil
 	}
 
-	if instances == nil {
-		es.log.Debug("ec2 syncer failed to get any instances; assuming temporary network error")
+	es.log.Debug("ec2 syncer confirming missing instances")
+	err = es.keepUnconfirmed(current, synced)
+	if err != nil {
+		es.log.WithField("err", err).Error("ec2 syncer failed to confirm missing instances; leaving stored instances in place")
 		return nil
 	}
 
+	es.log.Debug("ec2 syncer applying instance state reasons")
+	err = es.applyStateReasons(current)
+	if err != nil {
+		es.log.WithField("err", err).Error("ec2 syncer failed to apply instance state reasons")
+	}
+
 	es.log.Debug("ec2 syncer storing instances")
-	err = es.i.Store(instances)
+	events, err := es.i.Sync(current, synced)
 	if err != nil {
 		panic(err)
 	}
 
-	es.log.Debug("ec2 syncer fetching images")
-	for i := 3; i > 0; i-- {
-		images, err = es.fetchImages()
-		if err == nil {
-			break
-		}
+	es.emitEvents(events)
+
+	es.log.Debug("ec2 syncer checking spot instances")
+	err = es.checkSpotInstances(current, synced)
+	if err != nil {
+		es.log.WithField("err", err).Error("ec2 syncer failed to check spot instances")
 	}
 
+	es.log.Debug("ec2 syncer fetching images")
+	images, err := es.fetchAllImages()
 	if err != nil {
 		panic(err)
 	}
 
 	if images == nil {
-		es.log.Debug("ec2 syncer failed to get any images; assuming temporary network error")
+		es.log.Debug("ec2 syncer failed to get images in any location")
 		return nil
 	}
 
@@ -91,13 +178,171 @@ func (es *ec2Syncer) Sync() error {
 		panic(err)
 	}
 
+	es.recordMetrics(current, images)
+	es.cfg.Metrics.Observe("pudding_ec2_sync_duration_seconds", nil, time.Since(start).Seconds())
 	return nil
 }
 
-func (es *ec2Syncer) fetchInstances() (map[string]ec2.Instance, error) {
+// keepUnconfirmed adds to the current instances those stored for the
+// synced locations that were not found, unless ec2 confirms that they
+// are terminated or they were not found by the previous sync either,
+// so that a partial response from ec2 does not drop any instances
+func (es *ec2Syncer) keepUnconfirmed(current map[string]*lib.Instance, synced []*lib.Location) error {
+	stored, err := es.i.Fetch(map[string]string{})
+	if err != nil {
+		return err
+	}
+
+	syncedLocations := map[string]bool{}
+	for _, loc := range synced {
+		syncedLocations[loc.String()] = true
+	}
+
+	missing := map[string][]string{}
+	missingLocations := map[string]*lib.Location{}
+	missingInstances := map[string]*lib.Instance{}
+	for _, inst := range stored {
+		if _, ok := current[inst.InstanceID]; ok {
+			continue
+		}
+
+		key := ""
+		var loc *lib.Location
+		if inst.Region != "" {
+			loc = inst.Location()
+			key = loc.String()
+			if !syncedLocations[key] {
+				continue
+			}
+		}
+
+		missing[key] = append(missing[key], inst.InstanceID)
+		missingLocations[key] = loc
+		missingInstances[inst.InstanceID] = inst
+	}
+
+	stillMissing := map[string]bool{}
+	for key, instanceIDs := range missing {
+		terminated, err := es.fetchTerminatedInstances(missingLocations[key], instanceIDs)
+		if err != nil {
+			es.log.WithFields(logrus.Fields{
+				"location": key,
+				"err":      err,
+			}).Warn("ec2 syncer failed to confirm missing instances terminated")
+		}
+
+		for _, instanceID := range instanceIDs {
+			if _, ok := terminated[instanceID]; ok || es.missing[instanceID] {
+				continue
+			}
+
+			es.log.WithField("instance_id", instanceID).Debug("ec2 syncer keeping unconfirmed missing instance")
+			current[instanceID] = missingInstances[instanceID]
+			stillMissing[instanceID] = true
+		}
+	}
+
+	es.missing = stillMissing
+	return nil
+}
+
+func (es *ec2Syncer) fetchTerminatedInstances(loc *lib.Location, instanceIDs []string) (map[string]ec2.Instance, error) {
+	client, err := es.cfg.EC2Fleet.Client(loc)
+	if err != nil {
+		return nil, err
+	}
+
 	f := ec2.NewFilter()
-	f.Add("instance-state-name", "running")
-	instances, err := lib.GetInstancesWithFilter(es.ec2, f)
+	f.Add("instance-id", instanceIDs...)
+	f.Add("instance-state-name", "terminated")
+
+	return lib.GetInstancesWithFilter(client, f)
+}
+
+func (es *ec2Syncer) applyStateReasons(instances map[string]*lib.Instance) error {
+	conn := es.r.Get()
+	defer conn.Close()
+
+	return db.ApplyInstanceStateReasons(conn, instances)
+}
+
+// emitEvents logs and counts each instance event found by the sync,
+// and adds removed instances to the instance history unless already
+// recorded there by the termination worker
+func (es *ec2Syncer) emitEvents(events []*lib.InstanceEvent) {
+	for _, event := range events {
+		fields := logrus.Fields{
+			"instance_id": event.InstanceID,
+			"event":       event.Type,
+		}
+		for attr, change := range event.Changes {
+			fields[attr] = fmt.Sprintf("%q -> %q", change.Old, change.New)
+		}
+
+		es.log.WithFields(fields).Info("ec2 syncer found instance event")
+		es.cfg.Metrics.Inc("pudding_instance_events_total", map[string]string{"type": event.Type})
+
+		if event.Type == "removed" && event.Instance != nil {
+			es.storeHistory(event)
+		}
+	}
+}
+
+func (es *ec2Syncer) storeHistory(event *lib.InstanceEvent) {
+	at, err := time.Parse(time.RFC3339, event.Time)
+	if err != nil {
+		at = time.Now()
+	}
+
+	event.Instance.MarkTerminated("", at)
+
+	_, err = es.h.StoreInstance(event.Instance)
+	if err != nil {
+		es.log.WithFields(logrus.Fields{
+			"err":         err,
+			"instance_id": event.InstanceID,
+		}).Error("ec2 syncer failed to store terminated instance history")
+	}
+}
+
+// recordMetrics sets the gauges of instances by site, env, queue,
+// role, and state, and of images by role and active state
+func (es *ec2Syncer) recordMetrics(instances map[string]*lib.Instance, images map[string]*lib.Image) {
+	instanceCounts := map[string]map[string]string{}
+	counts := map[string]int{}
+	for _, inst := range instances {
+		labels := map[string]string{"site": inst.Site, "env": inst.Env, "queue": inst.Queue, "role": inst.Role, "state": inst.State}
+
+		key := fmt.Sprintf("%s:%s:%s:%s:%s", labels["site"], labels["env"], labels["queue"], labels["role"], labels["state"])
+		instanceCounts[key] = labels
+		counts[key]++
+	}
+
+	es.cfg.Metrics.Reset("pudding_instances")
+	for key, labels := range instanceCounts {
+		es.cfg.Metrics.Set("pudding_instances", labels, float64(counts[key]))
+	}
+
+	imageCounts := map[string]map[string]string{}
+	counts = map[string]int{}
+	for _, image := range images {
+		labels := map[string]string{"role": image.Role, "active": fmt.Sprintf("%v", image.Active)}
+
+		key := fmt.Sprintf("%s:%s", labels["role"], labels["active"])
+		imageCounts[key] = labels
+		counts[key]++
+	}
+
+	es.cfg.Metrics.Reset("pudding_images")
+	for key, labels := range imageCounts {
+		es.cfg.Metrics.Set("pudding_images", labels, float64(counts[key]))
+	}
+}
+
+func (es *ec2Syncer) fetchInstances(client *ec2.EC2) (map[string]ec2.Instance, error) {
+	f := ec2.NewFilter()
+	f.Add("instance-state-name", lib.InstanceStates...)
+	instances, err := lib.GetInstancesWithFilter(client, f)
 	if err == nil {
 		return instances, nil
 	}
@@ -111,10 +356,83 @@ func (es *ec2Syncer) fetchInstances() (map[string]ec2.Instance, error) {
 	}
 }
 
-func (es *ec2Syncer) fetchImages() (map[string]ec2.Image, error) {
+// fetchAllImages fetches the images with a role tag in every location,
+// keeping those stored for any location whose images cannot be
+// fetched, or returns nil when they cannot be fetched in any location
+func (es *ec2Syncer) fetchAllImages() (map[string]*lib.Image, error) {
+	locations := es.cfg.EC2Fleet.Locations()
+	current := map[string]*lib.Image{}
+	unsynced := map[string]bool{}
+
+	for _, loc := range locations {
+		client, err := es.cfg.EC2Fleet.Client(loc)
+		if err != nil {
+			es.log.WithFields(logrus.Fields{
+				"location": loc.String(),
+				"err":      err,
+			}).Error("ec2 syncer failed to get ec2 client; leaving stored images in place")
+			unsynced[loc.String()] = true
+			continue
+		}
+
+		var images map[string]ec2.Image
+		for i := 3; i > 0; i-- {
+			images, err = es.fetchImages(client)
+			if err == nil {
+				break
+			}
+		}
+
+		if err != nil {
+			es.log.WithFields(logrus.Fields{
+				"location": loc.String(),
+				"err":      err,
+			}).Error("ec2 syncer failed to fetch images; leaving stored images in place")
+			unsynced[loc.String()] = true
+			continue
+		}
+
+		if images == nil {
+			es.log.WithField("location", loc.String()).Debug("ec2 syncer failed to get any images; assuming temporary network error")
+			unsynced[loc.String()] = true
+			continue
+		}
+
+		for ID, img := range images {
+			current[ID] = lib.NewImageFromEC2(img, loc)
+		}
+	}
+
+	if len(unsynced) == len(locations) {
+		return nil, nil
+	}
+
+	if len(unsynced) == 0 {
+		return current, nil
+	}
+
+	stored, err := es.img.Fetch(map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, img := range stored {
+		if _, ok := current[img.ImageID]; ok {
+			continue
+		}
+
+		if unsynced[es.cfg.EC2Fleet.Resolve(img.Location()).String()] {
+			current[img.ImageID] = img
+		}
+	}
+
+	return current, nil
+}
+
+func (es *ec2Syncer) fetchImages(client *ec2.EC2) (map[string]ec2.Image, error) {
 	f := ec2.NewFilter()
 	f.Add("tag-key", "role")
-	images, err := lib.GetImagesWithFilter(es.ec2, f)
+	images, err := lib.GetImagesWithFilter(client, f)
 	if err == nil {
 		return images, nil
 	}
@@ -127,3 +445,145 @@ func (es *ec2Syncer) fetchImages() (map[string]ec2.Image, error) {
 		return nil, err
 	}
 }
+
+// checkSpotInstances looks up the spot instances launched for
+// instance builds in the synced locations that are no longer found,
+// and handles those that were terminated by ec2 as interruptions
+func (es *ec2Syncer) checkSpotInstances(current map[string]*lib.Instance, synced []*lib.Location) error {
+	builds, err := es.sib.Fetch()
+	if err != nil {
+		return err
+	}
+
+	syncedLocations := map[string]bool{}
+	for _, loc := range synced {
+		syncedLocations[loc.String()] = true
+	}
+
+	missing := map[string][]string{}
+	missingLocations := map[string]*lib.Location{}
+	for instanceID, b := range builds {
+		if _, ok := current[instanceID]; ok {
+			continue
+		}
+
+		loc := es.cfg.EC2Fleet.Resolve(b.Location())
+		if !syncedLocations[loc.String()] {
+			continue
+		}
+
+		missing[loc.String()] = append(missing[loc.String()], instanceID)
+		missingLocations[loc.String()] = loc
+	}
+
+	for key, instanceIDs := range missing {
+		err = es.checkMissingSpotInstances(missingLocations[key], instanceIDs, builds)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkMissingSpotInstances handles the spot instances in a single
+// location that are no longer running
+func (es *ec2Syncer) checkMissingSpotInstances(loc *lib.Location, missing []string, builds map[string]*lib.InstanceBuild) error {
+	client, err := es.cfg.EC2Fleet.Client(loc)
+	if err != nil {
+		return err
+	}
+
+	f := ec2.NewFilter()
+	f.Add("instance-id", missing...)
+	f.Add("instance-state-name", "shutting-down", "terminated")
+
+	gone, err := lib.GetInstancesWithFilter(client, f)
+	if err != nil {
+		return err
+	}
+
+	if len(gone) == 0 {
+		return nil
+	}
+
+	goneIDs := []string{}
+	for instanceID := range gone {
+		goneIDs = append(goneIDs, instanceID)
+	}
+
+	sf := ec2.NewFilter()
+	sf.Add("instance-id", goneIDs...)
+	sf.Add("status-code", spotInterruptionStatusCodes...)
+
+	resp, err := client.DescribeSpotRequests([]string{}, sf)
+	if err != nil {
+		return err
+	}
+
+	interrupted := map[string]bool{}
+	for _, result := range resp.SpotRequestResults {
+		interrupted[result.InstanceId] = true
+	}
+
+	for _, instanceID := range goneIDs {
+		claimed, err := es.sib.Claim(instanceID)
+		if err != nil {
+			return err
+		}
+
+		if !claimed || !interrupted[instanceID] {
+			continue
+		}
+
+		err = es.handleSpotInterruption(instanceID, builds[instanceID])
+		if err != nil {
+			es.log.WithFields(logrus.Fields{
+				"err":         err,
+				"instance_id": instanceID,
+			}).Error("failed to handle spot interruption")
+		}
+	}
+
+	return nil
+}
+
+func (es *ec2Syncer) handleSpotInterruption(instanceID string, b *lib.InstanceBuild) error {
+	es.log.WithFields(logrus.Fields{
+		"instance_id":       instanceID,
+		"instance_build_id": b.ID,
+	}).Warn("spot instance interrupted")
+
+	msg := fmt.Sprintf("Spot instance `%s` for instance build *%s* was interrupted", instanceID, b.ID)
+	if !es.cfg.SpotInterruptionReplacement {
+		es.notify(b.SlackChannel, msg)
+		return nil
+	}
+
+	rb := *b
+	rb.ID = feeds.NewUUID().String()
+	rb.State = "pending"
+	rb.InstanceID, rb.IP, rb.PrivateIP, rb.PurchaseType = "", "", "", ""
+
+	conn := es.r.Get()
+	defer conn.Close()
+
+	err := db.StoreInstanceBuild(conn, &rb, es.cfg.InstanceBuildStoreExpiry)
+	if err != nil {
+		return err
+	}
+
+	err = db.EnqueueInstanceBuild(conn, "instance-builds", &rb)
+	if err != nil {
+		return err
+	}
+
+	es.notify(b.SlackChannel, fmt.Sprintf("%s, replacing with instance build *%s*", msg, rb.ID))
+	return nil
+}
+
+func (es *ec2Syncer) notify(channel, msg string) {
+	for _, notifier := range es.n {
+		notifier.Notify(channel, msg)
+	}
+}
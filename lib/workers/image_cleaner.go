@@ -0,0 +1,323 @@
+package workers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/mitchellh/goamz/ec2"
+	"github.com/travis-ci/pudding/lib"
+	"github.com/travis-ci/pudding/lib/db"
+)
+
+type imageCleaner struct {
+	cfg *internalConfig
+	log *logrus.Logger
+	r   *redis.Pool
+	i   db.InstanceFetcherStorer
+	ip  db.ImagePinFetcherStorer
+	h   db.HistoryFetcherStorer
+}
+
+func newImageCleaner(cfg *internalConfig, log *logrus.Logger) (*imageCleaner, error) {
+	r, err := db.BuildRedisPool(cfg.RedisURL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := db.NewInstances(cfg.RedisURL.String(), log, cfg.InstanceStoreExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := db.NewImagePins(cfg.RedisURL.String(), log)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := db.NewHistory(cfg.RedisURL.String(), log, cfg.HistoryStoreExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &imageCleaner{
+		cfg: cfg,
+		log: log,
+		r:   r,
+		i:   i,
+		ip:  ip,
+		h:   h,
+	}, nil
+}
+
+func (ic *imageCleaner) Clean() error {
+	if len(ic.cfg.ImageRetention) == 0 {
+		return nil
+	}
+
+	conn := ic.r.Get()
+	defer conn.Close()
+
+	// the lock doubles as the interval between cleanups across all
+	// worker processes, so it is never explicitly released
+	reply, err := conn.Do("SET", fmt.Sprintf("%s:image-cleanup:lock", lib.RedisNamespace),
+		ic.cfg.ProcessID, "EX", ic.cfg.ImageCleanupInterval, "NX")
+	if err != nil {
+		return err
+	}
+
+	if reply == nil {
+		ic.log.Debug("image cleanup ran recently, skipping")
+		return nil
+	}
+
+	inUse, err := ic.imagesInUse()
+	if err != nil {
+		return err
+	}
+
+	pinned, err := ic.pinnedImages()
+	if err != nil {
+		return err
+	}
+
+	for role, keep := range ic.cfg.ImageRetention {
+		report, err := ic.cleanRole(role, keep, inUse, pinned)
+		if err != nil {
+			ic.log.WithFields(logrus.Fields{
+				"err":  err,
+				"role": role,
+			}).Error("failed to clean images")
+			continue
+		}
+
+		err = db.StoreImageCleanupReport(conn, report)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// imageCleanupLocation is the images for a role found in a single
+// region and account, along with the client for that location
+type imageCleanupLocation struct {
+	loc    *lib.Location
+	client *ec2.EC2
+	images map[string]ec2.Image
+}
+
+func (icl *imageCleanupLocation) imageList() []*lib.Image {
+	images := []*lib.Image{}
+	for _, img := range icl.images {
+		images = append(images, lib.NewImageFromEC2(img, icl.loc))
+	}
+
+	return images
+}
+
+func (ic *imageCleaner) cleanRole(role string, keep int, inUse, pinned map[string]bool) (*lib.ImageCleanupReport, error) {
+	sel := lib.ImageSelectorForRole(ic.cfg.ImageSelectors, role)
+	locations := []*imageCleanupLocation{}
+	seen := map[string]bool{}
+
+	for _, loc := range ic.cfg.EC2Fleet.Locations() {
+		client, err := ic.cfg.EC2Fleet.Client(loc)
+		if err != nil {
+			return nil, err
+		}
+
+		ec2Images, err := lib.GetImagesWithFilter(client, ic.cfg.Topology.ImageFilter(role))
+		if err != nil {
+			return nil, err
+		}
+
+		// an image shared with another account is only cleaned up
+		// from the first location it is found in
+		for ID := range ec2Images {
+			if seen[ID] {
+				delete(ec2Images, ID)
+				continue
+			}
+			seen[ID] = true
+		}
+
+		locations = append(locations, &imageCleanupLocation{loc: loc, client: client, images: ec2Images})
+	}
+
+	candidates := []string{}
+	for _, icl := range locations {
+		for _, entry := range lib.PlanImageCleanup(role, keep, icl.imageList(), inUse, pinned, sel).Removed {
+			candidates = append(candidates, entry.ImageID)
+		}
+	}
+
+	// the images that would be removed are checked against ec2
+	// directly, and the cleanup of the role is skipped if that fails
+	allInUse, err := ic.liveImagesInUse(candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	for ID := range inUse {
+		allInUse[ID] = true
+	}
+
+	report := &lib.ImageCleanupReport{
+		Role:        role,
+		Keep:        keep,
+		DryRun:      ic.cfg.ImageCleanupDryRun,
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+		Kept:        []*lib.ImageCleanupEntry{},
+		Removed:     []*lib.ImageCleanupEntry{},
+	}
+
+	deregistered := []string{}
+
+	for _, icl := range locations {
+		plan := lib.PlanImageCleanup(role, keep, icl.imageList(), allInUse, pinned, sel)
+
+		for _, entry := range plan.Kept {
+			entry.Region, entry.Account = icl.loc.Region, icl.loc.Account
+			report.Kept = append(report.Kept, entry)
+		}
+
+		for _, entry := range plan.Removed {
+			entry.Region, entry.Account = icl.loc.Region, icl.loc.Account
+			report.Removed = append(report.Removed, entry)
+
+			if ic.removeImage(role, icl, entry, report.DryRun) {
+				deregistered = append(deregistered, entry.ImageID)
+			}
+		}
+	}
+
+	if len(deregistered) > 0 {
+		conn := ic.r.Get()
+		defer conn.Close()
+
+		err = db.RemoveImages(conn, deregistered)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// removeImage deregisters the image of the entry and deletes its
+// snapshots, returning true if the image was deregistered
+func (ic *imageCleaner) removeImage(role string, icl *imageCleanupLocation, entry *lib.ImageCleanupEntry, dryRun bool) bool {
+	for _, bd := range icl.images[entry.ImageID].BlockDevices {
+		if bd.SnapshotId != "" {
+			entry.SnapshotIDs = append(entry.SnapshotIDs, bd.SnapshotId)
+		}
+	}
+
+	ic.log.WithFields(logrus.Fields{
+		"role":         role,
+		"image_id":     entry.ImageID,
+		"region":       icl.loc.Region,
+		"account":      icl.loc.Account,
+		"snapshot_ids": entry.SnapshotIDs,
+		"reason":       entry.Reason,
+		"dry_run":      dryRun,
+	}).Info("cleaning up image")
+
+	if dryRun {
+		return false
+	}
+
+	_, err := icl.client.DeregisterImage(entry.ImageID)
+	if err != nil {
+		entry.Error = err.Error()
+		return false
+	}
+
+	ic.storeHistory(lib.NewImageFromEC2(icl.images[entry.ImageID], icl.loc))
+
+	if len(entry.SnapshotIDs) == 0 {
+		return true
+	}
+
+	_, err = icl.client.DeleteSnapshots(entry.SnapshotIDs)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	return true
+}
+
+func (ic *imageCleaner) storeHistory(img *lib.Image) {
+	img.MarkDeregistered("image-cleanup", time.Now())
+
+	_, err := ic.h.StoreImage(img)
+	if err != nil {
+		ic.log.WithFields(logrus.Fields{
+			"err":      err,
+			"image_id": img.ImageID,
+		}).Error("failed to store deregistered image history")
+	}
+}
+
+func (ic *imageCleaner) imagesInUse() (map[string]bool, error) {
+	instances, err := ic.i.Fetch(map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := map[string]bool{}
+	for _, inst := range instances {
+		inUse[inst.ImageID] = true
+	}
+
+	return inUse, nil
+}
+
+// liveImagesInUse asks ec2 in every location which of the given
+// images are used by an instance that is not terminated, so that
+// images are not removed based on a stale or empty instance inventory
+func (ic *imageCleaner) liveImagesInUse(imageIDs []string) (map[string]bool, error) {
+	inUse := map[string]bool{}
+	if len(imageIDs) == 0 {
+		return inUse, nil
+	}
+
+	for _, loc := range ic.cfg.EC2Fleet.Locations() {
+		client, err := ic.cfg.EC2Fleet.Client(loc)
+		if err != nil {
+			return nil, err
+		}
+
+		f := ec2.NewFilter()
+		f.Add("image-id", imageIDs...)
+		f.Add("instance-state-name", "pending", "running", "shutting-down", "stopping", "stopped")
+
+		instances, err := lib.GetInstancesWithFilter(client, f)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, inst := range instances {
+			inUse[inst.ImageId] = true
+		}
+	}
+
+	return inUse, nil
+}
+
+func (ic *imageCleaner) pinnedImages() (map[string]bool, error) {
+	pins, err := ic.ip.Fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := map[string]bool{}
+	for _, pin := range pins {
+		pinned[pin.ImageID] = true
+	}
+
+	return pinned, nil
+}
@@ -0,0 +1,120 @@
+package workers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/jrallison/go-workers"
+	"github.com/mitchellh/goamz/ec2"
+	"github.com/travis-ci/pudding/lib"
+	"github.com/travis-ci/pudding/lib/db"
+)
+
+func init() {
+	defaultQueueFuncs["image-updates"] = imageUpdatesMain
+}
+
+func imageUpdatesMain(cfg *internalConfig, msg *workers.Msg) {
+	log.WithFields(logrus.Fields{
+		"jid": msg.Jid(),
+	}).Debug("starting processing of image update job")
+
+	updatePayloadJSON := []byte(msg.OriginalJson())
+	updatePayload := &lib.ImageUpdatePayload{}
+
+	err := json.Unmarshal(updatePayloadJSON, updatePayload)
+	if err != nil {
+		log.WithField("err", err).Panic("failed to deserialize message")
+	}
+
+	err = newImageUpdaterWorker(updatePayload.ImageID, updatePayload.Active, updatePayload.SlackChannel,
+		cfg, msg.Jid(), workers.Config.Pool.Get()).Update()
+	if err != nil {
+		log.WithField("err", err).Panic("image update failed")
+	}
+}
+
+type imageUpdaterWorker struct {
+	rc     redis.Conn
+	jid    string
+	nc     string
+	n      []lib.Notifier
+	imgID  string
+	active bool
+	cfg    *internalConfig
+}
+
+func newImageUpdaterWorker(imageID string, active bool, slackChannel string, cfg *internalConfig, jid string, redisConn redis.Conn) *imageUpdaterWorker {
+	notifier := lib.NewSlackNotifier(cfg.SlackHookPath, cfg.SlackUsername, cfg.SlackIcon)
+
+	return &imageUpdaterWorker{
+		rc:     redisConn,
+		jid:    jid,
+		cfg:    cfg,
+		nc:     slackChannel,
+		n:      []lib.Notifier{notifier},
+		imgID:  imageID,
+		active: active,
+	}
+}
+
+func (iuw *imageUpdaterWorker) Update() error {
+	loc, err := iuw.imageLocation()
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"jid":      iuw.jid,
+		"image_id": iuw.imgID,
+		"active":   iuw.active,
+		"location": loc.String(),
+	}).Debug("tagging image")
+
+	client, err := iuw.cfg.EC2Fleet.Client(loc)
+	if err == nil {
+		_, err = client.CreateTags([]string{iuw.imgID}, []ec2.Tag{
+			ec2.Tag{Key: "active", Value: fmt.Sprintf("%v", iuw.active)},
+		})
+	}
+	if err != nil {
+		for _, notifier := range iuw.n {
+			notifier.Notify(iuw.nc, fmt.Sprintf("Failed to update image *%s* :scream_cat: _(%s)_", iuw.imgID, err))
+		}
+		return err
+	}
+
+	err = db.SetImageActive(iuw.rc, iuw.imgID, iuw.active)
+	if err != nil {
+		return err
+	}
+
+	verb := "Retired"
+	if iuw.active {
+		verb = "Promoted"
+	}
+
+	for _, notifier := range iuw.n {
+		notifier.Notify(iuw.nc, fmt.Sprintf("%s image *%s*", verb, iuw.imgID))
+	}
+	return nil
+}
+
+// imageLocation returns the location the image was synced from, or
+// the workers' own region and account for an image not synced yet
+func (iuw *imageUpdaterWorker) imageLocation() (*lib.Location, error) {
+	images, err := db.FetchImages(iuw.rc, map[string]string{"image_id": iuw.imgID})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, img := range images {
+		if img.ImageID == iuw.imgID {
+			return iuw.cfg.EC2Fleet.Resolve(img.Location()), nil
+		}
+	}
+
+	return iuw.cfg.EC2Fleet.DefaultLocation(), nil
+}
@@ -6,8 +6,8 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/url"
+	"sort"
 	"text/template"
 	"time"
 
@@ -20,6 +20,11 @@ import (
 	"github.com/travis-ci/pudding/lib/db"
 )
 
+var (
+	errNoCapacity = fmt.Errorf("insufficient capacity for all instance types and placements")
+	errNoSpot     = fmt.Errorf("no spot request fulfilled within the spot timeout")
+)
+
 func init() {
 	defaultQueueFuncs["instance-builds"] = instanceBuildsMain
 }
@@ -37,11 +42,27 @@ func instanceBuildsMain(cfg *internalConfig, msg *workers.Msg) {
 		log.WithField("err", err).Panic("failed to deserialize message")
 	}
 
-	err = newInstanceBuilderWorker(buildPayload.InstanceBuild(),
-		cfg, msg.Jid(), workers.Config.Pool.Get()).Build()
+	b := buildPayload.InstanceBuild()
+	cfg.Topology.ApplyDefaults(b)
+
+	start := time.Now()
+	ibw := newInstanceBuilderWorker(b, cfg, msg.Jid(), workers.Config.Pool.Get())
+
+	err = ibw.Build()
 	if err != nil {
+		cfg.Metrics.Inc("pudding_instance_builds_total", map[string]string{"outcome": "failure"})
+		cfg.Metrics.Inc("pudding_instance_build_failures_total", map[string]string{"step": ibw.step})
+		cfg.Metrics.Observe("pudding_instance_build_duration_seconds",
+			map[string]string{"outcome": "failure"}, time.Since(start).Seconds())
+		if ibw.i != nil {
+			ibw.captureConsole()
+		}
 		log.WithField("err", err).Panic("instance build failed")
 	}
+
+	cfg.Metrics.Inc("pudding_instance_builds_total", map[string]string{"outcome": "success"})
+	cfg.Metrics.Observe("pudding_instance_build_duration_seconds",
+		map[string]string{"outcome": "success"}, time.Since(start).Seconds())
 }
 
 type instanceBuilderWorker struct {
@@ -50,12 +71,24 @@ type instanceBuilderWorker struct {
 	jid    string
 	cfg    *internalConfig
 	ec2    *ec2.EC2
+	runner instanceRunner
 	sg     *ec2.SecurityGroup
 	sgName string
 	ami    *ec2.Image
 	b      *lib.InstanceBuild
 	i      *ec2.Instance
 	t      *template.Template
+
+	capacityFailures int
+	launchedAt       time.Time
+
+	step      string
+	stepStart time.Time
+}
+
+// instanceRunner launches on-demand instances, as done by *ec2.EC2
+type instanceRunner interface {
+	RunInstances(*ec2.RunInstances) (*ec2.RunInstancesResp, error)
 }
 
 func newInstanceBuilderWorker(b *lib.InstanceBuild, cfg *internalConfig, jid string, redisConn redis.Conn) *instanceBuilderWorker {
@@ -67,7 +100,6 @@ func newInstanceBuilderWorker(b *lib.InstanceBuild, cfg *internalConfig, jid str
 		cfg: cfg,
 		n:   []lib.Notifier{notifier},
 		b:   b,
-		ec2: ec2.New(cfg.AWSAuth, cfg.AWSRegion),
 		t:   cfg.InitScriptTemplate,
 	}
 
@@ -78,17 +110,40 @@ func newInstanceBuilderWorker(b *lib.InstanceBuild, cfg *internalConfig, jid str
 func (ibw *instanceBuilderWorker) Build() error {
 	var err error
 
-	f := ec2.NewFilter()
-	if ibw.b.Role != "" {
-		f.Add("tag:role", ibw.b.Role)
+	ibw.beginStep("ec2-client")
+	loc := ibw.cfg.EC2Fleet.Resolve(ibw.b.Location())
+	ibw.ec2, err = ibw.cfg.EC2Fleet.Client(loc)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"jid":      ibw.jid,
+			"location": loc.String(),
+			"err":      err,
+		}).Error("failed to get ec2 client")
+		return err
+	}
+
+	ibw.runner = ibw.ec2
+	ibw.b.Region = loc.Region
+
+	ibw.beginStep("resolve-ami")
+	f := ibw.cfg.Topology.ImageFilter(ibw.b.Role)
+
+	pinnedID, err := ibw.pinnedImageID(loc)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"jid": ibw.jid,
+			"err": err,
+		}).Warn("failed to fetch image pin")
 	}
 
 	log.WithFields(logrus.Fields{
-		"jid":    ibw.jid,
-		"filter": f,
+		"jid":       ibw.jid,
+		"filter":    f,
+		"pinned_id": pinnedID,
 	}).Debug("resolving ami")
 
-	ibw.ami, err = lib.ResolveAMI(ibw.ec2, ibw.b.AMI, f)
+	ibw.ami, err = lib.ResolveAMI(ibw.ec2, ibw.b.AMI, pinnedID, f,
+		lib.ImageSelectorForRole(ibw.cfg.ImageSelectors, ibw.b.Role))
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"jid":    ibw.jid,
@@ -98,6 +153,7 @@ func (ibw *instanceBuilderWorker) Build() error {
 		return err
 	}
 
+	ibw.beginStep("security-group")
 	if ibw.b.SecurityGroupID != "" {
 		ibw.sg = &ec2.SecurityGroup{Id: ibw.b.SecurityGroupID}
 	} else {
@@ -113,6 +169,7 @@ func (ibw *instanceBuilderWorker) Build() error {
 		}
 	}
 
+	ibw.beginStep("create-instance")
 	log.WithField("jid", ibw.jid).Debug("creating instance")
 	err = ibw.createInstance()
 	if err != nil {
@@ -123,8 +180,20 @@ func (ibw *instanceBuilderWorker) Build() error {
 		return err
 	}
 
+	ibw.launchedAt = time.Now().UTC()
 	ibw.b.InstanceID = ibw.i.InstanceId
+	ibw.b.IP = ibw.i.PublicIpAddress
+	ibw.b.PrivateIP = ibw.i.PrivateIpAddress
+
+	err = ibw.storeLaunched()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+			"jid": ibw.jid,
+		}).Warn("failed to store launched instance build")
+	}
 
+	ibw.beginStep("tag-instance")
 	for i := ibw.cfg.InstanceTagRetries; i > 0; i-- {
 		log.WithField("jid", ibw.jid).Debug("tagging instance")
 		err = ibw.tagInstance()
@@ -142,12 +211,46 @@ func (ibw *instanceBuilderWorker) Build() error {
 		return err
 	}
 
+	ibw.beginStep("store")
+	err = ibw.storeStarted()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+			"jid": ibw.jid,
+		}).Warn("failed to store started instance build")
+	}
+
+	if ibw.b.PurchaseType == "spot" {
+		err = db.StoreSpotInstanceBuild(ibw.rc, ibw.i.InstanceId, ibw.b)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err,
+				"jid": ibw.jid,
+			}).Warn("failed to store spot instance build")
+		}
+	}
+
 	ibw.notifyInstanceLaunched()
+	ibw.beginStep("")
 
 	log.WithField("jid", ibw.jid).Debug("all done")
 	return nil
 }
 
+// beginStep records the duration of the current build step, if any,
+// and starts timing the given step, where an empty step ends timing.
+// The current step is left in place when a build fails, so that the
+// failure may be attributed to it.
+func (ibw *instanceBuilderWorker) beginStep(step string) {
+	if ibw.step != "" {
+		ibw.cfg.Metrics.Observe("pudding_instance_build_step_duration_seconds",
+			map[string]string{"step": ibw.step}, time.Since(ibw.stepStart).Seconds())
+	}
+
+	ibw.step = step
+	ibw.stepStart = time.Now()
+}
+
 func (ibw *instanceBuilderWorker) createSecurityGroup() error {
 	newSg := ec2.SecurityGroup{
 		Name:        ibw.sgName,
@@ -196,12 +299,16 @@ func (ibw *instanceBuilderWorker) createSecurityGroup() error {
 }
 
 func (ibw *instanceBuilderWorker) createInstance() error {
+	types := ibw.b.InstanceTypeCandidates()
+	placements := ibw.spreadPlacements()
+
 	log.WithFields(logrus.Fields{
-		"jid":           ibw.jid,
-		"instance_type": ibw.b.InstanceType,
-		"ami.id":        ibw.ami.Id,
-		"ami.name":      ibw.ami.Name,
-		"count":         ibw.b.Count,
+		"jid":            ibw.jid,
+		"instance_types": types,
+		"placements":     placements,
+		"ami.id":         ibw.ami.Id,
+		"ami.name":       ibw.ami.Name,
+		"count":          ibw.b.Count,
 	}).Info("booting instance")
 
 	userData, err := ibw.buildUserData()
@@ -209,21 +316,298 @@ func (ibw *instanceBuilderWorker) createInstance() error {
 		return err
 	}
 
-	resp, err := ibw.ec2.RunInstances(&ec2.RunInstances{
-		ImageId:        ibw.ami.Id,
-		UserData:       userData,
-		InstanceType:   ibw.b.InstanceType,
-		SecurityGroups: []ec2.SecurityGroup{*ibw.sg},
-		SubnetId:       ibw.b.SubnetID,
+	if ibw.b.Spot {
+		err = ibw.createSpotInstances(userData, types, placements)
+		if err == nil {
+			return nil
+		}
+
+		log.WithFields(logrus.Fields{
+			"jid": ibw.jid,
+			"err": err,
+		}).Warn("failed to get spot instance, falling back to on-demand")
+	}
+
+	return ibw.createOnDemandInstance(userData, types, placements)
+}
+
+// createOnDemandInstance launches a single on-demand instance with the
+// first instance type and placement that EC2 has capacity for, trying
+// each placement in turn before moving on to the next instance type
+func (ibw *instanceBuilderWorker) createOnDemandInstance(userData []byte, types []string, placements []*lib.Placement) error {
+	for _, instanceType := range types {
+		for _, placement := range placements {
+			resp, err := ibw.runner.RunInstances(&ec2.RunInstances{
+				ImageId:            ibw.ami.Id,
+				UserData:           userData,
+				InstanceType:       instanceType,
+				SecurityGroups:     []ec2.SecurityGroup{*ibw.sg},
+				SubnetId:           placement.SubnetID,
+				KeyName:            ibw.b.KeyName,
+				IamInstanceProfile: ibw.b.IAMInstanceProfile,
+				EbsOptimized:       ibw.b.EBSOptimized,
+				PlacementGroupName: ibw.b.PlacementGroup,
+				AvailZone:          placement.AvailabilityZone,
+				BlockDevices:       ibw.b.EC2BlockDeviceMappings(ibw.ami.RootDeviceName),
+			})
+			if err == nil {
+				ibw.b.PurchaseType = "on-demand"
+				ibw.i = &resp.Instances[0]
+				ibw.recordPlacement(instanceType, placement)
+				return nil
+			}
+
+			if !lib.IsCapacityError(err) {
+				return err
+			}
+
+			log.WithFields(logrus.Fields{
+				"jid":           ibw.jid,
+				"instance_type": instanceType,
+				"placement":     placement.String(),
+				"err":           err,
+			}).Warn("insufficient capacity, trying next placement or instance type")
+
+			ibw.capacityFailures++
+		}
+	}
+
+	return errNoCapacity
+}
+
+// spreadPlacements orders the build's placements so that those with
+// the fewest instances already running for the same site, env, queue,
+// and role are tried first
+func (ibw *instanceBuilderWorker) spreadPlacements() []*lib.Placement {
+	placements := ibw.b.Placements()
+	if len(placements) < 2 {
+		return placements
+	}
+
+	f := ec2.NewFilter()
+	f.Add("instance-state-name", "pending", "running")
+	f.Add("tag:site", ibw.b.Site)
+	f.Add("tag:env", ibw.b.Env)
+	f.Add("tag:queue", ibw.b.Queue)
+	f.Add("tag:role", ibw.b.Role)
+
+	instances, err := lib.GetInstancesWithFilter(ibw.ec2, f)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"jid": ibw.jid,
+			"err": err,
+		}).Warn("failed to fetch running instances, not spreading placements")
+		return placements
+	}
+
+	subnetCounts := map[string]int{}
+	azCounts := map[string]int{}
+	for _, inst := range instances {
+		subnetCounts[inst.SubnetId]++
+		azCounts[inst.AvailZone]++
+	}
+
+	return lib.SpreadPlacements(placements, subnetCounts, azCounts)
+}
+
+// recordPlacement sets the instance type, subnet, and availability
+// zone the instance was actually launched with on the build
+func (ibw *instanceBuilderWorker) recordPlacement(instanceType string, placement *lib.Placement) {
+	ibw.b.InstanceType = instanceType
+	ibw.b.SubnetID = placement.SubnetID
+	ibw.b.AvailabilityZone = placement.AvailabilityZone
+
+	if ibw.i.SubnetId != "" {
+		ibw.b.SubnetID = ibw.i.SubnetId
+	}
+	if ibw.i.AvailZone != "" {
+		ibw.b.AvailabilityZone = ibw.i.AvailZone
+	}
+
+	log.WithFields(logrus.Fields{
+		"jid":               ibw.jid,
+		"instance_type":     ibw.b.InstanceType,
+		"subnet_id":         ibw.b.SubnetID,
+		"availability_zone": ibw.b.AvailabilityZone,
+		"capacity_failures": ibw.capacityFailures,
+	}).Info("launched instance")
+}
+
+// createSpotInstances walks the same instance type and placement
+// candidates as on-demand instances, requesting a spot instance for
+// each in turn until one is fulfilled, all within the spot timeout
+func (ibw *instanceBuilderWorker) createSpotInstances(userData []byte, types []string, placements []*lib.Placement) error {
+	timeout := ibw.b.SpotTimeout
+	if timeout == 0 {
+		timeout = ibw.cfg.SpotFulfillmentTimeout
+	}
+
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+
+	for _, instanceType := range types {
+		for _, placement := range placements {
+			err := ibw.createSpotInstance(userData, instanceType, placement, deadline)
+			if err == nil {
+				ibw.b.PurchaseType = "spot"
+				ibw.recordPlacement(instanceType, placement)
+				return nil
+			}
+
+			if err == errNoSpot {
+				return err
+			}
+
+			log.WithFields(logrus.Fields{
+				"jid":           ibw.jid,
+				"instance_type": instanceType,
+				"placement":     placement.String(),
+				"err":           err,
+			}).Warn("failed to get spot instance, trying next placement or instance type")
+		}
+	}
+
+	return fmt.Errorf("spot requests failed for all instance types and placements")
+}
+
+// createSpotInstance requests a one-time spot instance of the given
+// type and placement at the build's max price and waits for the
+// request to be fulfilled, cancelling it if it is not fulfilled
+// before the deadline
+func (ibw *instanceBuilderWorker) createSpotInstance(userData []byte, instanceType string, placement *lib.Placement, deadline time.Time) error {
+	if time.Now().After(deadline) {
+		return errNoSpot
+	}
+
+	log.WithFields(logrus.Fields{
+		"jid":            ibw.jid,
+		"instance_type":  instanceType,
+		"placement":      placement.String(),
+		"spot_max_price": ibw.b.SpotMaxPrice,
+		"spot_deadline":  deadline.UTC().Format(time.RFC3339),
+	}).Info("requesting spot instance")
+
+	resp, err := ibw.ec2.RequestSpotInstances(&ec2.RequestSpotInstances{
+		SpotPrice:          ibw.b.SpotMaxPrice,
+		InstanceCount:      1,
+		Type:               "one-time",
+		ImageId:            ibw.ami.Id,
+		UserData:           userData,
+		InstanceType:       instanceType,
+		SecurityGroups:     []ec2.SecurityGroup{*ibw.sg},
+		SubnetId:           placement.SubnetID,
+		KeyName:            ibw.b.KeyName,
+		IamInstanceProfile: ibw.b.IAMInstanceProfile,
+		PlacementGroupName: ibw.b.PlacementGroup,
+		AvailZone:          placement.AvailabilityZone,
+		BlockDevices:       ibw.b.EC2BlockDeviceMappings(ibw.ami.RootDeviceName),
 	})
 	if err != nil {
 		return err
 	}
 
-	ibw.i = &resp.Instances[0]
+	if len(resp.SpotRequestResults) == 0 {
+		return fmt.Errorf("no spot request created")
+	}
+
+	requestID := resp.SpotRequestResults[0].SpotRequestId
+	instanceID := ""
+
+	for instanceID == "" {
+		sr, err := ibw.ec2.DescribeSpotRequests([]string{requestID}, nil)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"jid":             ibw.jid,
+				"spot_request_id": requestID,
+				"err":             err,
+			}).Warn("failed to describe spot request, retrying until the deadline")
+		} else if len(sr.SpotRequestResults) > 0 {
+			result := sr.SpotRequestResults[0]
+			instanceID = result.InstanceId
+
+			switch result.State {
+			case "closed", "cancelled", "failed":
+				if instanceID == "" {
+					return fmt.Errorf("spot request %s is %s", requestID, result.State)
+				}
+			}
+		}
+
+		if instanceID != "" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			instanceID, err = ibw.cancelSpotRequest(requestID)
+			if err != nil {
+				return err
+			}
+
+			if instanceID == "" {
+				log.WithFields(logrus.Fields{
+					"jid":             ibw.jid,
+					"spot_request_id": requestID,
+				}).Warn("spot request not fulfilled before the deadline")
+				return errNoSpot
+			}
+
+			log.WithFields(logrus.Fields{
+				"jid":             ibw.jid,
+				"spot_request_id": requestID,
+				"instance_id":     instanceID,
+			}).Info("spot request fulfilled while cancelling, keeping its instance")
+			break
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+
+	f := ec2.NewFilter()
+	f.Add("instance-id", instanceID)
+
+	instances, err := lib.GetInstancesWithFilter(ibw.ec2, f)
+	if err != nil {
+		return err
+	}
+
+	inst, ok := instances[instanceID]
+	if !ok {
+		return fmt.Errorf("spot instance %s not found", instanceID)
+	}
+
+	ibw.i = &inst
 	return nil
 }
 
+// cancelSpotRequest cancels the spot request and then describes it
+// again, returning the id of the instance if it was fulfilled in the
+// meantime, since cancelling a request does not terminate its instance
+func (ibw *instanceBuilderWorker) cancelSpotRequest(requestID string) (string, error) {
+	_, err := ibw.ec2.CancelSpotRequests([]string{requestID})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"jid":             ibw.jid,
+			"spot_request_id": requestID,
+			"err":             err,
+		}).Error("failed to cancel spot request")
+	}
+
+	for i := 3; i > 0; i-- {
+		var sr *ec2.SpotRequestsResp
+		sr, err = ibw.ec2.DescribeSpotRequests([]string{requestID}, nil)
+		if err == nil {
+			if len(sr.SpotRequestResults) == 0 {
+				return "", nil
+			}
+
+			return sr.SpotRequestResults[0].InstanceId, nil
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	return "", fmt.Errorf("failed to describe cancelled spot request %s: %v", requestID, err)
+}
+
 func (ibw *instanceBuilderWorker) tagInstance() error {
 	nameTmpl, err := template.New(fmt.Sprintf("name-template-%s", ibw.jid)).Parse(ibw.b.NameTemplate)
 	if err != nil {
@@ -242,6 +626,22 @@ func (ibw *instanceBuilderWorker) tagInstance() error {
 		ec2.Tag{Key: "site", Value: ibw.b.Site},
 		ec2.Tag{Key: "env", Value: ibw.b.Env},
 		ec2.Tag{Key: "queue", Value: ibw.b.Queue},
+		ec2.Tag{Key: "purchase_type", Value: ibw.b.PurchaseType},
+		ec2.Tag{Key: "instance_build_id", Value: ibw.b.ID},
+	}
+
+	if ibw.b.Requester != "" {
+		tags = append(tags, ec2.Tag{Key: "requester", Value: ibw.b.Requester})
+	}
+
+	tagKeys := []string{}
+	for key := range ibw.b.Tags {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+
+	for _, key := range tagKeys {
+		tags = append(tags, ec2.Tag{Key: key, Value: ibw.b.Tags[key]})
 	}
 
 	log.WithFields(logrus.Fields{
@@ -269,55 +669,53 @@ func (ibw *instanceBuilderWorker) buildUserData() ([]byte, error) {
 	webURL.Path = fmt.Sprintf("/instance-builds/%s", ibw.b.ID)
 	instanceBuildURL := webURL.String()
 
-	buf := &bytes.Buffer{}
-	gzw, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	t, err := db.ResolveInitScriptTemplate(ibw.rc, ibw.b, ibw.t)
 	if err != nil {
 		return nil, err
 	}
 
-	tw := &bytes.Buffer{}
-	w := io.MultiWriter(tw, gzw)
-
-	yml, err := lib.BuildInstanceSpecificYML(ibw.b.Site, ibw.b.Env, ibw.cfg.InstanceYML, ibw.b.Queue, ibw.b.Count)
+	rendered, err := lib.RenderInitScript(t, ibw.b, ibw.cfg.InstanceYML, ibw.cfg.InstanceRSA, instanceBuildURL)
 	if err != nil {
 		return nil, err
 	}
 
-	ymlString, err := yml.String()
+	log.WithFields(logrus.Fields{
+		"jid":                          ibw.jid,
+		"bytes":                        len(rendered.Script),
+		"init_script_template":         ibw.b.InitScriptTemplate,
+		"init_script_template_version": ibw.b.InitScriptTemplateVersion,
+	}).Debug("rendered init script")
+
+	buf := &bytes.Buffer{}
+	gzw, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
 	if err != nil {
 		return nil, err
 	}
 
-	err = ibw.t.Execute(w, &initScriptContext{
-		Env:              ibw.b.Env,
-		Site:             ibw.b.Site,
-		Queue:            ibw.b.Queue,
-		Role:             ibw.b.Role,
-		AMI:              ibw.b.AMI,
-		Count:            ibw.b.Count,
-		InstanceType:     ibw.b.InstanceType,
-		InstanceRSA:      ibw.cfg.InstanceRSA,
-		SlackChannel:     ibw.b.SlackChannel,
-		PapertrailSite:   yml.PapertrailSite,
-		InstanceYML:      ymlString,
-		InstanceBuildID:  ibw.b.ID,
-		InstanceBuildURL: instanceBuildURL,
-	})
+	_, err = gzw.Write([]byte(rendered.Script))
 	if err != nil {
 		return nil, err
 	}
 
-	log.WithFields(logrus.Fields{
-		"jid":    ibw.jid,
-		"script": tw.String(),
-	}).Debug("rendered init script")
-
 	err = gzw.Close()
 	if err != nil {
 		return nil, err
 	}
 
-	initScriptB64 := base64.StdEncoding.EncodeToString(buf.Bytes())
+	dbScript := base64.StdEncoding.EncodeToString(buf.Bytes())
+	dbAuth := tmpAuth
+
+	if ibw.cfg.InitScriptKeyring.Enabled() {
+		dbScript, err = ibw.cfg.InitScriptKeyring.Seal(buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		dbAuth, err = ibw.cfg.InitScriptKeyring.Seal([]byte(tmpAuth))
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	err = ibw.rc.Send("MULTI")
 	if err != nil {
@@ -325,14 +723,14 @@ func (ibw *instanceBuilderWorker) buildUserData() ([]byte, error) {
 	}
 
 	scriptKey := db.InitScriptRedisKey(ibw.b.ID)
-	err = ibw.rc.Send("SETEX", scriptKey, ibw.cfg.TmpInitExpiry, initScriptB64)
+	err = ibw.rc.Send("SETEX", scriptKey, ibw.cfg.TmpInitExpiry, dbScript)
 	if err != nil {
 		ibw.rc.Send("DISCARD")
 		return nil, err
 	}
 
 	authKey := db.AuthRedisKey(ibw.b.ID)
-	err = ibw.rc.Send("SETEX", authKey, ibw.cfg.TmpInitExpiry, tmpAuth)
+	err = ibw.rc.Send("SETEX", authKey, ibw.cfg.TmpInitExpiry, dbAuth)
 	if err != nil {
 		ibw.rc.Send("DISCARD")
 		return nil, err
@@ -346,9 +744,108 @@ func (ibw *instanceBuilderWorker) buildUserData() ([]byte, error) {
 	return []byte(fmt.Sprintf("#include %s\n", initScriptURL)), nil
 }
 
+// pinnedImageID returns the id of the image pinned for the role, site,
+// and env of the instance build, unless the pinned image was synced
+// from another location than the one the instance is built in
+func (ibw *instanceBuilderWorker) pinnedImageID(loc *lib.Location) (string, error) {
+	pinnedID, err := db.FetchImagePin(ibw.rc, ibw.b.Role, ibw.b.Site, ibw.b.Env)
+	if err != nil || pinnedID == "" {
+		return "", err
+	}
+
+	images, err := db.FetchImages(ibw.rc, map[string]string{"image_id": pinnedID})
+	if err != nil {
+		return "", err
+	}
+
+	for _, img := range images {
+		if img.ImageID != pinnedID {
+			continue
+		}
+
+		imgLoc := ibw.cfg.EC2Fleet.Resolve(img.Location())
+		if imgLoc.String() != loc.String() {
+			log.WithFields(logrus.Fields{
+				"jid":            ibw.jid,
+				"pinned_id":      pinnedID,
+				"image_location": imgLoc.String(),
+				"location":       loc.String(),
+			}).Debug("ignoring image pinned in another location")
+			return "", nil
+		}
+	}
+
+	return pinnedID, nil
+}
+
+// storeLaunched stores the instance id and ips of the build as soon
+// as the instance is launched, before the instance can fetch its init
+// script, so that the fetch may be bound to the instance's ip.  The
+// boot deadline starts here, so that it also covers builds that fail
+// before they are stored as started.
+func (ibw *instanceBuilderWorker) storeLaunched() error {
+	stored, err := db.FetchInstanceBuild(ibw.rc, ibw.b.ID)
+	if err != nil {
+		return err
+	}
+
+	if stored != nil && stored.State != "" {
+		ibw.b.State = stored.State
+	}
+
+	err = db.StoreInstanceBuild(ibw.rc, ibw.b, ibw.cfg.InstanceBuildStoreExpiry)
+	if err != nil || ibw.b.Done() {
+		return err
+	}
+
+	return db.StoreBootingInstanceBuild(ibw.rc, ibw.b.ID, ibw.launchedAt, ibw.cfg.InstanceBuildStoreExpiry)
+}
+
+func (ibw *instanceBuilderWorker) storeStarted() error {
+	stored, err := db.FetchInstanceBuild(ibw.rc, ibw.b.ID)
+	if err != nil {
+		return err
+	}
+
+	ibw.b.State = "started"
+	ibw.b.StartedAt = time.Now().UTC().Format(time.RFC3339)
+	if stored != nil && stored.Done() {
+		ibw.b.State = stored.State
+	}
+
+	err = db.StoreInstanceBuild(ibw.rc, ibw.b, ibw.cfg.InstanceBuildStoreExpiry)
+	if err != nil || ibw.b.Done() {
+		return err
+	}
+
+	// storing the launched build may have failed, so the build is
+	// added to the booting builds again, still as of its launch
+	return db.StoreBootingInstanceBuild(ibw.rc, ibw.b.ID, ibw.launchedAt, ibw.cfg.InstanceBuildStoreExpiry)
+}
+
 func (ibw *instanceBuilderWorker) notifyInstanceLaunched() {
+	msg := fmt.Sprintf("Started %s instance `%s` for instance build *%s*", ibw.b.PurchaseType, ibw.i.InstanceId, ibw.b.ID)
+	if ibw.b.Requester != "" {
+		msg = fmt.Sprintf("%s requested by %s", msg, ibw.b.Requester)
+	}
+	if ibw.capacityFailures > 0 {
+		msg = fmt.Sprintf("%s as %s in %s after %d capacity failure(s)", msg,
+			ibw.b.InstanceType, ibw.b.AvailabilityZone, ibw.capacityFailures)
+	}
+
 	for _, notifier := range ibw.n {
-		notifier.Notify(ibw.b.SlackChannel,
-			fmt.Sprintf("Started instance `%s` for instance build *%s*", ibw.i.InstanceId, ibw.b.ID))
+		notifier.Notify(ibw.b.SlackChannel, msg)
+	}
+}
+
+// captureConsole enqueues fetching the console output of the instance
+// of a failed build so that it is attached to the build for debugging
+func (ibw *instanceBuilderWorker) captureConsole() {
+	err := db.EnqueueInstanceConsole(ibw.rc, "instance-consoles", ibw.i.InstanceId, ibw.b.ID)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+			"jid": ibw.jid,
+		}).Warn("failed to enqueue console output capture")
 	}
 }
@@ -0,0 +1,149 @@
+package workers
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/goamz/ec2"
+	"github.com/travis-ci/pudding/lib"
+)
+
+type testInstanceRunner struct {
+	errs     map[string]error
+	attempts []string
+}
+
+func (tir *testInstanceRunner) RunInstances(ri *ec2.RunInstances) (*ec2.RunInstancesResp, error) {
+	attempt := ri.InstanceType + "/" + ri.SubnetId + ri.AvailZone
+	tir.attempts = append(tir.attempts, attempt)
+
+	if err, ok := tir.errs[attempt]; ok {
+		return nil, err
+	}
+
+	return &ec2.RunInstancesResp{Instances: []ec2.Instance{{InstanceId: "i-" + attempt}}}, nil
+}
+
+var _ instanceRunner = &ec2.EC2{}
+
+func TestInstanceBuilderWorkerCreateOnDemandInstance(t *testing.T) {
+	noCapacity := &ec2.Error{Code: "InsufficientInstanceCapacity"}
+	subnets := []*lib.Placement{{SubnetID: "subnet-a"}, {SubnetID: "subnet-b"}}
+
+	for _, c := range []struct {
+		desc             string
+		types            []string
+		placements       []*lib.Placement
+		errs             map[string]error
+		attempts         []string
+		instanceType     string
+		subnetID         string
+		capacityFailures int
+		err              error
+	}{
+		{
+			desc:         "first placement and type",
+			types:        []string{"c3.2xlarge", "c4.2xlarge"},
+			placements:   subnets,
+			errs:         map[string]error{},
+			attempts:     []string{"c3.2xlarge/subnet-a"},
+			instanceType: "c3.2xlarge",
+			subnetID:     "subnet-a",
+		},
+		{
+			desc:             "next placement before next type",
+			types:            []string{"c3.2xlarge", "c4.2xlarge"},
+			placements:       subnets,
+			errs:             map[string]error{"c3.2xlarge/subnet-a": noCapacity},
+			attempts:         []string{"c3.2xlarge/subnet-a", "c3.2xlarge/subnet-b"},
+			instanceType:     "c3.2xlarge",
+			subnetID:         "subnet-b",
+			capacityFailures: 1,
+		},
+		{
+			desc:       "next type once every placement is out of capacity",
+			types:      []string{"c3.2xlarge", "c4.2xlarge"},
+			placements: subnets,
+			errs: map[string]error{
+				"c3.2xlarge/subnet-a": noCapacity,
+				"c3.2xlarge/subnet-b": &ec2.Error{Code: "InsufficientFreeAddressesInSubnet"},
+			},
+			attempts:         []string{"c3.2xlarge/subnet-a", "c3.2xlarge/subnet-b", "c4.2xlarge/subnet-a"},
+			instanceType:     "c4.2xlarge",
+			subnetID:         "subnet-a",
+			capacityFailures: 2,
+		},
+		{
+			desc:             "availability zones",
+			types:            []string{"c3.2xlarge"},
+			placements:       []*lib.Placement{{AvailabilityZone: "us-east-1a"}, {AvailabilityZone: "us-east-1b"}},
+			errs:             map[string]error{"c3.2xlarge/us-east-1a": noCapacity},
+			attempts:         []string{"c3.2xlarge/us-east-1a", "c3.2xlarge/us-east-1b"},
+			instanceType:     "c3.2xlarge",
+			capacityFailures: 1,
+		},
+		{
+			desc:       "out of capacity everywhere",
+			types:      []string{"c3.2xlarge", "c4.2xlarge"},
+			placements: subnets,
+			errs: map[string]error{
+				"c3.2xlarge/subnet-a": noCapacity,
+				"c3.2xlarge/subnet-b": noCapacity,
+				"c4.2xlarge/subnet-a": noCapacity,
+				"c4.2xlarge/subnet-b": noCapacity,
+			},
+			attempts:         []string{"c3.2xlarge/subnet-a", "c3.2xlarge/subnet-b", "c4.2xlarge/subnet-a", "c4.2xlarge/subnet-b"},
+			capacityFailures: 4,
+			err:              errNoCapacity,
+		},
+		{
+			desc:       "other errors stop the fallback",
+			types:      []string{"c3.2xlarge", "c4.2xlarge"},
+			placements: subnets,
+			errs: map[string]error{
+				"c3.2xlarge/subnet-a": noCapacity,
+				"c3.2xlarge/subnet-b": fmt.Errorf("boom"),
+			},
+			attempts:         []string{"c3.2xlarge/subnet-a", "c3.2xlarge/subnet-b"},
+			capacityFailures: 1,
+			err:              fmt.Errorf("boom"),
+		},
+	} {
+		tir := &testInstanceRunner{errs: c.errs}
+		ibw := &instanceBuilderWorker{
+			jid:    "jid",
+			runner: tir,
+			sg:     &ec2.SecurityGroup{Id: "sg-1"},
+			ami:    &ec2.Image{Id: "ami-1"},
+			b:      &lib.InstanceBuild{ID: "b-1"},
+		}
+
+		err := ibw.createOnDemandInstance([]byte{}, c.types, c.placements)
+		if !reflect.DeepEqual(err, c.err) {
+			t.Errorf("%s: expected error %v, got %v", c.desc, c.err, err)
+		}
+
+		if !reflect.DeepEqual(tir.attempts, c.attempts) {
+			t.Errorf("%s: expected attempts %v, got %v", c.desc, c.attempts, tir.attempts)
+		}
+
+		if ibw.capacityFailures != c.capacityFailures {
+			t.Errorf("%s: expected %d capacity failures, got %d", c.desc, c.capacityFailures, ibw.capacityFailures)
+		}
+
+		if c.err != nil {
+			continue
+		}
+
+		if ibw.i == nil || ibw.b.PurchaseType != "on-demand" {
+			t.Errorf("%s: expected an on-demand instance", c.desc)
+			continue
+		}
+
+		if ibw.b.InstanceType != c.instanceType || ibw.b.SubnetID != c.subnetID {
+			t.Errorf("%s: expected %s in %q to be recorded, got %s in %q",
+				c.desc, c.instanceType, c.subnetID, ibw.b.InstanceType, ibw.b.SubnetID)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package workers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/jrallison/go-workers"
+	"github.com/travis-ci/pudding/lib"
+	"github.com/travis-ci/pudding/lib/db"
+)
+
+var (
+	errConsoleOutputUnavailable = fmt.Errorf("console output not yet available")
+)
+
+func init() {
+	defaultQueueFuncs["instance-consoles"] = instanceConsolesMain
+}
+
+func instanceConsolesMain(cfg *internalConfig, msg *workers.Msg) {
+	log.WithFields(logrus.Fields{
+		"jid": msg.Jid(),
+	}).Debug("starting processing of instance console job")
+
+	consolePayloadJSON := []byte(msg.OriginalJson())
+	consolePayload := &lib.InstanceConsolePayload{}
+
+	err := json.Unmarshal(consolePayloadJSON, consolePayload)
+	if err != nil {
+		log.WithField("err", err).Panic("failed to deserialize message")
+	}
+
+	err = newInstanceConsoleWorker(consolePayload, cfg, msg.Jid(), workers.Config.Pool.Get()).Fetch()
+	if err != nil {
+		log.WithField("err", err).Panic("instance console fetch failed")
+	}
+}
+
+type instanceConsoleWorker struct {
+	rc  redis.Conn
+	jid string
+	iid string
+	bid string
+	cfg *internalConfig
+}
+
+func newInstanceConsoleWorker(payload *lib.InstanceConsolePayload, cfg *internalConfig, jid string, redisConn redis.Conn) *instanceConsoleWorker {
+	return &instanceConsoleWorker{
+		rc:  redisConn,
+		jid: jid,
+		iid: payload.InstanceID,
+		bid: payload.InstanceBuildID,
+		cfg: cfg,
+	}
+}
+
+// Fetch gets the console output of the instance from ec2, caches it,
+// and attaches it to the instance build, if any
+func (icw *instanceConsoleWorker) Fetch() error {
+	var loc *lib.Location
+
+	instances, err := db.FetchInstances(icw.rc, map[string]string{"instance_id": icw.iid})
+	if err != nil {
+		return err
+	}
+
+	if len(instances) > 0 && instances[0].Region != "" {
+		loc = instances[0].Location()
+	}
+
+	var b *lib.InstanceBuild
+	if icw.bid != "" {
+		b, err = db.FetchInstanceBuild(icw.rc, icw.bid)
+		if err != nil {
+			return err
+		}
+
+		if loc == nil && b != nil {
+			loc = icw.cfg.EC2Fleet.Resolve(b.Location())
+		}
+	}
+
+	co, err := fetchConsoleOutput(icw.cfg, icw.rc, icw.iid, loc)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"jid":         icw.jid,
+		"instance_id": icw.iid,
+		"timestamp":   co.Timestamp,
+	}).Debug("fetched console output")
+
+	if b == nil {
+		return nil
+	}
+
+	b.ConsoleOutput = co.Output
+	return db.StoreInstanceBuild(icw.rc, b, icw.cfg.InstanceBuildStoreExpiry)
+}
+
+// fetchConsoleOutput gets the console output of the instance in the
+// given location, which may be nil for the default, and caches it
+func fetchConsoleOutput(cfg *internalConfig, conn redis.Conn, instanceID string, loc *lib.Location) (*lib.ConsoleOutput, error) {
+	client, err := cfg.EC2Fleet.Client(loc)
+	if err != nil {
+		return nil, err
+	}
+
+	co, err := lib.GetConsoleOutput(client, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if co.Output == "" {
+		return nil, errConsoleOutputUnavailable
+	}
+
+	return co, db.StoreInstanceConsoleOutput(conn, co)
+}
@@ -0,0 +1,135 @@
+package workers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/jrallison/go-workers"
+	"github.com/mitchellh/goamz/ec2"
+	"github.com/travis-ci/pudding/lib"
+	"github.com/travis-ci/pudding/lib/db"
+)
+
+var (
+	errUnknownInstanceAction = fmt.Errorf("action must be start or stop")
+)
+
+func init() {
+	defaultQueueFuncs["instance-state-changes"] = instanceStateChangesMain
+}
+
+func instanceStateChangesMain(cfg *internalConfig, msg *workers.Msg) {
+	log.WithFields(logrus.Fields{
+		"jid": msg.Jid(),
+	}).Debug("starting processing of instance state change job")
+
+	changePayloadJSON := []byte(msg.OriginalJson())
+	changePayload := &lib.InstanceStateChangePayload{}
+
+	err := json.Unmarshal(changePayloadJSON, changePayload)
+	if err != nil {
+		log.WithField("err", err).Panic("failed to deserialize message")
+	}
+
+	err = newInstanceStateChangerWorker(changePayload, cfg, msg.Jid(), workers.Config.Pool.Get()).Change()
+	if err != nil {
+		cfg.Metrics.Inc("pudding_instance_state_changes_total", map[string]string{"action": changePayload.Action, "outcome": "failure"})
+		log.WithField("err", err).Panic("instance state change failed")
+	}
+
+	cfg.Metrics.Inc("pudding_instance_state_changes_total", map[string]string{"action": changePayload.Action, "outcome": "success"})
+}
+
+type instanceStateChangerWorker struct {
+	rc     redis.Conn
+	jid    string
+	nc     string
+	n      []lib.Notifier
+	iid    string
+	action string
+	req    string
+	cfg    *internalConfig
+	ec2    *ec2.EC2
+}
+
+func newInstanceStateChangerWorker(payload *lib.InstanceStateChangePayload, cfg *internalConfig, jid string, redisConn redis.Conn) *instanceStateChangerWorker {
+	notifier := lib.NewSlackNotifier(cfg.SlackHookPath, cfg.SlackUsername, cfg.SlackIcon)
+
+	return &instanceStateChangerWorker{
+		rc:     redisConn,
+		jid:    jid,
+		cfg:    cfg,
+		nc:     payload.SlackChannel,
+		n:      []lib.Notifier{notifier},
+		iid:    payload.InstanceID,
+		action: payload.Action,
+		req:    payload.Requester,
+	}
+}
+
+// Change starts or stops the instance, leaving the stored state to be
+// updated by the ec2 syncer
+func (iscw *instanceStateChangerWorker) Change() error {
+	var loc *lib.Location
+
+	instances, err := db.FetchInstances(iscw.rc, map[string]string{"instance_id": iscw.iid})
+	if err != nil {
+		return err
+	}
+
+	if len(instances) > 0 && instances[0].Region != "" {
+		loc = instances[0].Location()
+	}
+
+	iscw.ec2, err = iscw.cfg.EC2Fleet.Client(loc)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"jid":         iscw.jid,
+		"instance_id": iscw.iid,
+		"action":      iscw.action,
+		"requester":   iscw.req,
+	}).Info("changing instance state")
+
+	verb := ""
+	switch iscw.action {
+	case "start":
+		verb = "Starting"
+		_, err = iscw.ec2.StartInstances(iscw.iid)
+	case "stop":
+		verb = "Stopping"
+		_, err = iscw.ec2.StopInstances(iscw.iid)
+	default:
+		err = errUnknownInstanceAction
+	}
+
+	if err != nil {
+		for _, notifier := range iscw.n {
+			notifier.Notify(iscw.nc, fmt.Sprintf("Failed to %s *%s* :scream_cat: _(%s)_", iscw.action, iscw.iid, err))
+		}
+		return err
+	}
+
+	requester := iscw.req
+	if requester == "" {
+		requester = "api"
+	}
+
+	err = db.StoreInstanceStateReason(iscw.rc, iscw.iid, iscw.action,
+		fmt.Sprintf("%s requested by %s", iscw.action, requester), iscw.cfg.HistoryStoreExpiry)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err":         err,
+			"instance_id": iscw.iid,
+		}).Error("failed to store instance state reason")
+	}
+
+	for _, notifier := range iscw.n {
+		notifier.Notify(iscw.nc, fmt.Sprintf("%s *%s*", verb, iscw.iid))
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package workers
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/garyburd/redigo/redis"
@@ -30,10 +31,13 @@ func instanceTerminationsMain(cfg *internalConfig, msg *workers.Msg) {
 	}
 
 	err = newInstanceTerminatorWorker(buildPayload.InstanceID, buildPayload.SlackChannel,
-		cfg, msg.Jid(), workers.Config.Pool.Get()).Terminate()
+		buildPayload.Requester, cfg, msg.Jid(), workers.Config.Pool.Get()).Terminate()
 	if err != nil {
+		cfg.Metrics.Inc("pudding_instance_terminations_total", map[string]string{"outcome": "failure"})
 		log.WithField("err", err).Panic("instance build failed")
 	}
+
+	cfg.Metrics.Inc("pudding_instance_terminations_total", map[string]string{"outcome": "success"})
 }
 
 type instanceTerminatorWorker struct {
@@ -42,11 +46,12 @@ type instanceTerminatorWorker struct {
 	nc  string
 	n   []lib.Notifier
 	iid string
+	req string
 	cfg *internalConfig
 	ec2 *ec2.EC2
 }
 
-func newInstanceTerminatorWorker(instanceID, slackChannel string, cfg *internalConfig, jid string, redisConn redis.Conn) *instanceTerminatorWorker {
+func newInstanceTerminatorWorker(instanceID, slackChannel, requester string, cfg *internalConfig, jid string, redisConn redis.Conn) *instanceTerminatorWorker {
 	notifier := lib.NewSlackNotifier(cfg.SlackHookPath, cfg.SlackUsername, cfg.SlackIcon)
 
 	return &instanceTerminatorWorker{
@@ -56,12 +61,32 @@ func newInstanceTerminatorWorker(instanceID, slackChannel string, cfg *internalC
 		nc:  slackChannel,
 		n:   []lib.Notifier{notifier},
 		iid: instanceID,
-		ec2: ec2.New(cfg.AWSAuth, cfg.AWSRegion),
+		req: requester,
 	}
 }
 
 func (itw *instanceTerminatorWorker) Terminate() error {
-	_, err := itw.ec2.TerminateInstances([]string{itw.iid})
+	var loc *lib.Location
+	inst := &lib.Instance{InstanceID: itw.iid}
+
+	instances, err := db.FetchInstances(itw.rc, map[string]string{"instance_id": itw.iid})
+	if err != nil {
+		return err
+	}
+
+	if len(instances) > 0 {
+		inst = instances[0]
+		if inst.Region != "" {
+			loc = inst.Location()
+		}
+	}
+
+	itw.ec2, err = itw.cfg.EC2Fleet.Client(loc)
+	if err != nil {
+		return err
+	}
+
+	_, err = itw.ec2.TerminateInstances([]string{itw.iid})
 	if err != nil {
 		return err
 	}
@@ -74,8 +99,27 @@ func (itw *instanceTerminatorWorker) Terminate() error {
 		return err
 	}
 
+	itw.storeHistory(inst)
+
 	for _, notifier := range itw.n {
 		notifier.Notify(itw.nc, fmt.Sprintf("Terminating *%s* :boom:", itw.iid))
 	}
 	return nil
 }
+
+func (itw *instanceTerminatorWorker) storeHistory(inst *lib.Instance) {
+	requester := itw.req
+	if requester == "" {
+		requester = "api"
+	}
+
+	inst.MarkTerminated(requester, time.Now())
+
+	_, err := db.StoreTerminatedInstance(itw.rc, inst, itw.cfg.HistoryStoreExpiry)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"err":         err,
+			"instance_id": itw.iid,
+		}).Error("failed to store terminated instance history")
+	}
+}
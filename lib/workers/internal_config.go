@@ -6,11 +6,13 @@ import (
 
 	"github.com/jrallison/go-workers"
 	"github.com/mitchellh/goamz/aws"
+	"github.com/travis-ci/pudding/lib"
 )
 
 type internalConfig struct {
 	AWSAuth   aws.Auth
 	AWSRegion aws.Region
+	EC2Fleet  *ec2Fleet
 
 	RedisURL      *url.URL
 	RedisPoolSize string
@@ -32,10 +34,29 @@ type internalConfig struct {
 	QueueFuncs         map[string]func(*internalConfig, *workers.Msg)
 	QueueConcurrencies map[string]int
 
-	MiniWorkerInterval  int
-	InstanceStoreExpiry int
-	ImageStoreExpiry    int
-	TmpInitExpiry       int
+	MiniWorkerInterval       int
+	InstanceStoreExpiry      int
+	ImageStoreExpiry         int
+	InstanceBuildStoreExpiry int
+	TmpInitExpiry            int
+	HistoryStoreExpiry       int
 
 	InitScriptTemplate *template.Template
+	InitScriptKeyring  *lib.Keyring
+	ImageSelectors     map[string]*lib.ImageSelector
+	Topology           *lib.Topology
+	TagPolicy          *lib.TagPolicy
+
+	SpotFulfillmentTimeout      int
+	SpotInterruptionReplacement bool
+
+	BootDeadline          int
+	BootDeadlineTerminate bool
+
+	MetricsAddr string
+	Metrics     *lib.Metrics
+
+	ImageRetention       map[string]int
+	ImageCleanupInterval int
+	ImageCleanupDryRun   bool
 }
@@ -1,6 +1,7 @@
 package workers
 
 import (
+	"fmt"
 	"net/url"
 	"os"
 	"strconv"
@@ -9,6 +10,8 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/mitchellh/goamz/aws"
+	"github.com/travis-ci/pudding/lib"
+	"github.com/travis-ci/pudding/lib/db"
 )
 
 // Main is the whole shebang
@@ -17,6 +20,15 @@ func Main(cfg *Config) {
 		log.Level = logrus.DebugLevel
 	}
 
+	configErrors := CheckConfig(cfg)
+	if len(configErrors) > 0 {
+		for _, err := range configErrors {
+			log.WithField("err", err).Error("invalid config")
+		}
+		log.Fatal("config check failed")
+		os.Exit(1)
+	}
+
 	ic := &internalConfig{
 		RedisPoolSize: cfg.RedisPoolSize,
 
@@ -37,10 +49,24 @@ func Main(cfg *Config) {
 		QueueConcurrencies: map[string]int{},
 		QueueFuncs:         defaultQueueFuncs,
 
-		MiniWorkerInterval:  cfg.MiniWorkerInterval,
-		InstanceStoreExpiry: cfg.InstanceExpiry,
-		ImageStoreExpiry:    cfg.ImageExpiry,
-		TmpInitExpiry:       cfg.TmpInitExpiry,
+		MiniWorkerInterval:       cfg.MiniWorkerInterval,
+		InstanceStoreExpiry:      cfg.InstanceExpiry,
+		ImageStoreExpiry:         cfg.ImageExpiry,
+		InstanceBuildStoreExpiry: cfg.InstanceBuildExpiry,
+		TmpInitExpiry:            cfg.TmpInitExpiry,
+		HistoryStoreExpiry:       cfg.HistoryExpiry,
+
+		ImageCleanupInterval: cfg.ImageCleanupInterval,
+		ImageCleanupDryRun:   cfg.ImageCleanupDryRun,
+
+		SpotFulfillmentTimeout:      cfg.SpotFulfillmentTimeout,
+		SpotInterruptionReplacement: cfg.SpotInterruptionReplacement,
+
+		BootDeadline:          cfg.BootDeadline,
+		BootDeadlineTerminate: cfg.BootDeadlineTerminate,
+
+		MetricsAddr: cfg.MetricsAddr,
+		Metrics:     lib.NewMetrics(),
 
 		InitScriptTemplate: template.Must(template.New("init-script").Parse(cfg.InitScriptTemplate)),
 	}
@@ -56,9 +82,59 @@ func Main(cfg *Config) {
 		log.WithField("region", cfg.AWSRegion).Fatal("invalid region")
 		os.Exit(1)
 	}
+
+	imageSelectors, err := lib.ParseImageSelectors(cfg.ImageSelectors)
+	if err != nil {
+		log.WithField("err", err).Fatal("invalid image selectors")
+		os.Exit(1)
+	}
+
+	imageRetention, err := lib.ParseImageRetention(cfg.ImageRetention)
+	if err != nil {
+		log.WithField("err", err).Fatal("invalid image retention")
+		os.Exit(1)
+	}
+
+	topology, err := lib.ParseTopology(cfg.Topology)
+	if err != nil {
+		log.WithField("err", err).Fatal("invalid topology")
+		os.Exit(1)
+	}
+
+	topology.DefaultRegion = region.Name
+
+	tagPolicy, err := lib.ParseTagPolicy(cfg.TagPolicy)
+	if err != nil {
+		log.WithField("err", err).Fatal("invalid tag policy")
+		os.Exit(1)
+	}
+
+	keyring, err := lib.ParseKeyring(cfg.InitScriptKeys)
+	if err != nil {
+		log.WithField("err", err).Fatal("invalid init script keys")
+		os.Exit(1)
+	}
+
+	if !keyring.Enabled() {
+		log.Warn("no init script keys given, init scripts will be stored unencrypted")
+	}
+
+	ic.ImageSelectors = imageSelectors
+	ic.Topology = topology
+	ic.TagPolicy = tagPolicy
+	ic.InitScriptKeyring = keyring
+	ic.ImageRetention = imageRetention
 	ic.AWSAuth = auth
 	ic.AWSRegion = region
 
+	fleet, err := newEC2Fleet(auth, region, topology, fmt.Sprintf("pudding-%s", cfg.ProcessID))
+	if err != nil {
+		log.WithField("err", err).Fatal("invalid topology regions")
+		os.Exit(1)
+	}
+
+	ic.EC2Fleet = fleet
+
 	if ic.InstanceRSA == "" {
 		log.Fatal("missing instance rsa key")
 		os.Exit(1)
@@ -99,3 +175,52 @@ func Main(cfg *Config) {
 		os.Exit(1)
 	}
 }
+
+// CheckConfig verifies that the topology parses, and that the
+// instance yml and init script template render for every site and env
+// of the topology and every site, env, and queue the instance yml
+// mentions, where the stored init script templates take precedence
+// over the given one as they do for instance builds
+func CheckConfig(cfg *Config) []error {
+	errors := []error{}
+
+	topology, err := lib.ParseTopology(cfg.Topology)
+	if err != nil {
+		errors = append(errors, fmt.Errorf("topology: %v", err))
+	}
+
+	_, err = lib.ParseTagPolicy(cfg.TagPolicy)
+	if err != nil {
+		errors = append(errors, fmt.Errorf("tag policy: %v", err))
+	}
+
+	return append(errors, lib.CheckInstanceConfig(cfg.InstanceYML, cfg.InitScriptTemplate, cfg.InstanceRSA, topology,
+		storedInitScriptTemplates(cfg.RedisURL, topology))...)
+}
+
+// storedInitScriptTemplates returns a func resolving the stored init
+// script template for an instance build with the topology defaults
+// applied, or nil when there is no redis url
+func storedInitScriptTemplates(redisURL string, topology *lib.Topology) func(*lib.InstanceBuild) (*template.Template, error) {
+	if redisURL == "" {
+		return nil
+	}
+
+	r, err := db.BuildRedisPool(redisURL)
+	if err != nil {
+		return func(*lib.InstanceBuild) (*template.Template, error) {
+			return nil, err
+		}
+	}
+
+	return func(b *lib.InstanceBuild) (*template.Template, error) {
+		if topology != nil {
+			topology.ApplyDefaults(b)
+		}
+
+		conn := r.Get()
+		defer conn.Close()
+
+		return db.ResolveInitScriptTemplate(conn, b, nil)
+	}
+}
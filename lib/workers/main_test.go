@@ -0,0 +1,122 @@
+package workers
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var testCheckConfigTopology = `sites: [org, com]
+envs: [prod, staging]
+roles:
+  worker: {}
+`
+
+var testCheckConfigYML = `global:
+  queue: "builds.{{.Queue}}"
+sites:
+  org: {}
+  com: {}
+envs:
+  prod: {}
+  staging: {}
+queues:
+  org.prod.docker:
+    count: "{{.Count}}"
+`
+
+func TestCheckConfig(t *testing.T) {
+	for _, c := range []struct {
+		desc     string
+		topology string
+		yml      string
+		template string
+		expected []string
+	}{
+		{
+			"every topology site and env covered",
+			testCheckConfigTopology, testCheckConfigYML, "#!/bin/bash\n{{.InstanceYML}}",
+			[]string{},
+		},
+		{
+			"topology env missing from the instance yml",
+			testCheckConfigTopology,
+			"sites:\n  org: {}\n  com: {}\nenvs:\n  prod: {}\n",
+			"#!/bin/bash",
+			[]string{
+				"com/staging/check: envs.com.staging missing",
+				"org/staging/check: envs.org.staging missing",
+			},
+		},
+		{
+			"topology site missing from the instance yml",
+			testCheckConfigTopology,
+			"sites:\n  org: {}\nenvs:\n  prod: {}\n  staging: {}\n",
+			"#!/bin/bash",
+			[]string{
+				"com/prod/check: sites.com missing",
+			},
+		},
+		{
+			"site env only for a queue missing from the topology",
+			testCheckConfigTopology,
+			testCheckConfigYML + "  com.test.docker: {}\n",
+			"#!/bin/bash",
+			[]string{
+				"com/test/docker: envs.com.test missing",
+			},
+		},
+		{
+			"default topology",
+			"", "sites:\n  org: {}\n  com: {}\nenvs:\n  prod: {}\n  staging: {}\n", "#!/bin/bash",
+			[]string{
+				"com/test/check: envs.com.test missing",
+				"org/test/check: envs.org.test missing",
+			},
+		},
+		{
+			"invalid topology",
+			"sites: []\n", testCheckConfigYML, "#!/bin/bash",
+			[]string{
+				"topology: topology must have at least one site",
+			},
+		},
+		{
+			"missing instance yml",
+			testCheckConfigTopology, "", "#!/bin/bash",
+			[]string{
+				"instance yml missing",
+			},
+		},
+		{
+			"unparseable init script template",
+			testCheckConfigTopology, testCheckConfigYML, "{{.Nope",
+			[]string{
+				"init script template: template: init-script:1: unclosed action",
+			},
+		},
+		{
+			"missing init script template",
+			testCheckConfigTopology, testCheckConfigYML, "",
+			[]string{
+				"com/prod/check: init script template missing",
+			},
+		},
+	} {
+		errors := CheckConfig(&Config{
+			Topology:           c.topology,
+			InstanceYML:        c.yml,
+			InitScriptTemplate: c.template,
+			InstanceRSA:        "rsa",
+		})
+
+		actual := []string{}
+		for _, err := range errors {
+			actual = append(actual, fmt.Sprintf("%v", err))
+		}
+
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%s: expected errors %q, got %q", c.desc, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package workers
+
+import (
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jrallison/go-workers"
+	"github.com/travis-ci/pudding/lib/db"
+)
+
+// serveMetrics listens on the metrics addr and responds to
+// `GET /metrics` with the workers' metrics, including the depth of
+// each queue being processed
+func serveMetrics(cfg *internalConfig, log *logrus.Logger) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		conn := workers.Config.Pool.Get()
+		defer conn.Close()
+
+		depths, err := db.FetchQueueDepths(conn, cfg.Queues)
+		if err != nil {
+			log.WithField("err", err).Error("failed to fetch queue depths")
+		}
+
+		for queue, depth := range depths {
+			cfg.Metrics.Set("pudding_queue_depth", map[string]string{"queue": queue}, float64(depth))
+		}
+
+		cfg.Metrics.ServeHTTP(w, req)
+	})
+
+	log.WithField("addr", cfg.MetricsAddr).Info("serving metrics")
+	err := http.ListenAndServe(cfg.MetricsAddr, mux)
+	if err != nil {
+		log.WithField("err", err).Error("failed to serve metrics")
+	}
+}
@@ -0,0 +1,449 @@
+package workers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/garyburd/redigo/redis"
+	"github.com/travis-ci/pudding/lib"
+	"github.com/travis-ci/pudding/lib/db"
+)
+
+type rolloutRunner struct {
+	cfg *internalConfig
+	log *logrus.Logger
+	n   []lib.Notifier
+	q   rolloutEnqueuer
+	i   db.InstanceFetcherStorer
+	ib  db.InstanceBuildGetterStorer
+	ip  db.ImagePinFetcherStorer
+	img db.ImageFetcherStorer
+	ro  db.RolloutBatcher
+}
+
+// rolloutEnqueuer enqueues the instance builds and terminations of
+// rollouts
+type rolloutEnqueuer interface {
+	EnqueueInstanceBuild(*lib.InstanceBuild) error
+	EnqueueInstanceTermination(string, string, string) error
+}
+
+type redisRolloutEnqueuer struct {
+	r *redis.Pool
+}
+
+func (rq *redisRolloutEnqueuer) EnqueueInstanceBuild(b *lib.InstanceBuild) error {
+	conn := rq.r.Get()
+	defer conn.Close()
+
+	return db.EnqueueInstanceBuild(conn, "instance-builds", b)
+}
+
+func (rq *redisRolloutEnqueuer) EnqueueInstanceTermination(instanceID, slackChannel, terminatedBy string) error {
+	conn := rq.r.Get()
+	defer conn.Close()
+
+	return db.EnqueueInstanceTermination(conn, "instance-terminations", instanceID, slackChannel, terminatedBy)
+}
+
+func newRolloutRunner(cfg *internalConfig, log *logrus.Logger) (*rolloutRunner, error) {
+	r, err := db.BuildRedisPool(cfg.RedisURL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := db.NewInstances(cfg.RedisURL.String(), log, cfg.InstanceStoreExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	ib, err := db.NewInstanceBuilds(cfg.RedisURL.String(), log, cfg.InstanceBuildStoreExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := db.NewImagePins(cfg.RedisURL.String(), log)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := db.NewImages(cfg.RedisURL.String(), log, cfg.ImageStoreExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	ro, err := db.NewRollouts(cfg.RedisURL.String(), log)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rolloutRunner{
+		cfg: cfg,
+		log: log,
+		n:   []lib.Notifier{lib.NewSlackNotifier(cfg.SlackHookPath, cfg.SlackUsername, cfg.SlackIcon)},
+		q:   &redisRolloutEnqueuer{r: r},
+		i:   i,
+		ib:  ib,
+		ip:  ip,
+		img: img,
+		ro:  ro,
+	}, nil
+}
+
+func (rr *rolloutRunner) Run() error {
+	rollouts, err := rr.ro.Fetch(map[string]string{})
+	if err != nil {
+		return err
+	}
+
+	for _, ro := range rollouts {
+		if !ro.IsActive() {
+			continue
+		}
+
+		locked, err := rr.ro.Lock(ro.ID, rr.cfg.ProcessID, rr.cfg.MiniWorkerInterval)
+		if err != nil {
+			return err
+		}
+
+		if !locked {
+			rr.log.WithField("rollout", ro.ID).Debug("rollout locked elsewhere, skipping")
+			continue
+		}
+
+		err = rr.advanceByID(ro.ID)
+		rr.ro.Unlock(ro.ID, rr.cfg.ProcessID)
+
+		if err != nil {
+			rr.log.WithFields(logrus.Fields{
+				"err":     err,
+				"rollout": ro.ID,
+			}).Error("failed to advance rollout")
+		}
+	}
+
+	return nil
+}
+
+func (rr *rolloutRunner) advanceByID(ID string) error {
+	rollouts, err := rr.ro.Fetch(map[string]string{"rollout_id": ID})
+	if err != nil {
+		return err
+	}
+
+	if len(rollouts) == 0 || !rollouts[0].IsActive() {
+		return nil
+	}
+
+	return rr.advance(rollouts[0])
+}
+
+func (rr *rolloutRunner) advance(ro *lib.Rollout) error {
+	if ro.State == "pending" {
+		err := rr.start(ro)
+		if err != nil {
+			return err
+		}
+	}
+
+	batch, err := rr.ro.Batch(ro.ID)
+	if err != nil {
+		return err
+	}
+
+	requeued := []string{}
+	for instanceBuildID, instanceID := range batch {
+		b, err := rr.ib.Get(instanceBuildID)
+		if err != nil {
+			return err
+		}
+
+		state := "missing"
+		if b != nil {
+			state = b.State
+		}
+
+		switch state {
+		case "finished":
+		case "failed", "timed-out", "missing":
+			// the instance it was replacing is picked again once the
+			// rollout is resumed
+			err = rr.ro.RequeueFromBatch(ro.ID, instanceBuildID, instanceID)
+			if err != nil {
+				return err
+			}
+
+			delete(batch, instanceBuildID)
+			requeued = append(requeued, fmt.Sprintf("`%s` (%s)", instanceBuildID, state))
+			continue
+		default:
+			continue
+		}
+
+		err = rr.terminate(ro, instanceID)
+		if err != nil {
+			return err
+		}
+
+		err = rr.ro.RemoveFromBatch(ro.ID, instanceBuildID)
+		if err != nil {
+			return err
+		}
+
+		delete(batch, instanceBuildID)
+		ro.Replaced++
+
+		rr.notify(ro, fmt.Sprintf("Rollout *%s* replaced `%s` with `%s` (%d/%d)",
+			ro.ID, instanceID, b.InstanceID, ro.Replaced, ro.Total))
+	}
+
+	ro.InFlight = len(batch)
+
+	if len(requeued) > 0 {
+		sort.Strings(requeued)
+		ro.State = "paused"
+		ro.Reason = fmt.Sprintf("%d instance build(s) did not finish: %s", len(requeued), strings.Join(requeued, ", "))
+		rr.notify(ro, fmt.Sprintf("Rollout *%s* paused :warning: _(%s)_", ro.ID, ro.Reason))
+		return rr.ro.Store(ro)
+	}
+
+	if len(batch) > 0 {
+		if rr.bootTimedOut(ro) {
+			ro.State = "paused"
+			ro.Reason = fmt.Sprintf("%d instance build(s) did not finish within %ds", len(batch), ro.BootTimeout)
+			rr.notify(ro, fmt.Sprintf("Rollout *%s* paused :warning: _(%s)_", ro.ID, ro.Reason))
+		}
+
+		return rr.ro.Store(ro)
+	}
+
+	outdated, err := rr.outdatedInstances(ro)
+	if err != nil {
+		return err
+	}
+
+	ro.Total = ro.Replaced + len(outdated)
+
+	if len(outdated) == 0 {
+		ro.State = "finished"
+		rr.notify(ro, fmt.Sprintf("Rollout *%s* finished replacing %d instance(s) with `%s` :tada:",
+			ro.ID, ro.Replaced, ro.AMI))
+		return rr.ro.Store(ro)
+	}
+
+	if len(outdated) > ro.BatchSize {
+		outdated = outdated[:ro.BatchSize]
+	}
+
+	for _, inst := range outdated {
+		errs := rr.cfg.TagPolicy.Validate(rr.cfg.TagPolicy.UserTags(inst.Tags))
+		if len(errs) > 0 {
+			ro.State = "paused"
+			ro.Reason = fmt.Sprintf("tags of `%s` do not satisfy the tag policy: %v", inst.InstanceID, errs[0])
+			rr.notify(ro, fmt.Sprintf("Rollout *%s* paused :warning: _(%s)_", ro.ID, ro.Reason))
+			return rr.ro.Store(ro)
+		}
+	}
+
+	for _, inst := range outdated {
+		err = rr.launchReplacement(ro, inst)
+		if err != nil {
+			return err
+		}
+	}
+
+	ro.InFlight = len(outdated)
+	ro.BatchStartedAt = time.Now().UTC().Format(time.RFC3339)
+
+	rr.notify(ro, fmt.Sprintf("Rollout *%s* launching %d replacement instance(s) (%d/%d replaced)",
+		ro.ID, len(outdated), ro.Replaced, ro.Total))
+
+	return rr.ro.Store(ro)
+}
+
+func (rr *rolloutRunner) start(ro *lib.Rollout) error {
+	if ro.AMI == "" {
+		f := rr.cfg.Topology.ImageFilter(ro.Role)
+
+		pinnedID, err := rr.pinnedImageID(ro)
+		if err != nil {
+			return err
+		}
+
+		rr.log.WithFields(logrus.Fields{
+			"rollout":   ro.ID,
+			"filter":    f,
+			"pinned_id": pinnedID,
+		}).Debug("resolving ami for rollout")
+
+		client, err := rr.cfg.EC2Fleet.Client(rr.location(ro))
+		if err != nil {
+			return err
+		}
+
+		img, err := lib.ResolveAMI(client, "", pinnedID, f,
+			lib.ImageSelectorForRole(rr.cfg.ImageSelectors, ro.Role))
+		if err != nil {
+			return err
+		}
+
+		ro.AMI = img.Id
+	}
+
+	ro.State = "running"
+	rr.notify(ro, fmt.Sprintf("Starting rollout *%s* of `%s` to %s/%s/%s in batches of %d",
+		ro.ID, ro.AMI, ro.Site, ro.Env, ro.Queue, ro.BatchSize))
+
+	return rr.ro.Store(ro)
+}
+
+// pinnedImageID returns the id of the image pinned for the role, site,
+// and env of the rollout, unless the pinned image was synced from
+// another location than the one the rollout replaces instances in
+func (rr *rolloutRunner) pinnedImageID(ro *lib.Rollout) (string, error) {
+	pinnedID, err := rr.ip.Get(ro.Role, ro.Site, ro.Env)
+	if err != nil || pinnedID == "" {
+		return "", err
+	}
+
+	images, err := rr.img.Fetch(map[string]string{"image_id": pinnedID})
+	if err != nil {
+		return "", err
+	}
+
+	loc := rr.location(ro)
+	for _, img := range images {
+		if img.ImageID == pinnedID && rr.cfg.EC2Fleet.Resolve(img.Location()).String() != loc.String() {
+			rr.log.WithFields(logrus.Fields{
+				"rollout":   ro.ID,
+				"pinned_id": pinnedID,
+				"location":  loc.String(),
+			}).Debug("ignoring image pinned in another location")
+			return "", nil
+		}
+	}
+
+	return pinnedID, nil
+}
+
+func (rr *rolloutRunner) location(ro *lib.Rollout) *lib.Location {
+	return rr.cfg.EC2Fleet.Resolve(&lib.Location{Region: ro.Region, Account: ro.Account})
+}
+
+func (rr *rolloutRunner) outdatedInstances(ro *lib.Rollout) ([]*lib.Instance, error) {
+	f := map[string]string{
+		"site":  ro.Site,
+		"env":   ro.Env,
+		"queue": ro.Queue,
+		"state": "running",
+	}
+	if ro.Role != "" {
+		f["role"] = ro.Role
+	}
+
+	loc := rr.location(ro)
+	f["region"] = loc.Region
+	f["account"] = loc.Account
+
+	instances, err := rr.i.Fetch(f)
+	if err != nil {
+		return nil, err
+	}
+
+	replaced, err := rr.ro.Replaced(ro.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	outdated := []*lib.Instance{}
+	for _, inst := range instances {
+		if inst.ImageID == ro.AMI || replaced[inst.InstanceID] {
+			continue
+		}
+		outdated = append(outdated, inst)
+	}
+
+	sort.Sort(instancesByLaunchTime(outdated))
+	return outdated, nil
+}
+
+func (rr *rolloutRunner) launchReplacement(ro *lib.Rollout, inst *lib.Instance) error {
+	b := lib.NewInstanceBuild()
+	b.Site = ro.Site
+	b.Env = ro.Env
+	b.Queue = ro.Queue
+	if ro.Role != "" {
+		b.Role = ro.Role
+	}
+	b.AMI = ro.AMI
+	b.Region = ro.Region
+	b.Account = ro.Account
+	b.Count = 1
+	b.SlackChannel = ro.SlackChannel
+	b.Requester = "rollout:" + ro.ID
+	b.Tags = rr.cfg.TagPolicy.UserTags(inst.Tags)
+	b.InstanceType = ro.InstanceType
+	if b.InstanceType == "" {
+		b.InstanceType = inst.InstanceType
+	}
+	rr.cfg.Topology.ApplyDefaults(b)
+
+	rr.log.WithFields(logrus.Fields{
+		"rollout":           ro.ID,
+		"instance_build_id": b.ID,
+		"replacing":         inst.InstanceID,
+	}).Info("launching replacement instance")
+
+	err := rr.ib.Store(b)
+	if err != nil {
+		return err
+	}
+
+	err = rr.q.EnqueueInstanceBuild(b)
+	if err != nil {
+		return err
+	}
+
+	return rr.ro.AddToBatch(ro.ID, b.ID, inst.InstanceID)
+}
+
+func (rr *rolloutRunner) terminate(ro *lib.Rollout, instanceID string) error {
+	rr.log.WithFields(logrus.Fields{
+		"rollout":     ro.ID,
+		"instance_id": instanceID,
+	}).Info("terminating replaced instance")
+
+	return rr.q.EnqueueInstanceTermination(instanceID, ro.SlackChannel, "rollout:"+ro.ID)
+}
+
+func (rr *rolloutRunner) bootTimedOut(ro *lib.Rollout) bool {
+	if ro.BootTimeout == 0 || ro.BatchStartedAt == "" {
+		return false
+	}
+
+	batchStartedAt, err := time.Parse(time.RFC3339, ro.BatchStartedAt)
+	if err != nil {
+		rr.log.WithFields(logrus.Fields{
+			"err":     err,
+			"rollout": ro.ID,
+		}).Warn("failed to parse batch start time")
+		return false
+	}
+
+	return time.Now().UTC().Sub(batchStartedAt) > time.Duration(ro.BootTimeout)*time.Second
+}
+
+func (rr *rolloutRunner) notify(ro *lib.Rollout, msg string) {
+	for _, notifier := range rr.n {
+		notifier.Notify(ro.SlackChannel, msg)
+	}
+}
+
+type instancesByLaunchTime []*lib.Instance
+
+func (s instancesByLaunchTime) Len() int           { return len(s) }
+func (s instancesByLaunchTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s instancesByLaunchTime) Less(i, j int) bool { return s[i].LaunchTime < s[j].LaunchTime }
@@ -0,0 +1,444 @@
+package workers
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/goamz/aws"
+	"github.com/travis-ci/pudding/lib"
+	"github.com/travis-ci/pudding/lib/db"
+)
+
+type testRollouts struct {
+	stored   *lib.Rollout
+	batch    map[string]string
+	replaced map[string]bool
+}
+
+func (tr *testRollouts) Fetch(map[string]string) ([]*lib.Rollout, error) {
+	return []*lib.Rollout{tr.stored}, nil
+}
+
+func (tr *testRollouts) Store(ro *lib.Rollout) error {
+	tr.stored = ro
+	return nil
+}
+
+func (tr *testRollouts) Lock(string, string, int) (bool, error) { return true, nil }
+func (tr *testRollouts) Unlock(string, string) error            { return nil }
+
+func (tr *testRollouts) Batch(string) (map[string]string, error) {
+	batch := map[string]string{}
+	for instanceBuildID, instanceID := range tr.batch {
+		batch[instanceBuildID] = instanceID
+	}
+	return batch, nil
+}
+
+func (tr *testRollouts) AddToBatch(ID, instanceBuildID, instanceID string) error {
+	tr.batch[instanceBuildID] = instanceID
+	tr.replaced[instanceID] = true
+	return nil
+}
+
+func (tr *testRollouts) RemoveFromBatch(ID, instanceBuildID string) error {
+	delete(tr.batch, instanceBuildID)
+	return nil
+}
+
+func (tr *testRollouts) RequeueFromBatch(ID, instanceBuildID, instanceID string) error {
+	delete(tr.batch, instanceBuildID)
+	delete(tr.replaced, instanceID)
+	return nil
+}
+
+func (tr *testRollouts) Replaced(string) (map[string]bool, error) {
+	replaced := map[string]bool{}
+	for instanceID := range tr.replaced {
+		replaced[instanceID] = true
+	}
+	return replaced, nil
+}
+
+type testInstanceBuilds struct {
+	builds map[string]*lib.InstanceBuild
+}
+
+func (tib *testInstanceBuilds) Get(ID string) (*lib.InstanceBuild, error) {
+	return tib.builds[ID], nil
+}
+
+func (tib *testInstanceBuilds) Store(b *lib.InstanceBuild) error {
+	tib.builds[b.ID] = b
+	return nil
+}
+
+func (tib *testInstanceBuilds) InitScriptFetches(string) ([]*lib.InitScriptFetch, error) {
+	return nil, nil
+}
+
+func (tib *testInstanceBuilds) RecordInitScriptFetch(string, *lib.InitScriptFetch) error {
+	return nil
+}
+
+func (tib *testInstanceBuilds) ClaimBooting(string) (bool, error) { return true, nil }
+
+type testInstances struct {
+	instances []*lib.Instance
+}
+
+func (ti *testInstances) Fetch(map[string]string) ([]*lib.Instance, error) {
+	return ti.instances, nil
+}
+
+func (ti *testInstances) FetchFields(map[string]string, []string) ([]*lib.Instance, error) {
+	return ti.instances, nil
+}
+
+func (ti *testInstances) Sync(map[string]*lib.Instance, []*lib.Location) ([]*lib.InstanceEvent, error) {
+	return nil, nil
+}
+
+func (ti *testInstances) FetchEvents(string) ([]*lib.InstanceEvent, error) { return nil, nil }
+
+func (ti *testInstances) FetchSyncHistory(int) ([]*lib.EC2SyncHistoryEntry, error) {
+	return nil, nil
+}
+
+func (ti *testInstances) FetchConsoleOutput(string) (*lib.ConsoleOutput, error) { return nil, nil }
+
+type testRolloutEnqueuer struct {
+	builds       []*lib.InstanceBuild
+	terminations []string
+}
+
+func (tq *testRolloutEnqueuer) EnqueueInstanceBuild(b *lib.InstanceBuild) error {
+	tq.builds = append(tq.builds, b)
+	return nil
+}
+
+func (tq *testRolloutEnqueuer) EnqueueInstanceTermination(instanceID, slackChannel, terminatedBy string) error {
+	tq.terminations = append(tq.terminations, instanceID)
+	return nil
+}
+
+var (
+	_ db.RolloutBatcher = &db.Rollouts{}
+	_ rolloutEnqueuer   = &redisRolloutEnqueuer{}
+)
+
+func TestRolloutRunnerAdvance(t *testing.T) {
+	topo := lib.DefaultTopology()
+	fleet, err := newEC2Fleet(aws.Auth{}, aws.Region{Name: "us-east-1"}, topo, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := logrus.New()
+	log.Level = logrus.PanicLevel
+
+	longAgo := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+
+	outdated := []*lib.Instance{
+		{InstanceID: "i-new", ImageID: "ami-old", LaunchTime: "2015-03-03T00:00:00Z"},
+		{InstanceID: "i-oldest", ImageID: "ami-old", LaunchTime: "2015-03-01T00:00:00Z"},
+		{InstanceID: "i-current", ImageID: "ami-new", LaunchTime: "2015-03-01T00:00:00Z"},
+		{InstanceID: "i-older", ImageID: "ami-old", LaunchTime: "2015-03-02T00:00:00Z"},
+	}
+
+	for _, c := range []struct {
+		desc           string
+		bootTimeout    int
+		batchStartedAt string
+		builds         map[string]*lib.InstanceBuild
+		batch          map[string]string
+		replaced       []string
+		instances      []*lib.Instance
+
+		state        string
+		inFlight     int
+		replacedN    int
+		terminations []string
+		launched     []string
+		requeued     []string
+	}{
+		{
+			desc:         "finished build terminates the replaced instance",
+			builds:       map[string]*lib.InstanceBuild{"b-1": {ID: "b-1", State: "finished", InstanceID: "i-1"}},
+			batch:        map[string]string{"b-1": "i-oldest"},
+			replaced:     []string{"i-oldest"},
+			state:        "finished",
+			replacedN:    1,
+			terminations: []string{"i-oldest"},
+		},
+		{
+			desc:     "booting build waits without a boot timeout",
+			builds:   map[string]*lib.InstanceBuild{"b-1": {ID: "b-1", State: "started"}},
+			batch:    map[string]string{"b-1": "i-oldest"},
+			replaced: []string{"i-oldest"},
+			state:    "running",
+			inFlight: 1,
+		},
+		{
+			desc:           "booting build past the boot timeout pauses",
+			bootTimeout:    60,
+			batchStartedAt: longAgo,
+			builds:         map[string]*lib.InstanceBuild{"b-1": {ID: "b-1", State: "pending"}},
+			batch:          map[string]string{"b-1": "i-oldest"},
+			replaced:       []string{"i-oldest"},
+			state:          "paused",
+			inFlight:       1,
+		},
+		{
+			desc:     "failed build pauses without a boot timeout",
+			builds:   map[string]*lib.InstanceBuild{"b-1": {ID: "b-1", State: "failed"}},
+			batch:    map[string]string{"b-1": "i-oldest"},
+			replaced: []string{"i-oldest"},
+			state:    "paused",
+			requeued: []string{"i-oldest"},
+		},
+		{
+			desc:     "timed out build pauses",
+			builds:   map[string]*lib.InstanceBuild{"b-1": {ID: "b-1", State: "timed-out"}},
+			batch:    map[string]string{"b-1": "i-oldest"},
+			replaced: []string{"i-oldest"},
+			state:    "paused",
+			requeued: []string{"i-oldest"},
+		},
+		{
+			desc:     "missing build pauses",
+			builds:   map[string]*lib.InstanceBuild{},
+			batch:    map[string]string{"b-1": "i-oldest"},
+			replaced: []string{"i-oldest"},
+			state:    "paused",
+			requeued: []string{"i-oldest"},
+		},
+		{
+			desc: "failed build pauses while the rest of the batch stays in flight",
+			builds: map[string]*lib.InstanceBuild{
+				"b-1": {ID: "b-1", State: "failed"},
+				"b-2": {ID: "b-2", State: "started"},
+				"b-3": {ID: "b-3", State: "finished", InstanceID: "i-3"},
+			},
+			batch:        map[string]string{"b-1": "i-oldest", "b-2": "i-older", "b-3": "i-new"},
+			replaced:     []string{"i-oldest", "i-older", "i-new"},
+			state:        "paused",
+			inFlight:     1,
+			replacedN:    1,
+			terminations: []string{"i-new"},
+			requeued:     []string{"i-oldest"},
+		},
+		{
+			desc:      "empty batch launches the oldest outdated instances",
+			builds:    map[string]*lib.InstanceBuild{},
+			batch:     map[string]string{},
+			instances: outdated,
+			state:     "running",
+			inFlight:  2,
+			launched:  []string{"i-oldest", "i-older"},
+		},
+		{
+			desc:      "requeued instance is replaced again after resuming",
+			builds:    map[string]*lib.InstanceBuild{},
+			batch:     map[string]string{},
+			replaced:  []string{"i-older"},
+			instances: outdated,
+			state:     "running",
+			inFlight:  2,
+			launched:  []string{"i-oldest", "i-new"},
+		},
+	} {
+		ro := lib.NewRollout()
+		ro.Site = "org"
+		ro.Env = "prod"
+		ro.Queue = "docker"
+		ro.AMI = "ami-new"
+		ro.State = "running"
+		ro.BatchSize = 2
+		ro.BootTimeout = c.bootTimeout
+		ro.BatchStartedAt = c.batchStartedAt
+
+		replaced := map[string]bool{}
+		for _, instanceID := range c.replaced {
+			replaced[instanceID] = true
+		}
+
+		tr := &testRollouts{stored: ro, batch: c.batch, replaced: replaced}
+		tib := &testInstanceBuilds{builds: c.builds}
+		tq := &testRolloutEnqueuer{}
+
+		rr := &rolloutRunner{
+			cfg: &internalConfig{
+				EC2Fleet:  fleet,
+				Topology:  topo,
+				TagPolicy: &lib.TagPolicy{},
+			},
+			log: log,
+			n:   []lib.Notifier{},
+			q:   tq,
+			i:   &testInstances{instances: c.instances},
+			ib:  tib,
+			ro:  tr,
+		}
+
+		err := rr.advance(ro)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.desc, err)
+			continue
+		}
+
+		if tr.stored.State != c.state {
+			t.Errorf("%s: expected state %q, got %q (%s)", c.desc, c.state, tr.stored.State, tr.stored.Reason)
+		}
+
+		if tr.stored.InFlight != c.inFlight {
+			t.Errorf("%s: expected %d in flight, got %d", c.desc, c.inFlight, tr.stored.InFlight)
+		}
+
+		if tr.stored.Replaced != c.replacedN {
+			t.Errorf("%s: expected %d replaced, got %d", c.desc, c.replacedN, tr.stored.Replaced)
+		}
+
+		if strings.Join(tq.terminations, ",") != strings.Join(c.terminations, ",") {
+			t.Errorf("%s: expected terminations %v, got %v", c.desc, c.terminations, tq.terminations)
+		}
+
+		launched := []string{}
+		for _, b := range tq.builds {
+			if b.Count != 1 || b.AMI != "ami-new" || b.Requester != "rollout:"+ro.ID {
+				t.Errorf("%s: unexpected replacement build %+v", c.desc, b)
+			}
+			if tib.builds[b.ID] != b {
+				t.Errorf("%s: expected replacement build %s to be stored", c.desc, b.ID)
+			}
+			launched = append(launched, tr.batch[b.ID])
+		}
+
+		if strings.Join(launched, ",") != strings.Join(c.launched, ",") {
+			t.Errorf("%s: expected replacements for %v, got %v", c.desc, c.launched, launched)
+		}
+
+		for _, instanceID := range c.requeued {
+			if tr.replaced[instanceID] {
+				t.Errorf("%s: expected %s to no longer be marked replaced", c.desc, instanceID)
+			}
+
+			for _, batchInstanceID := range tr.batch {
+				if batchInstanceID == instanceID {
+					t.Errorf("%s: expected %s to be removed from the batch", c.desc, instanceID)
+				}
+			}
+		}
+
+		if len(c.requeued) > 0 && !strings.Contains(tr.stored.Reason, "(failed)") &&
+			!strings.Contains(tr.stored.Reason, "(timed-out)") && !strings.Contains(tr.stored.Reason, "(missing)") {
+			t.Errorf("%s: expected reason to name the build state, got %q", c.desc, tr.stored.Reason)
+		}
+	}
+}
+
+func TestInstancesByLaunchTime(t *testing.T) {
+	instances := []*lib.Instance{
+		{InstanceID: "i-b", LaunchTime: "2015-03-02T00:00:00Z"},
+		{InstanceID: "i-c", LaunchTime: "2015-03-03T00:00:00Z"},
+		{InstanceID: "i-a", LaunchTime: "2015-03-01T00:00:00Z"},
+	}
+
+	sort.Sort(instancesByLaunchTime(instances))
+
+	IDs := []string{}
+	for _, inst := range instances {
+		IDs = append(IDs, inst.InstanceID)
+	}
+
+	if strings.Join(IDs, ",") != "i-a,i-b,i-c" {
+		t.Errorf("expected instances sorted by launch time, got %v", IDs)
+	}
+}
+
+type testImagePins struct {
+	pins map[string]string
+}
+
+func (tip *testImagePins) Fetch() ([]*lib.ImagePin, error) { return nil, nil }
+
+func (tip *testImagePins) Get(role, site, env string) (string, error) {
+	return tip.pins[role+":"+site+":"+env], nil
+}
+
+func (tip *testImagePins) Store(*lib.ImagePin) error { return nil }
+
+func (tip *testImagePins) Remove(string, string, string) error { return nil }
+
+type testImages struct {
+	images []*lib.Image
+}
+
+func (ti *testImages) Fetch(f map[string]string) ([]*lib.Image, error) {
+	images := []*lib.Image{}
+	for _, img := range ti.images {
+		if img.ImageID == f["image_id"] {
+			images = append(images, img)
+		}
+	}
+	return images, nil
+}
+
+func (ti *testImages) Store(map[string]*lib.Image) error { return nil }
+
+func (ti *testImages) CleanupReports() ([]*lib.ImageCleanupReport, error) { return nil, nil }
+
+func TestRolloutRunnerPinnedImageID(t *testing.T) {
+	fleet, err := newEC2Fleet(aws.Auth{}, aws.Region{Name: "us-east-1"}, lib.DefaultTopology(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := logrus.New()
+	log.Level = logrus.PanicLevel
+
+	rr := &rolloutRunner{
+		cfg: &internalConfig{EC2Fleet: fleet},
+		log: log,
+		ip: &testImagePins{pins: map[string]string{
+			"worker:org:prod": "ami-east",
+			"worker:org:test": "ami-west",
+			"worker:com:prod": "ami-unsynced",
+		}},
+		img: &testImages{images: []*lib.Image{
+			{ImageID: "ami-east"},
+			{ImageID: "ami-west", Region: "us-west-2"},
+		}},
+	}
+
+	for _, c := range []struct {
+		desc     string
+		site     string
+		env      string
+		region   string
+		expected string
+	}{
+		{"pinned in the workers' own region", "org", "prod", "", "ami-east"},
+		{"pinned in the workers' own region named explicitly", "org", "prod", "us-east-1", "ami-east"},
+		{"pinned in another region", "org", "prod", "us-west-2", ""},
+		{"pinned in the rollout's region", "org", "test", "us-west-2", "ami-west"},
+		{"pinned outside the rollout's region", "org", "test", "", ""},
+		{"pinned image not synced", "com", "prod", "", "ami-unsynced"},
+		{"not pinned", "com", "staging", "", ""},
+	} {
+		ro := &lib.Rollout{ID: "ro", Role: "worker", Site: c.site, Env: c.env, Region: c.region}
+
+		pinnedID, err := rr.pinnedImageID(ro)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.desc, err)
+			continue
+		}
+
+		if pinnedID != c.expected {
+			t.Errorf("%s: expected pinned id %q, got %q", c.desc, c.expected, pinnedID)
+		}
+	}
+}
@@ -43,6 +43,10 @@ func runWorkers(cfg *internalConfig, log *logrus.Logger) error {
 
 	go setupMiniWorkers(cfg, log, rm).Run()
 
+	if cfg.MetricsAddr != "" {
+		go serveMetrics(cfg, log)
+	}
+
 	log.Info("starting go-workers")
 	workers.Run()
 	return nil
@@ -60,6 +64,36 @@ func setupMiniWorkers(cfg *internalConfig, log *logrus.Logger, rm *MiddlewareRav
 		return syncer.Sync()
 	})
 
+	mw.Register("rollouts", func() error {
+		runner, err := newRolloutRunner(cfg, log)
+		if err != nil {
+			log.WithField("err", err).Error("failed to build rollout runner")
+			return err
+		}
+
+		return runner.Run()
+	})
+
+	mw.Register("image-cleanup", func() error {
+		cleaner, err := newImageCleaner(cfg, log)
+		if err != nil {
+			log.WithField("err", err).Error("failed to build image cleaner")
+			return err
+		}
+
+		return cleaner.Clean()
+	})
+
+	mw.Register("boot-deadlines", func() error {
+		checker, err := newBootDeadlineChecker(cfg, log)
+		if err != nil {
+			log.WithField("err", err).Error("failed to build boot deadline checker")
+			return err
+		}
+
+		return checker.Check()
+	})
+
 	mw.Register("keepalive", func() error {
 		_, err := http.Get(cfg.WebHost)
 		if err != nil {